@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ttlCache is an in-process cache that loads missing values on demand. An
+// entry older than refreshAfter is still served, but triggers a reload in the
+// background; an entry older than ttl is never served and is reloaded
+// synchronously. At most one background reload runs per key.
+type ttlCache[K comparable, V any] struct {
+	mu           sync.Mutex
+	entries      map[K]*cacheEntry[V]
+	generation   uint64
+	ttl          time.Duration
+	refreshAfter time.Duration
+	load         func(K) (V, error)
+	now          func() time.Time
+}
+
+type cacheEntry[V any] struct {
+	value      V
+	loadedAt   time.Time
+	refreshing bool
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration, load func(K) (V, error)) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		entries:      make(map[K]*cacheEntry[V]),
+		ttl:          ttl,
+		refreshAfter: ttl / 2,
+		load:         load,
+		now:          time.Now,
+	}
+}
+
+// Get returns the cached value for key, loading it if needed.
+func (c *ttlCache[K, V]) Get(key K) (V, error) {
+	c.mu.Lock()
+	generation := c.generation
+	entry, ok := c.entries[key]
+	if ok {
+		age := c.now().Sub(entry.loadedAt)
+		if age < c.ttl {
+			if age >= c.refreshAfter && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key, generation)
+			}
+			value := entry.value
+			c.mu.Unlock()
+			return value, nil
+		}
+	}
+	c.mu.Unlock()
+
+	value, err := c.load(key)
+	if err != nil {
+		return value, err
+	}
+	c.set(key, value, generation)
+	return value, nil
+}
+
+func (c *ttlCache[K, V]) refresh(key K, generation uint64) {
+	value, err := c.load(key)
+	if err != nil {
+		log.Printf("Background cache refresh failed: %v", err)
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.set(key, value, generation)
+}
+
+// set stores a loaded value unless the cache was invalidated after the load
+// started, in which case the value may already be outdated.
+func (c *ttlCache[K, V]) set(key K, value V, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		if entry, ok := c.entries[key]; ok {
+			entry.refreshing = false
+		}
+		return
+	}
+	c.entries[key] = &cacheEntry[V]{value: value, loadedAt: c.now()}
+}
+
+// Invalidate drops every entry whose key matches.
+func (c *ttlCache[K, V]) Invalidate(match func(K) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// prune drops expired entries so keys that are no longer requested, such as
+// finished batches, do not accumulate.
+func (c *ttlCache[K, V]) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if c.now().Sub(entry.loadedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// durationFromEnv parses a duration such as "5m" from the environment.
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return ttl
+}
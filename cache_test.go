@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTTLCache(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	var mu sync.Mutex
+	loads := 0
+	refreshed := make(chan struct{}, 1)
+
+	cache := newTTLCache(time.Minute, func(key int) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads++
+		if loads > 1 {
+			refreshed <- struct{}{}
+		}
+		return key * 10 * loads, nil
+	})
+	cache.now = clock.Now
+
+	if value, _ := cache.Get(1); value != 10 {
+		t.Fatalf("Expected first load to return 10, got %d", value)
+	}
+
+	clock.Advance(10 * time.Second)
+	if value, _ := cache.Get(1); value != 10 {
+		t.Errorf("Fresh entry should be served from the cache, got %d", value)
+	}
+
+	// Past the refresh point the stale value is served while it reloads
+	clock.Advance(30 * time.Second)
+	if value, _ := cache.Get(1); value != 10 {
+		t.Errorf("Stale entry should still be served during background refresh, got %d", value)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a background refresh")
+	}
+	// The refresh stores its result under the cache lock right after loading
+	deadline := time.Now().Add(time.Second)
+	for {
+		if value, _ := cache.Get(1); value == 20 || time.Now().After(deadline) {
+			if value != 20 {
+				t.Errorf("Expected refreshed value 20, got %d", value)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cache.Invalidate(func(key int) bool { return key == 1 })
+	if value, _ := cache.Get(1); value != 30 {
+		t.Errorf("Invalidated entry should be reloaded, got %d", value)
+	}
+	<-refreshed
+
+	clock.Advance(2 * time.Minute)
+	cache.prune()
+	if len(cache.entries) != 0 {
+		t.Errorf("Expired entries should be pruned, got %d", len(cache.entries))
+	}
+}
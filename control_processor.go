@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"relay-go-consumer/database"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// ControlMessage is an operational command published to the control topic.
+type ControlMessage struct {
+	Type    string `json:"type"`
+	UserID  int    `json:"user_id"`
+	BatchID int    `json:"batch_id"`
+}
+
+const (
+	// controlInvalidateCache drops cached credentials and weights for UserID,
+	// or for every user when UserID is zero. Publish it after changing ESP
+	// credentials, sending domains, routing, unsubscribe settings or stored
+	// templates.
+	controlInvalidateCache = "invalidate_cache"
+
+	// controlPauseBatch, controlResumeBatch and controlCancelBatch change the
+	// status of campaign BatchID. Batch messages of a paused campaign are held
+	// until it is resumed; those of a cancelled campaign are acknowledged
+	// without sending. Every consumer instance applies the change, which is
+	// harmless because only the first one finds the campaign in a state that
+	// allows it.
+	controlPauseBatch  = "pause_batch"
+	controlResumeBatch = "resume_batch"
+	controlCancelBatch = "cancel_batch"
+)
+
+func ProcessControlMessages(msg *sarama.ConsumerMessage) {
+	var control ControlMessage
+	err := json.Unmarshal(msg.Value, &control)
+	if err != nil {
+		log.Printf("Failed to unmarshal control message: %v", err)
+		return
+	}
+
+	switch control.Type {
+	case controlInvalidateCache:
+		invalidateUserCaches(control.UserID)
+	case controlPauseBatch, controlResumeBatch, controlCancelBatch:
+		database.InitDB()
+		action := strings.TrimSuffix(control.Type, "_batch")
+		if err := updateBatchStatus(database.GetDB(), control.BatchID, action); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		log.Printf("Batch %d: %s applied", control.BatchID, action)
+	default:
+		log.Printf("Unknown control message type: %s", control.Type)
+	}
+}
@@ -0,0 +1,7 @@
+-- Recipient domain and mailbox provider group for each event, used to weight
+-- ESPs separately for Gmail, Outlook, Yahoo and Apple recipients.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS recipient_domain VARCHAR(255);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS mailbox_provider VARCHAR(32);
+
+CREATE INDEX IF NOT EXISTS idx_events_mailbox_provider_processed_time
+    ON events (mailbox_provider, processed_time);
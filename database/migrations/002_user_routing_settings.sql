@@ -0,0 +1,9 @@
+-- Per-user choice of how provider weights are calculated:
+-- 'formula' (fixed scoring formula) or 'bandit' (Thompson sampling).
+CREATE TABLE IF NOT EXISTS user_routing_settings (
+    user_id    INTEGER PRIMARY KEY,
+    strategy   VARCHAR(32) NOT NULL DEFAULT 'formula'
+               CHECK (strategy IN ('formula', 'bandit')),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,18 @@
+-- Per-user scoring profile (JSON) used to calculate provider weights, e.g.
+-- {"open_weight": 0.5, "delivery_weight": 0.2, "bounce_weight": 0.3,
+--  "spam_weight": 0.2, "deferred_weight": 0, "min_sample_size": 100,
+--  "decay_window_days": 30,
+--  "provider_limits": {"sendgrid": {"floor": 100, "ceiling": 600}}}
+-- Missing fields fall back to the defaults.
+ALTER TABLE user_routing_settings ADD COLUMN IF NOT EXISTS scoring_profile JSONB;
+
+-- Spam complaints are recorded explicitly instead of being inferred from
+-- dropped_reason.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS spam_report BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS spam_report_time BIGINT;
+
+UPDATE events
+SET spam_report = TRUE,
+    spam_report_time = dropped_time
+WHERE dropped
+  AND (dropped_reason ILIKE '%spam%' OR dropped_reason = 'Complaint');
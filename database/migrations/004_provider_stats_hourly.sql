@@ -0,0 +1,51 @@
+-- Hourly per-user, per-ESP and per-mailbox-provider statistics maintained by
+-- the event pipeline as events are saved. Provider weighting reads these
+-- instead of scanning the events table. Each counter counts messages.
+CREATE TABLE IF NOT EXISTS provider_stats_hourly (
+    user_id          INT NOT NULL,
+    esp_id           INT NOT NULL,
+    provider         TEXT NOT NULL,
+    mailbox_provider TEXT NOT NULL DEFAULT 'other',
+    bucket_start     TIMESTAMPTZ NOT NULL,
+    total_events     BIGINT NOT NULL DEFAULT 0,
+    delivered        BIGINT NOT NULL DEFAULT 0,
+    bounced          BIGINT NOT NULL DEFAULT 0,
+    opened           BIGINT NOT NULL DEFAULT 0,
+    deferred         BIGINT NOT NULL DEFAULT 0,
+    complaints       BIGINT NOT NULL DEFAULT 0,
+    clicks           BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, esp_id, mailbox_provider, bucket_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_provider_stats_hourly_user_bucket
+    ON provider_stats_hourly (user_id, bucket_start);
+
+-- Clicks are recorded alongside opens.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS click BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS click_count INT NOT NULL DEFAULT 0;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS last_click_time BIGINT;
+
+-- Backfill from existing events. Run before the consumer starts updating the
+-- rollups, otherwise recent hours are skipped by ON CONFLICT.
+INSERT INTO provider_stats_hourly (
+    user_id, esp_id, provider, mailbox_provider, bucket_start,
+    total_events, delivered, bounced, opened, deferred, complaints, clicks
+)
+SELECT
+    mua.user_id,
+    mua.esp_id,
+    esp.provider_name,
+    COALESCE(e.mailbox_provider, 'other'),
+    date_trunc('hour', to_timestamp(e.processed_time)),
+    COUNT(*),
+    COUNT(CASE WHEN e.delivered THEN 1 END),
+    COUNT(CASE WHEN e.bounce THEN 1 END),
+    COUNT(CASE WHEN e.open THEN 1 END),
+    COUNT(CASE WHEN e.deferred THEN 1 END),
+    COUNT(CASE WHEN e.spam_report THEN 1 END),
+    COUNT(CASE WHEN e.click THEN 1 END)
+FROM events e
+JOIN message_user_associations mua ON e.message_id = mua.message_id
+JOIN email_service_providers esp ON mua.esp_id = esp.esp_id
+GROUP BY 1, 2, 3, 4, 5
+ON CONFLICT (user_id, esp_id, mailbox_provider, bucket_start) DO NOTHING;
@@ -0,0 +1,15 @@
+-- Recipients of each campaign batch handed to each provider. A row is written
+-- when the consumer finishes a batch and advances email_batches.current_batch.
+CREATE TABLE IF NOT EXISTS email_batch_provider_sends (
+    batch_id     INT NOT NULL REFERENCES email_batches (batch_id) ON DELETE CASCADE,
+    batch_number INT NOT NULL,
+    provider     TEXT NOT NULL,
+    sent_count   INT NOT NULL DEFAULT 0,
+    failed_count INT NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (batch_id, batch_number, provider)
+);
+
+-- Campaigns move through pending -> processing -> completed or failed.
+UPDATE email_batches SET status = 'pending' WHERE status IS NULL;
+ALTER TABLE email_batches ALTER COLUMN status SET DEFAULT 'pending';
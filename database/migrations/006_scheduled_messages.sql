@@ -0,0 +1,20 @@
+-- Messages (or the recipients of a message) held until their send_at time.
+-- payload is the Kafka message to send, limited to the recipients due at
+-- send_at and without ESP credentials.
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       INT NOT NULL,
+    batch_id      INT,
+    message_id    TEXT,
+    send_at       TIMESTAMPTZ NOT NULL,
+    payload       JSONB NOT NULL,
+    status        TEXT NOT NULL DEFAULT 'pending'
+                  CHECK (status IN ('pending', 'dispatching', 'sent', 'cancelled')),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    dispatched_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due
+    ON scheduled_messages (send_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_batch
+    ON scheduled_messages (batch_id) WHERE status = 'pending';
@@ -0,0 +1,15 @@
+-- Stored templates referenced from the email payload by template_id and an
+-- optional template_version. Without a version the highest active version is
+-- used. sections is a JSON object of section name to template source.
+CREATE TABLE IF NOT EXISTS email_templates (
+    user_id     INT NOT NULL,
+    template_id TEXT NOT NULL,
+    version     INT NOT NULL CHECK (version > 0),
+    subject     TEXT,
+    html_body   TEXT,
+    text_body   TEXT,
+    sections    JSONB,
+    active      BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, template_id, version)
+);
@@ -0,0 +1,13 @@
+-- Provider copies of stored template versions, created the first time a
+-- message with template_mode "native" is routed to a provider. An empty
+-- provider_template_id records that the provider's template language cannot
+-- express the template, so it is rendered locally.
+CREATE TABLE IF NOT EXISTS esp_template_mappings (
+    user_id              INT NOT NULL,
+    template_id          TEXT NOT NULL,
+    version              INT NOT NULL,
+    provider             TEXT NOT NULL,
+    provider_template_id TEXT NOT NULL,
+    synced_at            TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, template_id, version, provider)
+);
@@ -0,0 +1,6 @@
+-- Correlation ID stamped on outbound messages (the request's MessageID and
+-- the recipient index) and returned by the providers in their events, used to
+-- join events back to the originating request.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS correlation_id VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_events_correlation_id ON events (correlation_id);
@@ -0,0 +1,19 @@
+-- Recipients rejected by pre-send validation, with the reasons as a JSON list
+-- of {code, field, detail} and the personalization as it was received, so
+-- they can be reviewed and resent once fixed.
+CREATE TABLE IF NOT EXISTS rejected_recipients (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         INT NOT NULL,
+    batch_id        INT,
+    message_id      TEXT,
+    recipient_index INT NOT NULL,
+    recipient       TEXT,
+    reasons         JSONB NOT NULL,
+    personalization JSONB NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rejected_recipients_user
+    ON rejected_recipients (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_rejected_recipients_message
+    ON rejected_recipients (message_id);
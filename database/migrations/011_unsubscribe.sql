@@ -0,0 +1,32 @@
+-- Per-user List-Unsubscribe configuration. When enabled, every recipient gets
+-- a token signed with secret, sent as one-click List-Unsubscribe headers
+-- pointing at base_url (and mailto when set). footer_html and footer_text may
+-- use {{unsubscribe_url}} and are added to content that has no link itself.
+CREATE TABLE IF NOT EXISTS user_unsubscribe_settings (
+    user_id     INTEGER PRIMARY KEY,
+    enabled     BOOLEAN NOT NULL DEFAULT FALSE,
+    base_url    TEXT NOT NULL DEFAULT '',
+    mailto      TEXT,
+    secret      TEXT NOT NULL DEFAULT '',
+    footer_html TEXT,
+    footer_text TEXT,
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Recipients who unsubscribed from a user's mail, with the message they
+-- unsubscribed from when the token carried its correlation ID.
+CREATE TABLE IF NOT EXISTS unsubscribes (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         INT NOT NULL,
+    email           TEXT NOT NULL,
+    correlation_id  TEXT,
+    message_id      TEXT,
+    recipient_index INT,
+    method          VARCHAR(16),
+    unsubscribed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS idx_unsubscribes_message
+    ON unsubscribes (message_id);
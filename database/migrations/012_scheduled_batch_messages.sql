@@ -0,0 +1,6 @@
+-- Batch messages that arrive while their campaign is paused or inside
+-- interval_seconds are parked in scheduled_messages until the next batch is
+-- due. Dispatching a parked message advances the campaign, unlike scheduled
+-- recipients of a batch that was already sent.
+ALTER TABLE scheduled_messages
+    ADD COLUMN IF NOT EXISTS advances_batch BOOLEAN NOT NULL DEFAULT FALSE;
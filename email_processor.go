@@ -5,13 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"regexp"
 	"relay-go-consumer/database"
-	"strings"
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/lib/pq"
 )
 
 type KafkaMessage struct {
@@ -20,6 +18,8 @@ type KafkaMessage struct {
 	UserID    int                 `json:"UserID"`
 	Headers   map[string][]string `json:"headers"`
 	Body      EmailMessage        `json:"body"`
+	// SendAt optionally delays the message, see sendTime for the format
+	SendAt string `json:"send_at,omitempty"`
 }
 
 type BatchInfo struct {
@@ -45,13 +45,39 @@ func ProcessEmailMessages(msg *sarama.ConsumerMessage) {
 		log.Fatalf("Failed to parse JSON: %v", err)
 	}
 
-	batchID := kafkaMessage.BatchID
-
 	database.InitDB()
 	db := database.GetDB()
 
-	// Fetch ESP credentials from the database
-	credentials, credentialsErr := fetchESPCredentials(kafkaMessage.UserID)
+	// Recipients whose send time is in the future are handed to the scheduler
+	if kafkaMessage.hasSendAt() {
+		if err := scheduleFutureRecipients(db, &kafkaMessage, time.Now()); err != nil {
+			log.Printf("Failed to schedule message %s: %v", kafkaMessage.MessageID, err)
+			return
+		}
+		// A message whose recipients are all scheduled has nothing to validate
+		// or send now; a batch message's campaign advances when its earliest
+		// scheduled recipients are sent
+		if len(kafkaMessage.Body.Personalizations) == 0 {
+			log.Printf("No recipients of message %s are due yet", kafkaMessage.MessageID)
+			return
+		}
+	}
+
+	processEmailMessage(db, kafkaMessage, true)
+}
+
+// processEmailMessage sends a message through the providers selected for its
+// recipients. With trackBatch set, a batch message is parked in the scheduler
+// until its campaign is due and advances it once sent; scheduled deliveries
+// of a batch that was already recorded are sent without touching the
+// campaign.
+func processEmailMessage(db *sql.DB, kafkaMessage KafkaMessage, trackBatch bool) {
+	var err error
+	batchID := kafkaMessage.BatchID
+	initCaches()
+
+	// Fetch ESP credentials from the cache, falling back to the database
+	credentials, credentialsErr := credentialsCache.Get(kafkaMessage.UserID)
 	if credentialsErr != nil {
 		fmt.Printf("failed to fetch ESP credentials: %v", credentialsErr)
 		return
@@ -59,126 +85,229 @@ func ProcessEmailMessages(msg *sarama.ConsumerMessage) {
 
 	emailMessage := kafkaMessage.Body
 	emailMessage.Credentials = credentials
+	emailMessage.messageID = kafkaMessage.MessageID
+	emailMessage.userID = kafkaMessage.UserID
+
+	emailMessage, err = resolveStoredTemplate(emailMessage, kafkaMessage.UserID)
+	if err != nil {
+		log.Printf("Failed to resolve template for message %s: %v", kafkaMessage.MessageID, err)
+		return
+	}
+
+	// Recipients who unsubscribed are stored as rejected and not sent, but do
+	// not count as failed. They are removed first so the unsubscribe links
+	// belong to the recipients that remain
+	emailMessage, suppressed, err := suppressUnsubscribed(db, emailMessage, kafkaMessage.UserID)
+	if err != nil {
+		log.Printf("Failed to check unsubscribes for message %s: %v", kafkaMessage.MessageID, err)
+		return
+	}
+
+	// Recipients get their own signed unsubscribe links when the user has
+	// List-Unsubscribe enabled
+	unsubscribe, err := unsubscribeCache.Get(kafkaMessage.UserID)
+	if err != nil {
+		log.Printf("Failed to fetch unsubscribe settings for message %s: %v", kafkaMessage.MessageID, err)
+		return
+	}
+	emailMessage, err = withUnsubscribe(emailMessage, unsubscribe, kafkaMessage.UserID)
+	if err != nil {
+		log.Printf("Failed to add unsubscribe links to message %s: %v", kafkaMessage.MessageID, err)
+		return
+	}
 
-	// Calculate weights based on event data
-	var weights map[string]int
-	if batchID != 0 {
-		batchInfo, err := fetchBatchData(db, batchID)
+	// Weights for later batches of a campaign start from the time of the
+	// previous batch
+	key := weightsKey{UserID: kafkaMessage.UserID}
+	var batchInfo BatchInfo
+	if batchID != 0 && trackBatch {
+		var ready bool
+		var retryAt time.Time
+		batchInfo, ready, retryAt, err = checkBatch(db, batchID, time.Now())
 		if err != nil {
 			fmt.Printf("Failed to fetch batch data: %v", err)
 			return
 		}
+		if !ready {
+			if retryAt.IsZero() {
+				log.Printf("Skipping batch %d of campaign %d: campaign is %s", batchInfo.CurrentBatch+1, batchID, batchInfo.Status.String)
+				return
+			}
+			if err := parkBatchMessage(db, kafkaMessage, retryAt); err != nil {
+				log.Printf("%v", err)
+				return
+			}
+			log.Printf("Holding batch %d of campaign %d until %s", batchInfo.CurrentBatch+1, batchID, retryAt.Format(time.RFC3339))
+			return
+		}
+		if err := startBatch(db, batchID); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		if batchInfo.CurrentBatch >= 1 {
+			key.LastBatch = batchInfo.UpdatedAt.Unix()
+		}
+	}
 
-		currentTime := time.Now().UTC()
-		var startTime, endTime time.Time
-
-		if batchInfo.CurrentBatch < 1 {
-			// For the first batch, use the last 30 days
-			startTime = currentTime.AddDate(0, 0, -30)
-			endTime = currentTime
-		} else {
-			// For subsequent batches, use the time since the last batch
-			startTime = batchInfo.UpdatedAt
-			endTime = currentTime.Add(time.Duration(batchInfo.IntervalSeconds) * time.Second)
+	weights, err := weightsCache.Get(key)
+	if err != nil {
+		fmt.Printf("failed to calculate weights: %v", err)
+		if batchID != 0 && trackBatch {
+			failBatch(db, batchInfo, len(expandPersonalizations(emailMessage).Personalizations))
 		}
+		return
+	}
 
-		weights, err = calculateWeightsForTimeRange(db, kafkaMessage.UserID, credentials, startTime, endTime)
-		if err != nil {
-			fmt.Printf("failed to calculate weights: %v", err)
-			return
+	// Recipients that fail validation are stored with the reasons instead of
+	// being sent, and count as failed
+	var rejected []rejectedRecipient
+	if len(emailMessage.Personalizations) > 0 || len(suppressed) == 0 {
+		emailMessage, rejected = validateEmailMessage(emailMessage)
+	}
+	if all := append(suppressed, rejected...); len(all) > 0 {
+		for _, r := range all {
+			log.Printf("Rejected recipient %s of message %s: %v", r.Personalization.primaryRecipient().Email, kafkaMessage.MessageID, r.Issues)
 		}
-	} else {
-		// If batchID is 0, use the default 30 days back
-		endTime := time.Now()
-		startTime := endTime.AddDate(0, 0, -30)
-		weights, err = calculateWeightsForTimeRange(db, kafkaMessage.UserID, credentials, startTime, endTime)
-		if err != nil {
-			fmt.Printf("failed to calculate weights: %v", err)
-			return
+		if err := storeRejectedRecipients(db, kafkaMessage, all); err != nil {
+			log.Printf("%v", err)
 		}
 	}
 
-	sendEmailsImmediately(emailMessage, weights)
-}
+	counts := make(map[string]ProviderSendCount)
+	if len(emailMessage.Personalizations) > 0 {
+		selector := NewSenderSelector(nil, senderAffinityFromEnv(), campaignKey(kafkaMessage))
+		counts = sendEmailsImmediately(emailMessage, weights, selector)
+	}
+	if len(rejected) > 0 {
+		unsent := counts[""]
+		unsent.Failed += len(rejected)
+		counts[""] = unsent
+	}
 
-func sendEmailsImmediately(emailMessage EmailMessage, weights map[string]int) {
-	// If there are no personalizations, create one for each recipient
-	if len(emailMessage.Personalizations) == 0 {
-		for _, recipient := range emailMessage.To {
-			emailMessage.Personalizations = append(emailMessage.Personalizations, Personalization{
-				To:            recipient,
-				Subject:       emailMessage.Subject,
-				Substitutions: make(map[string]string),
-			})
+	if batchID != 0 && trackBatch {
+		if err := completeBatch(db, batchInfo, counts); err != nil {
+			log.Printf("%v", err)
 		}
 	}
+}
 
+// campaignKey scopes recipient affinity: every batch of a campaign shares the
+// batch ID, while stand-alone requests are keyed by their message ID.
+func campaignKey(kafkaMessage KafkaMessage) string {
+	if kafkaMessage.BatchID != 0 {
+		return fmt.Sprintf("batch:%d", kafkaMessage.BatchID)
+	}
+	return "message:" + kafkaMessage.MessageID
+}
+
+// sendEmailsImmediately sends every personalization through its selected
+// provider, logs each recipient a provider did not accept and returns how
+// many recipients each provider accepted.
+func sendEmailsImmediately(emailMessage EmailMessage, weights RoutingWeights, selector *SenderSelector) map[string]ProviderSendCount {
+	emailMessage = expandPersonalizations(emailMessage)
+
+	// Providers that cannot take the attachments get none of the recipients
+	if excluded := emailMessage.providersOverAttachmentLimit(); len(excluded) > 0 {
+		weights = weights.without(excluded)
+	}
+
+	emailMessage.Credentials.warnUnrestrictedProviders(emailMessage.userID)
 	senderGroups := make(map[string][]Personalization)
 	for _, p := range emailMessage.Personalizations {
-		sender := SelectSender(weights)
+		recipient := p.primaryRecipient().Email
+		providerWeights := weights.For(recipient)
+		if emailMessage.needsSMTPUTF8(p) {
+			providerWeights = onlyProviders(providerWeights, smtpUTF8Providers)
+		}
+		// Only providers set up for the sender's domain may send for it
+		from := emailMessage.envelopeFor(p).From
+		providerWeights = emailMessage.Credentials.authorizedWeights(providerWeights, from)
+		sender := selector.Select(providerWeights, recipient)
 		senderGroups[sender] = append(senderGroups[sender], p)
 	}
 	// Send emails using each selected sender
+	counts := make(map[string]ProviderSendCount)
 	for sender, personalizations := range senderGroups {
-		groupMessage := emailMessage
+		groupMessage := withNativeTemplate(emailMessage, sender)
 		groupMessage.Personalizations = personalizations
+		if !smtpUTF8Providers[sender] {
+			groupMessage = groupMessage.withASCIIDomains()
+		}
+
+		var results sendResults
 		switch sender {
 		case "sendgrid":
-			SendEmailWithSendGrid(groupMessage)
+			results = SendEmailWithSendGrid(groupMessage)
 		case "socketlabs":
-			SendEmailWithSocketLabs(groupMessage)
+			results = SendEmailWithSocketLabs(groupMessage)
 		case "postmark":
-			SendEmailWithPostmark(groupMessage)
+			results = SendEmailWithPostmark(groupMessage)
 		case "sparkpost":
-			SendEmailWithSparkPost(groupMessage)
+			results = SendEmailWithSparkPost(groupMessage)
+		case "":
+			results = newSendResults(len(personalizations))
+			results.setAll(allIndexes(results), fmt.Errorf("no configured provider can send this message"))
 		default:
-			log.Printf("No valid credentials found for sender: %s", sender)
+			results = newSendResults(len(personalizations))
+			results.setAll(allIndexes(results), fmt.Errorf("no valid credentials found for sender: %s", sender))
 		}
+
+		sent := results.sent()
+		if sent < len(personalizations) {
+			log.Printf("Failed to send %d of %d emails with %s: %v", len(personalizations)-sent, len(personalizations), sender, results.lastErr())
+			for i, err := range results {
+				if err != nil {
+					log.Printf("Not sent to %s with %s: %v", personalizations[i].primaryRecipient().Email, sender, err)
+				}
+			}
+		}
+		counts[sender] = ProviderSendCount{Sent: sent, Failed: len(personalizations) - sent}
 	}
+	return counts
 }
 
-func SelectSender(weights map[string]int) string {
-	totalWeight := 0
-	for _, weight := range weights {
-		totalWeight += weight
+// expandPersonalizations creates one personalization for each recipient when
+// the message has none, numbers the personalizations for correlation IDs,
+// and moves the message's Cc and Bcc onto the first
+// personalization so that copies are sent once rather than with every
+// recipient's message.
+func expandPersonalizations(emailMessage EmailMessage) EmailMessage {
+	if len(emailMessage.Personalizations) == 0 {
+		for _, recipient := range emailMessage.To {
+			emailMessage.Personalizations = append(emailMessage.Personalizations, Personalization{
+				To:            EmailAddressList{recipient},
+				Subject:       emailMessage.Subject,
+				Substitutions: make(map[string]string),
+			})
+		}
 	}
 
-	if totalWeight == 0 {
-		return ""
+	personalizations := make([]Personalization, len(emailMessage.Personalizations))
+	copy(personalizations, emailMessage.Personalizations)
+	for i := range personalizations {
+		if personalizations[i].Index == 0 {
+			personalizations[i].Index = i + 1
+		}
 	}
+	emailMessage.Personalizations = personalizations
 
-	randomValue := rand.Intn(totalWeight)
-	cumulativeWeight := 0
+	if len(personalizations) > 0 && len(emailMessage.Cc)+len(emailMessage.Bcc) > 0 {
+		first := &personalizations[0]
+		first.Cc = mergeAddresses(first.Cc, emailMessage.Cc)
+		first.Bcc = mergeAddresses(first.Bcc, emailMessage.Bcc)
 
-	for provider, weight := range weights {
-		cumulativeWeight += weight
-		if randomValue < cumulativeWeight {
-			return provider
-		}
+		emailMessage.Cc = nil
+		emailMessage.Bcc = nil
 	}
-
-	return "" // This should never happen if weights are calculated correctly
+	return emailMessage
 }
 
-// Custom unmarshaling logic for EmailAddress
+// UnmarshalJSON accepts an address string, such as "Ann <ann@example.com>",
+// or an object with email and name.
 func (e *EmailAddress) UnmarshalJSON(data []byte) error {
-	// Attempt to unmarshal as a simple string
 	var emailString string
 	if err := json.Unmarshal(data, &emailString); err == nil {
-		// Updated regex pattern to capture Friendly Name and Email Address
-		r := regexp.MustCompile(`(?i)(?:"?([^"<]*)"?\s*<([^>]+)>|([^<>\s]+@[^<>\s]+))`)
-		matches := r.FindStringSubmatch(emailString)
-		if len(matches) > 0 {
-			e.Name = strings.TrimSpace(matches[1])
-			if matches[2] != "" {
-				e.Email = strings.TrimSpace(matches[2])
-			} else {
-				e.Email = strings.TrimSpace(matches[3])
-			}
-		} else {
-			e.Email = emailString
-			e.Name = "" // No name available
-		}
+		*e = parseEmailAddress(emailString)
 		return nil
 	}
 
@@ -204,13 +333,18 @@ type Attachment struct {
 	Name        string `json:"name"`
 	Type        string `json:"type"`
 	ContentType string `json:"ContentType,omitempty"`
+	// Source references content that is not inline: an http(s) URL or a
+	// path in the attachment store, fetched when the message is sent
+	Source string `json:"source,omitempty"`
 }
 
 type EmailMessage struct {
-	From             EmailAddress
-	To               []EmailAddress
-	Cc               []string
-	Bcc              []string
+	From    EmailAddress
+	ReplyTo EmailAddress `json:"reply_to"`
+	To      []EmailAddress
+	// Cc and Bcc receive one copy of the message, not one per personalization
+	Cc               []EmailAddress
+	Bcc              []EmailAddress
 	Subject          string
 	TextBody         string
 	HtmlBody         string
@@ -222,6 +356,19 @@ type EmailMessage struct {
 	Personalizations []Personalization
 	Sections         map[string]string
 	Categories       []string
+	Tracking         Tracking `json:"tracking"`
+	// TemplateID references a stored template used instead of Content;
+	// TemplateVersion pins a version, otherwise the latest active one is used
+	TemplateID      string `json:"template_id"`
+	TemplateVersion int    `json:"template_version"`
+	// TemplateMode is "local" (the default) or "native" to send the
+	// providers' own copies of the template
+	TemplateMode string `json:"template_mode"`
+
+	resolved         *resolvedTemplate
+	nativeTemplateID string
+	messageID        string
+	userID           int
 }
 type Content struct {
 	Type  string `json:"type"`
@@ -229,9 +376,35 @@ type Content struct {
 }
 
 type Personalization struct {
-	To            EmailAddress
+	// To accepts a single address or a list; every address in it receives
+	// the same rendered message
+	To            EmailAddressList
 	Subject       string
 	Substitutions map[string]string
+	// Timezone is an IANA name such as "America/New_York". When set, the
+	// message's send_at clock time is read in this timezone.
+	Timezone string
+	// TemplateData holds structured values for templates, such as lists
+	// for {{#each}}
+	TemplateData map[string]interface{} `json:"template_data"`
+	// From and ReplyTo replace the message's values for this recipient, Cc
+	// and Bcc are copied on this recipient's message, and Headers and
+	// CustomArgs are merged over the message's
+	From       EmailAddress
+	ReplyTo    EmailAddress `json:"reply_to"`
+	Cc         []EmailAddress
+	Bcc        []EmailAddress
+	Headers    map[string]string
+	CustomArgs map[string]interface{} `json:"custom_args"`
+	// SendAt delays this recipient instead of the message's send_at
+	SendAt string `json:"send_at,omitempty"`
+	// Index is the 1-based position of the personalization in the request,
+	// kept when recipients are scheduled or routed to different providers
+	Index int `json:"recipient_index,omitempty"`
+	// recipientHeaders are generated for this recipient alone, such as its
+	// List-Unsubscribe link. They are kept apart from Headers so that
+	// recipients with different values can still share a provider request.
+	recipientHeaders map[string]string
 }
 
 type EmailAddress struct {
@@ -249,6 +422,9 @@ type Credentials struct {
 	SendgridWeight      string `json:"SendgridWeight"`
 	SparkpostAPIKey     string `json:"SparkpostAPIKey"`
 	SparkpostWeight     string `json:"SparkpostWeight"`
+	// SendingDomains lists, for each provider, the From domains it is set
+	// up to send for
+	SendingDomains map[string][]string `json:"SendingDomains"`
 }
 
 type StandardizedEvent struct {
@@ -272,6 +448,27 @@ type StandardizedEvent struct {
 	Dropped          bool
 	DroppedTime      *int64
 	DroppedReason    string
+	SpamReport       bool
+	SpamReportTime   *int64
+	Click            bool
+	ClickCount       int
+	LastClickTime    *int64
+	RecipientDomain  string
+	MailboxProvider  string
+	// CorrelationID is the ID stamped on the outbound message, see
+	// EmailMessage.correlationID
+	CorrelationID string
+	// SentMessageID is the ID the message was sent and associated with its
+	// user under, when MessageID was made unique per recipient
+	SentMessageID string
+}
+
+// sentMessageID returns the ID to attribute the event to a user with.
+func (event StandardizedEvent) sentMessageID() string {
+	if event.SentMessageID != "" {
+		return event.SentMessageID
+	}
+	return event.MessageID
 }
 
 type ESPCredential struct {
@@ -296,6 +493,7 @@ func fetchESPCredentials(userID int) (Credentials, error) {
                postmark_server_token,
                sendgrid_api_key,
                sparkpost_api_key,
+               sending_domains,
 			   weight
         FROM email_service_providers
         WHERE user_id = $1
@@ -315,6 +513,7 @@ func fetchESPCredentials(userID int) (Credentials, error) {
 			providerName, socketlabsServerID, socketlabsAPIKey,
 			postmarkServerKey, sendgridAPIKey,
 			sparkpostAPIKey, senderWeight sql.NullString
+			sendingDomains []string
 		)
 
 		err := rows.Scan(
@@ -323,6 +522,7 @@ func fetchESPCredentials(userID int) (Credentials, error) {
 			&postmarkServerKey,
 			&sendgridAPIKey,
 			&sparkpostAPIKey,
+			pq.Array(&sendingDomains),
 			&senderWeight,
 		)
 		if err != nil {
@@ -353,6 +553,14 @@ func fetchESPCredentials(userID int) (Credentials, error) {
 			}
 		default:
 			log.Printf("Unknown provider: %s", providerName.String)
+			continue
+		}
+
+		if len(sendingDomains) > 0 {
+			if creds.SendingDomains == nil {
+				creds.SendingDomains = make(map[string][]string)
+			}
+			creds.SendingDomains[providerName.String] = append(creds.SendingDomains[providerName.String], sendingDomains...)
 		}
 	}
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// smtpUTF8Providers accept addresses with non-ASCII local parts (RFC 6531).
+// The other providers are sent punycode domains, and recipients with
+// non-ASCII local parts are routed away from them.
+var smtpUTF8Providers = map[string]bool{
+	"sparkpost": true,
+}
+
+// parseEmailAddress reads an address string with an optional display name.
+// Names may be quoted, contain commas, be RFC 2047 encoded or be UTF-8, and
+// addresses may be internationalized. A string that cannot be parsed is
+// kept as the email, for validation to reject.
+func parseEmailAddress(s string) EmailAddress {
+	s = strings.TrimSpace(s)
+	if parsed, err := mail.ParseAddress(s); err == nil {
+		return EmailAddress{Name: parsed.Name, Email: parsed.Address}
+	}
+
+	// Unquoted names with specials, such as Smith, Ann <ann@example.com>
+	if open := strings.LastIndex(s, "<"); open >= 0 && strings.HasSuffix(s, ">") {
+		name := strings.Trim(strings.TrimSpace(s[:open]), `"`)
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+		return EmailAddress{Name: name, Email: strings.TrimSpace(s[open+1 : len(s)-1])}
+	}
+	return EmailAddress{Email: s}
+}
+
+// hasUTF8LocalPart reports whether an address needs SMTPUTF8 to be sent,
+// which punycode cannot avoid.
+func hasUTF8LocalPart(email string) bool {
+	at := strings.LastIndex(email, "@")
+	return at > 0 && !isASCII(email[:at])
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiDomain converts the domain of an address to punycode, leaving
+// addresses it cannot convert for the provider to reject.
+func asciiDomain(address EmailAddress) EmailAddress {
+	at := strings.LastIndex(address.Email, "@")
+	if at < 0 || isASCII(address.Email[at+1:]) {
+		return address
+	}
+	domain, err := idna.Lookup.ToASCII(address.Email[at+1:])
+	if err != nil {
+		return address
+	}
+	address.Email = address.Email[:at+1] + domain
+	return address
+}
+
+func asciiDomains(addresses []EmailAddress) []EmailAddress {
+	if addresses == nil {
+		return nil
+	}
+	converted := make([]EmailAddress, len(addresses))
+	for i, address := range addresses {
+		converted[i] = asciiDomain(address)
+	}
+	return converted
+}
+
+// withASCIIDomains converts every address of the message to punycode
+// domains, for providers that do not accept internationalized domains.
+func (emailMessage EmailMessage) withASCIIDomains() EmailMessage {
+	emailMessage.From = asciiDomain(emailMessage.From)
+	emailMessage.ReplyTo = asciiDomain(emailMessage.ReplyTo)
+	emailMessage.To = asciiDomains(emailMessage.To)
+	emailMessage.Cc = asciiDomains(emailMessage.Cc)
+	emailMessage.Bcc = asciiDomains(emailMessage.Bcc)
+
+	personalizations := make([]Personalization, len(emailMessage.Personalizations))
+	for i, p := range emailMessage.Personalizations {
+		p.To = asciiDomains(p.To)
+		p.From = asciiDomain(p.From)
+		p.ReplyTo = asciiDomain(p.ReplyTo)
+		p.Cc = asciiDomains(p.Cc)
+		p.Bcc = asciiDomains(p.Bcc)
+		personalizations[i] = p
+	}
+	emailMessage.Personalizations = personalizations
+	return emailMessage
+}
+
+// needsSMTPUTF8 reports whether any address of a personalization, including
+// its sender, has a non-ASCII local part.
+func (emailMessage EmailMessage) needsSMTPUTF8(p Personalization) bool {
+	env := emailMessage.envelopeFor(p)
+	for _, addresses := range [][]EmailAddress{{env.From, env.ReplyTo}, p.To, env.Cc, env.Bcc} {
+		for _, address := range addresses {
+			if hasUTF8LocalPart(address.Email) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyProviders returns the weights of the given providers.
+func onlyProviders(weights map[string]int, providers map[string]bool) map[string]int {
+	filtered := make(map[string]int, len(providers))
+	for provider, weight := range weights {
+		if providers[provider] {
+			filtered[provider] = weight
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEmailAddressUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected EmailAddress
+	}{
+		{`"ann@example.com"`, EmailAddress{Email: "ann@example.com"}},
+		{`"Ann <ann@example.com>"`, EmailAddress{Name: "Ann", Email: "ann@example.com"}},
+		{`"\"Smith, Ann \\\"A\\\"\" <ann@example.com>"`, EmailAddress{Name: `Smith, Ann "A"`, Email: "ann@example.com"}},
+		{`"Smith, Ann <ann@example.com>"`, EmailAddress{Name: "Smith, Ann", Email: "ann@example.com"}},
+		{`"=?UTF-8?B?Sm9zw6k=?= <jose@example.com>"`, EmailAddress{Name: "José", Email: "jose@example.com"}},
+		{`"Zoë <zoë@bücher.de>"`, EmailAddress{Name: "Zoë", Email: "zoë@bücher.de"}},
+		{`"not an address"`, EmailAddress{Email: "not an address"}},
+		{`{"email": "ann@example.com", "name": "Ann"}`, EmailAddress{Name: "Ann", Email: "ann@example.com"}},
+	}
+
+	for _, tt := range tests {
+		var address EmailAddress
+		if err := json.Unmarshal([]byte(tt.input), &address); err != nil {
+			t.Errorf("Unexpected error for %s: %v", tt.input, err)
+			continue
+		}
+		if address != tt.expected {
+			t.Errorf("Expected %+v for %s, got %+v", tt.expected, tt.input, address)
+		}
+	}
+}
+
+func TestInternationalizedAddresses(t *testing.T) {
+	emailMessage := EmailMessage{
+		From: EmailAddress{Name: "Bücher GmbH", Email: "news@bücher.de"},
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "ann@例子.广告"}}, Cc: []EmailAddress{{Email: "bob@example.com"}}},
+			{To: EmailAddressList{{Email: "用户@example.com"}}},
+		},
+	}
+
+	ascii := emailMessage.withASCIIDomains()
+	if ascii.From.Email != "news@xn--bcher-kva.de" || ascii.Personalizations[0].To[0].Email != "ann@xn--fsqu00a.xn--4rr70v" {
+		t.Errorf("Expected punycode domains, got %q and %q", ascii.From.Email, ascii.Personalizations[0].To[0].Email)
+	}
+	if emailMessage.Personalizations[0].To[0].Email != "ann@例子.广告" {
+		t.Error("Expected the original message to be left unchanged")
+	}
+
+	if emailMessage.needsSMTPUTF8(emailMessage.Personalizations[0]) || !emailMessage.needsSMTPUTF8(emailMessage.Personalizations[1]) {
+		t.Error("Expected only the non-ASCII local part to need SMTPUTF8")
+	}
+	weights := onlyProviders(map[string]int{"sendgrid": 60, "sparkpost": 40}, smtpUTF8Providers)
+	if len(weights) != 1 || weights["sparkpost"] != 40 {
+		t.Errorf("Expected only SMTPUTF8 providers, got %v", weights)
+	}
+
+	if formatted := formatAddress(ascii.From); formatted != "=?utf-8?q?B=C3=BCcher_GmbH?= <news@xn--bcher-kva.de>" {
+		t.Errorf("Expected an RFC 2047 encoded name, got %q", formatted)
+	}
+	if formatted := formatAddress(EmailAddress{Name: "Smith, Ann", Email: "ann@example.com"}); formatted != `"Smith, Ann" <ann@example.com>` {
+		t.Errorf("Expected a quoted name, got %q", formatted)
+	}
+}
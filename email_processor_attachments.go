@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// attachmentLimits is the largest total size of a message's attachments, as
+// base64 sent in the request, that each provider accepts.
+var attachmentLimits = map[string]int{
+	"sendgrid":   30 << 20,
+	"sparkpost":  20 << 20,
+	"postmark":   10 << 20,
+	"socketlabs": 10 << 20,
+}
+
+// maxAttachmentBytes bounds the decoded size of a message's attachments
+// together, and so how much is fetched by reference, since no provider could
+// send more than the largest limit.
+const maxAttachmentBytes = 30 << 20 / 4 * 3
+
+// blockedAttachmentExtensions are executable types the providers reject.
+var blockedAttachmentExtensions = map[string]bool{
+	".bat": true, ".cmd": true, ".com": true, ".cpl": true, ".exe": true,
+	".hta": true, ".jar": true, ".js": true, ".lnk": true, ".msi": true,
+	".pif": true, ".reg": true, ".scr": true, ".vbs": true, ".wsf": true,
+}
+
+// sniffedTypes are the declared types content sniffing recognizes reliably,
+// so a mismatch means the content is not what it claims to be.
+var sniffedTypes = map[string]bool{
+	"application/pdf": true,
+	"application/zip": true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+}
+
+// attachmentHTTPClient fetches attachment URLs. Every connection, including
+// those of redirects, is refused unless it goes to a public address, and
+// redirects must stay on allowed hosts. No proxy is used so the address
+// checked is the one connected to.
+var attachmentHTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("connection to %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		if !attachmentHostAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// publicIP reports whether ip is a globally routable unicast address, not a
+// loopback, private, link-local, shared (100.64.0.0/10) or unspecified one.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// attachmentHostAllowed reports whether attachments may be fetched from host:
+// one of the hosts in ATTACHMENT_URL_ALLOWED_HOSTS, a comma separated list,
+// or a subdomain of one. Without the setting no URL is fetched.
+func attachmentHostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(os.Getenv("ATTACHMENT_URL_ALLOWED_HOSTS"), ",") {
+		allowed = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(allowed), "."))
+		if allowed != "" && (host == allowed || strings.HasSuffix(host, "."+allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filename returns the attachment's file name; producers set either
+// Filename or Name.
+func (a Attachment) filename() string {
+	if a.Filename != "" {
+		return a.Filename
+	}
+	return a.Name
+}
+
+// prepareAttachments fetches attachments given by reference, and checks and
+// normalizes every attachment once for all providers: Content is standard
+// base64, Filename and Name are both set and Type is the validated or
+// sniffed content type. It also checks that the inline images the HTML
+// references are attached.
+func prepareAttachments(emailMessage EmailMessage) (EmailMessage, error) {
+	if len(emailMessage.Attachments) == 0 {
+		return emailMessage, validateInlineImages(emailMessage)
+	}
+
+	attachments := make([]Attachment, len(emailMessage.Attachments))
+	remaining := maxAttachmentBytes
+	for i, attachment := range emailMessage.Attachments {
+		prepared, size, err := prepareAttachment(attachment, remaining)
+		if err != nil {
+			name := attachment.filename()
+			if name == "" {
+				name = attachment.Source
+			}
+			return emailMessage, fmt.Errorf("invalid attachment %q: %v", name, err)
+		}
+		attachments[i] = prepared
+		remaining -= size
+	}
+	emailMessage.Attachments = attachments
+	return emailMessage, validateInlineImages(emailMessage)
+}
+
+// prepareAttachment checks and normalizes one attachment and returns its
+// decoded size, which may be at most limit, the budget left for the message.
+func prepareAttachment(attachment Attachment, limit int) (Attachment, int, error) {
+	var data []byte
+	var err error
+	switch {
+	case attachment.Content != "":
+		data, err = decodeAttachmentContent(attachment.Content)
+		if err == nil && len(data) > limit {
+			err = fmt.Errorf("attachments are larger than %d bytes in total", maxAttachmentBytes)
+		}
+	case attachment.Source != "":
+		data, err = fetchAttachment(attachment.Source, limit)
+		if attachment.filename() == "" {
+			attachment.Filename = path.Base(attachment.Source)
+		}
+	default:
+		err = fmt.Errorf("no content or source")
+	}
+	if err != nil {
+		return attachment, 0, err
+	}
+
+	name := attachment.filename()
+	if name == "" {
+		return attachment, 0, fmt.Errorf("missing filename")
+	}
+	if blockedAttachmentExtensions[strings.ToLower(filepath.Ext(name))] {
+		return attachment, 0, fmt.Errorf("file type is not allowed")
+	}
+	attachment.Filename = name
+	if attachment.Name == "" {
+		attachment.Name = name
+	}
+	attachment.ContentID = normalizeContentID(attachment.ContentID)
+
+	attachment.Type, err = attachmentType(attachment, data)
+	if err != nil {
+		return attachment, 0, err
+	}
+	attachment.ContentType = ""
+	attachment.Content = base64.StdEncoding.EncodeToString(data)
+	return attachment, len(data), nil
+}
+
+// decodeAttachmentContent accepts standard or URL-safe base64, with or
+// without padding and line breaks.
+func decodeAttachmentContent(content string) ([]byte, error) {
+	content = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, content)
+	content = strings.TrimRight(content, "=")
+
+	encoding := base64.RawStdEncoding
+	if strings.ContainsAny(content, "-_") {
+		encoding = base64.RawURLEncoding
+	}
+	data, err := encoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("content is not base64: %v", err)
+	}
+	return data, nil
+}
+
+// fetchAttachment reads at most limit bytes of an attachment from an http(s)
+// URL on an allowed host, or from a path in the object store mounted at
+// ATTACHMENT_STORE_DIR.
+func fetchAttachment(source string, limit int) ([]byte, error) {
+	var body io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL %s: %v", source, err)
+		}
+		if !attachmentHostAllowed(u.Hostname()) {
+			return nil, fmt.Errorf("fetching attachments from %s is not allowed", u.Hostname())
+		}
+		res, err := attachmentHTTPClient.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %v", source, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch %s: status %d", source, res.StatusCode)
+		}
+		body = res.Body
+	} else {
+		dir := os.Getenv("ATTACHMENT_STORE_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("ATTACHMENT_STORE_DIR is not set")
+		}
+		// Cleaning the path as if it were absolute keeps it inside the store
+		file, err := os.Open(filepath.Join(dir, filepath.Clean("/"+source)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", source, err)
+		}
+		defer file.Close()
+		body = file
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", source, err)
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("%s exceeds the %d bytes allowed for a message's attachments", source, maxAttachmentBytes)
+	}
+	return data, nil
+}
+
+// attachmentType validates the declared content type, or determines one from
+// the file extension or content when none, or only a generic one, is given.
+func attachmentType(attachment Attachment, data []byte) (string, error) {
+	declared := attachment.Type
+	if declared == "" {
+		declared = attachment.ContentType
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+
+	if declared == "" || declared == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(filepath.Ext(attachment.filename())); byExtension != "" {
+			return byExtension, nil
+		}
+		return sniffed, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q", declared)
+	}
+	if sniffedTypes[mediaType] && sniffed != mediaType {
+		return "", fmt.Errorf("content is %s, not %s", sniffed, mediaType)
+	}
+	return declared, nil
+}
+
+// attachmentSize is the total size of the message's attachments as base64.
+func (emailMessage EmailMessage) attachmentSize() int {
+	size := 0
+	for _, attachment := range emailMessage.Attachments {
+		size += len(attachment.Content)
+	}
+	return size
+}
+
+// providersOverAttachmentLimit returns the providers whose limit the
+// message's attachments exceed.
+func (emailMessage EmailMessage) providersOverAttachmentLimit() map[string]bool {
+	size := emailMessage.attachmentSize()
+	excluded := make(map[string]bool)
+	for provider, limit := range attachmentLimits {
+		if size > limit {
+			excluded[provider] = true
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestPrepareAttachments(t *testing.T) {
+	tests := []struct {
+		name         string
+		attachment   Attachment
+		expectedType string
+		expectErr    bool
+	}{
+		{"wrapped base64", Attachment{Filename: "a.txt", Content: "SGVsbG8g\r\nV29ybGQh", Type: "text/plain"}, "text/plain", false},
+		{"url-safe base64", Attachment{Name: "logo.png", Content: base64.RawURLEncoding.EncodeToString(pngHeader)}, "image/png", false},
+		{"sniffed type", Attachment{Name: "logo", Content: base64.StdEncoding.EncodeToString(pngHeader), Type: "application/octet-stream"}, "image/png", false},
+		{"mismatched type", Attachment{Name: "logo.png", Content: "SGVsbG8gV29ybGQh", Type: "image/png"}, "", true},
+		{"invalid type", Attachment{Name: "a.txt", Content: "SGVsbG8gV29ybGQh", Type: "text/"}, "", true},
+		{"blocked extension", Attachment{Name: "setup.EXE", Content: "SGVsbG8gV29ybGQh"}, "", true},
+		{"not base64", Attachment{Name: "a.txt", Content: "not base64!"}, "", true},
+		{"no filename", Attachment{Content: "SGVsbG8gV29ybGQh"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared, err := prepareAttachments(EmailMessage{Attachments: []Attachment{tt.attachment}})
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			attachment := prepared.Attachments[0]
+			if attachment.Type != tt.expectedType {
+				t.Errorf("Expected type %q, got %q", tt.expectedType, attachment.Type)
+			}
+			if attachment.Filename == "" || attachment.Name == "" {
+				t.Errorf("Expected both file names to be set, got %q and %q", attachment.Filename, attachment.Name)
+			}
+			if _, err := base64.StdEncoding.DecodeString(attachment.Content); err != nil {
+				t.Errorf("Expected standard base64 content, got %q", attachment.Content)
+			}
+		})
+	}
+}
+
+func TestPrepareAttachmentsFromSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "invoice.txt"), []byte("Invoice"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ATTACHMENT_STORE_DIR", dir)
+	t.Setenv("ATTACHMENT_URL_ALLOWED_HOSTS", "127.0.0.1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logo.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(pngHeader)
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback, which attachments are never
+	// fetched from
+	if _, err := prepareAttachments(EmailMessage{Attachments: []Attachment{{Source: server.URL + "/logo.png"}}}); err == nil {
+		t.Errorf("Expected fetching from a loopback address to be refused")
+	}
+
+	defer func(client *http.Client) { attachmentHTTPClient = client }(attachmentHTTPClient)
+	attachmentHTTPClient = server.Client()
+
+	prepared, err := prepareAttachments(EmailMessage{Attachments: []Attachment{
+		{Source: "invoice.txt"},
+		{Source: server.URL + "/logo.png"},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if prepared.Attachments[0].Content != base64.StdEncoding.EncodeToString([]byte("Invoice")) || prepared.Attachments[0].Filename != "invoice.txt" {
+		t.Errorf("Expected the stored file, got %+v", prepared.Attachments[0])
+	}
+	if prepared.Attachments[1].Type != "image/png" || prepared.Attachments[1].Filename != "logo.png" {
+		t.Errorf("Expected the fetched image, got %+v", prepared.Attachments[1])
+	}
+
+	for _, source := range []string{
+		"../invoice.txt/../../etc/passwd",
+		server.URL + "/missing.png",
+		strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/logo.png",
+	} {
+		if _, err := prepareAttachments(EmailMessage{Attachments: []Attachment{{Source: source}}}); err == nil {
+			t.Errorf("Expected an error for %s", source)
+		}
+	}
+}
+
+func TestPrepareAttachmentsTotalSize(t *testing.T) {
+	half := base64.StdEncoding.EncodeToString(make([]byte, maxAttachmentBytes/2+1))
+	_, err := prepareAttachments(EmailMessage{Attachments: []Attachment{
+		{Filename: "a.bin", Type: "application/octet-stream", Content: half},
+		{Filename: "b.bin", Type: "application/octet-stream", Content: half},
+	}})
+	if err == nil {
+		t.Errorf("Expected attachments over the total limit to be refused")
+	}
+}
+
+func TestAttachmentHostAllowed(t *testing.T) {
+	t.Setenv("ATTACHMENT_URL_ALLOWED_HOSTS", "cdn.example.com, files.example.org.")
+	for host, allowed := range map[string]bool{
+		"cdn.example.com":         true,
+		"CDN.example.com":         true,
+		"eu.cdn.example.com":      true,
+		"files.example.org":       true,
+		"example.com":             false,
+		"evilcdn.example.com":     false,
+		"cdn.example.com.evil.io": false,
+		"":                        false,
+	} {
+		if attachmentHostAllowed(host) != allowed {
+			t.Errorf("Expected %q allowed: %v", host, allowed)
+		}
+	}
+
+	t.Setenv("ATTACHMENT_URL_ALLOWED_HOSTS", "")
+	if attachmentHostAllowed("cdn.example.com") {
+		t.Errorf("Expected no host to be allowed without the setting")
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+	} {
+		if publicIP(net.ParseIP(address)) != public {
+			t.Errorf("Expected %s public: %v", address, public)
+		}
+	}
+}
+
+func TestProvidersOverAttachmentLimit(t *testing.T) {
+	emailMessage := EmailMessage{Attachments: []Attachment{{Content: strings.Repeat("A", 15<<20)}}}
+	excluded := emailMessage.providersOverAttachmentLimit()
+	if !excluded["postmark"] || !excluded["socketlabs"] || excluded["sendgrid"] || excluded["sparkpost"] {
+		t.Errorf("Expected Postmark and SocketLabs to be excluded, got %v", excluded)
+	}
+
+	weights := RoutingWeights{
+		Global:            map[string]int{"postmark": 50, "sendgrid": 50},
+		ByMailboxProvider: map[string]map[string]int{"gmail": {"postmark": 100}},
+	}.without(excluded)
+	if len(weights.Global) != 1 || weights.Global["sendgrid"] != 50 || weights.For("ann@gmail.com")["sendgrid"] != 50 {
+		t.Errorf("Unexpected weights %+v", weights)
+	}
+}
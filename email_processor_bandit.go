@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// RoutingStrategy selects how provider statistics are turned into weights.
+type RoutingStrategy string
+
+const (
+	// StrategyFormula scores providers with the fixed formula documented on
+	// scoreProviderStats.
+	StrategyFormula RoutingStrategy = "formula"
+	// StrategyBandit treats every provider as an arm of a multi-armed bandit
+	// and allocates traffic by Thompson sampling.
+	StrategyBandit RoutingStrategy = "bandit"
+)
+
+// banditDraws is the number of posterior samples used to estimate how often
+// each provider would win.
+const banditDraws = 2000
+
+// thompsonSamplingWeights allocates traffic in proportion to the probability
+// that each provider is the best one. Every provider has Beta posteriors,
+// starting from a uniform prior, on its delivery, open, bounce, spam and
+// deferral rates. A draw samples the posteriors of every provider and scores
+// the sampled rates with the profile's coefficients, as the formula scores
+// observed rates; the highest score wins the draw. Providers with fewer
+// events than the profile's minimum sample size are sampled from the prior
+// alone, providers with valid credentials take part even without any
+// statistics, and every eligible provider keeps the profile's minimum share of
+// the traffic.
+func thompsonSamplingWeights(stats []ProviderStats, credentials Credentials, profile ScoringProfile, rng *rand.Rand) map[string]int {
+	arms := make(map[string]ProviderStats)
+	for _, s := range stats {
+		if s.TotalEvents < float64(profile.MinSampleSize) {
+			s = ProviderStats{Name: s.Name}
+		}
+		arms[s.Name] = s
+	}
+	for _, provider := range providerNames {
+		if _, ok := arms[provider]; !ok && isValidProvider(provider, credentials) {
+			arms[provider] = ProviderStats{Name: provider}
+		}
+	}
+	if len(arms) == 0 {
+		return map[string]int{}
+	}
+
+	names := make([]string, 0, len(arms))
+	for name := range arms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	wins := make(map[string]int, len(names))
+	for draw := 0; draw < banditDraws; draw++ {
+		best := ""
+		bestReward := -1.0
+		for _, name := range names {
+			if reward := profile.sampleReward(arms[name], rng); reward > bestReward {
+				best = name
+				bestReward = reward
+			}
+		}
+		wins[best]++
+	}
+
+	minShare := math.Min(profile.BanditMinShare, 1/float64(len(names)))
+	shares := make(map[string]float64, len(names))
+	for _, name := range names {
+		shares[name] = minShare + (1-minShare*float64(len(names)))*float64(wins[name])/banditDraws
+	}
+
+	return normalizeWeights(shares)
+}
+
+// sampleReward scores one draw from a provider's posteriors. Opens are
+// sampled among delivered messages, so the open rate never exceeds the
+// delivery rate, and coefficients of zero skip their posterior.
+func (p ScoringProfile) sampleReward(s ProviderStats, rng *rand.Rand) float64 {
+	rate := func(events, total float64) float64 {
+		events = math.Min(events, total)
+		return sampleBeta(rng, 1+events, 1+total-events)
+	}
+
+	delivered := math.Min(s.DeliveredEvents, s.TotalEvents)
+	deliveryRate := rate(delivered, s.TotalEvents)
+	reward := p.DeliveryWeight * deliveryRate
+	if p.OpenWeight > 0 {
+		reward += p.OpenWeight * deliveryRate * rate(s.OpenEvents, delivered)
+	}
+	if p.BounceWeight > 0 {
+		reward -= p.BounceWeight * rate(s.BounceEvents, s.TotalEvents)
+	}
+	if p.SpamWeight > 0 {
+		reward -= p.SpamWeight * rate(s.SpamReportEvents, s.TotalEvents)
+	}
+	if p.DeferredWeight > 0 {
+		reward -= p.DeferredWeight * rate(s.DeferredEvents, s.TotalEvents)
+	}
+	return reward
+}
+
+// sampleBeta draws from Beta(alpha, beta) as the ratio of two gamma variates.
+func sampleBeta(rng *rand.Rand, alpha, beta float64) float64 {
+	x := sampleGamma(rng, alpha)
+	y := sampleGamma(rng, beta)
+	return x / (x + y)
+}
+
+// sampleGamma draws from Gamma(shape, 1) using the Marsaglia and Tsang method.
+// Shapes below one are boosted and corrected, though the bandit priors always
+// keep the shape at or above one.
+func sampleGamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return sampleGamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
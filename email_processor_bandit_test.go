@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestThompsonSamplingWeights(t *testing.T) {
+	stats := []ProviderStats{
+		{"sendgrid", 10000, 9800, 100, 5000, 50, 5},
+		{"postmark", 10000, 9000, 900, 2000, 50, 20},
+		{"sparkpost", 10000, 6000, 3900, 500, 50, 100}, // Had a bad month
+	}
+	credentials := Credentials{
+		SendgridAPIKey:      "sg",
+		PostmarkServerToken: "pm",
+		SparkpostAPIKey:     "sp",
+		SocketLabsServerID:  "1",
+		SocketLabsAPIKey:    "sl",
+	}
+
+	weights := thompsonSamplingWeights(stats, credentials, DefaultScoringProfile, rand.New(rand.NewSource(7)))
+
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total != 1000 {
+		t.Errorf("Weights should sum to 1000, got %d (%v)", total, weights)
+	}
+
+	for _, provider := range []string{"sendgrid", "postmark", "sparkpost", "socketlabs"} {
+		if weights[provider] < int(DefaultScoringProfile.BanditMinShare*1000) {
+			t.Errorf("Provider %s should keep at least the exploration share, got %v", provider, weights)
+		}
+	}
+
+	if weights["sendgrid"] <= weights["sparkpost"] {
+		t.Errorf("Best performing provider should receive more traffic than the worst, got %v", weights)
+	}
+
+	again := thompsonSamplingWeights(stats, credentials, DefaultScoringProfile, rand.New(rand.NewSource(7)))
+	if !reflect.DeepEqual(weights, again) {
+		t.Errorf("Identically seeded runs should produce identical weights: %v vs %v", weights, again)
+	}
+}
+
+func TestThompsonSamplingWeightsWithoutStats(t *testing.T) {
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+
+	weights := thompsonSamplingWeights(nil, credentials, DefaultScoringProfile, rand.New(rand.NewSource(1)))
+
+	if len(weights) != 2 {
+		t.Fatalf("Expected weights for the two configured providers, got %v", weights)
+	}
+	if weights["sendgrid"]+weights["postmark"] != 1000 {
+		t.Errorf("Weights should sum to 1000, got %v", weights)
+	}
+	if weights["sendgrid"] < 350 || weights["postmark"] < 350 {
+		t.Errorf("Providers without data should be explored roughly evenly, got %v", weights)
+	}
+}
+
+func TestThompsonSamplingWeightsUsesProfile(t *testing.T) {
+	stats := []ProviderStats{
+		{"sendgrid", 10000, 9800, 100, 5000, 50, 5},
+		{"postmark", 50, 10, 40, 0, 0, 10}, // Below the minimum sample size
+	}
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+
+	profile := DefaultScoringProfile
+	profile.MinSampleSize = 100
+	profile.BanditMinShare = 0.2
+	weights := thompsonSamplingWeights(stats, credentials, profile, rand.New(rand.NewSource(3)))
+	if weights["postmark"] < 200 {
+		t.Errorf("Expected postmark to keep the profile's minimum share, got %v", weights)
+	}
+
+	// With the sample size lowered, postmark's poor statistics count against it
+	profile.MinSampleSize = 10
+	profile.BanditMinShare = 0
+	weights = thompsonSamplingWeights(stats, credentials, profile, rand.New(rand.NewSource(3)))
+	if weights["postmark"] > 10 {
+		t.Errorf("Expected postmark's statistics to be used, got %v", weights)
+	}
+}
+
+func TestRoutingWeightsFromStatsUsesSource(t *testing.T) {
+	groupStats := map[string][]ProviderStats{
+		mailboxOther: {
+			{"sendgrid", 10000, 9800, 100, 5000, 50, 5},
+			{"postmark", 10000, 9000, 900, 2000, 50, 20},
+		},
+	}
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+	settings := RoutingSettings{Strategy: StrategyBandit, Profile: DefaultScoringProfile}
+
+	first := routingWeightsFromStats(groupStats, credentials, settings, rand.NewSource(11))
+	second := routingWeightsFromStats(groupStats, credentials, settings, rand.NewSource(11))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Identically seeded sources should produce identical weights: %v vs %v", first, second)
+	}
+}
@@ -2,8 +2,35 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"log"
+	"time"
 )
 
+// Batch statuses stored in email_batches.status. A batch with no status is
+// treated as pending.
+const (
+	batchStatusPending    = "pending"
+	batchStatusProcessing = "processing"
+	batchStatusCompleted  = "completed"
+	batchStatusFailed     = "failed"
+	batchStatusPaused     = "paused"
+	batchStatusCancelled  = "cancelled"
+)
+
+// Actions accepted by updateBatchStatus.
+const (
+	batchActionPause  = "pause"
+	batchActionResume = "resume"
+	batchActionCancel = "cancel"
+)
+
+// ProviderSendCount counts the recipients of one batch handed to a provider.
+type ProviderSendCount struct {
+	Sent   int
+	Failed int
+}
+
 func fetchBatchData(db *sql.DB, batchID int) (BatchInfo, error) {
 	var batch BatchInfo
 
@@ -34,3 +61,195 @@ func fetchBatchData(db *sql.DB, batchID int) (BatchInfo, error) {
 
 	return batch, nil
 }
+
+// totalBatches returns the number of batches in the campaign, deriving it from
+// the message count when total_batches has not been filled in.
+func (b BatchInfo) totalBatches() int {
+	if b.TotalBatches.Valid {
+		return int(b.TotalBatches.Int32)
+	}
+	if b.BatchSize <= 0 {
+		return 1
+	}
+	return (b.TotalMessages + b.BatchSize - 1) / b.BatchSize
+}
+
+// isFinished reports whether no further batches should be sent.
+func (b BatchInfo) isFinished() bool {
+	switch b.Status.String {
+	case batchStatusCompleted, batchStatusFailed, batchStatusCancelled:
+		return true
+	}
+	return b.CurrentBatch >= b.totalBatches()
+}
+
+// nextSendTime is the earliest time the next batch may be sent: the campaign
+// start for the first batch, and interval_seconds after the previous batch
+// for every later one.
+func (b BatchInfo) nextSendTime() time.Time {
+	if b.CurrentBatch == 0 {
+		return b.StartTime
+	}
+	return b.UpdatedAt.Add(time.Duration(b.IntervalSeconds) * time.Second)
+}
+
+// checkBatch reads the campaign of a batch message and reports whether its
+// next batch can be sent now. When it cannot, retryAt is when to look again:
+// the end of interval_seconds, or for a paused campaign the time it would
+// have been due, since the scheduler holds messages of paused campaigns until
+// they are resumed. A finished or cancelled campaign is not ready and has no
+// retry time, and its batch message is acknowledged without sending.
+func checkBatch(db *sql.DB, batchID int, now time.Time) (batch BatchInfo, ready bool, retryAt time.Time, err error) {
+	batch, err = fetchBatchData(db, batchID)
+	if err != nil {
+		return BatchInfo{}, false, time.Time{}, err
+	}
+	if batch.isFinished() {
+		return batch, false, time.Time{}, nil
+	}
+
+	next := batch.nextSendTime()
+	if batch.Status.String == batchStatusPaused {
+		if next.Before(now) {
+			next = now
+		}
+		return batch, false, next, nil
+	}
+	if next.After(now) {
+		return batch, false, next, nil
+	}
+	return batch, true, time.Time{}, nil
+}
+
+// startBatch marks a pending campaign as processing.
+func startBatch(db *sql.DB, batchID int) error {
+	_, err := db.Exec(`
+        UPDATE public.email_batches
+        SET status = $2, updated_at = NOW()
+        WHERE batch_id = $1 AND (status IS NULL OR status = $3)
+    `, batchID, batchStatusProcessing, batchStatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to start batch %d: %v", batchID, err)
+	}
+	return nil
+}
+
+// failBatch records a batch that was started but could not be sent, failing
+// the campaign so it does not stay processing forever.
+func failBatch(db *sql.DB, batch BatchInfo, recipients int) {
+	counts := map[string]ProviderSendCount{"": {Failed: recipients}}
+	if err := completeBatch(db, batch, counts); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// completeBatch records the per-provider send counts of the batch that was
+// just sent and advances the campaign. The campaign is completed after its
+// last batch, and failed when no recipient of a batch could be handed to any
+// provider. The update is conditional on current_batch so a redelivered Kafka
+// message cannot advance the campaign twice.
+func completeBatch(db *sql.DB, batch BatchInfo, counts map[string]ProviderSendCount) error {
+	batchNumber := batch.CurrentBatch + 1
+
+	sent := 0
+	for _, count := range counts {
+		sent += count.Sent
+	}
+
+	status := batchStatusProcessing
+	finished := false
+	switch {
+	case len(counts) > 0 && sent == 0:
+		status = batchStatusFailed
+		finished = true
+	case batchNumber >= batch.totalBatches():
+		status = batchStatusCompleted
+		finished = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// A campaign paused or cancelled while this batch was sending keeps that
+	// status
+	result, err := tx.Exec(`
+        UPDATE public.email_batches
+        SET current_batch = $2,
+            status = CASE WHEN status IN ('paused', 'cancelled') THEN status ELSE $3 END,
+            end_time = CASE WHEN $4 AND status IS DISTINCT FROM 'cancelled' THEN NOW() ELSE end_time END,
+            updated_at = NOW()
+        WHERE batch_id = $1 AND current_batch = $5
+    `, batch.BatchID, batchNumber, status, finished, batch.CurrentBatch)
+	if err != nil {
+		return fmt.Errorf("failed to update batch %d: %v", batch.BatchID, err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		log.Printf("Batch %d of campaign %d was already recorded", batchNumber, batch.BatchID)
+		return nil
+	}
+
+	for provider, count := range counts {
+		if provider == "" {
+			continue
+		}
+		_, err := tx.Exec(`
+            INSERT INTO email_batch_provider_sends (batch_id, batch_number, provider, sent_count, failed_count)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (batch_id, batch_number, provider) DO NOTHING
+        `, batch.BatchID, batchNumber, provider, count.Sent, count.Failed)
+		if err != nil {
+			return fmt.Errorf("failed to record send counts for batch %d: %v", batch.BatchID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batch %d: %v", batch.BatchID, err)
+	}
+	return nil
+}
+
+// updateBatchStatus pauses, resumes or cancels a campaign. Only campaigns that
+// are still running can be paused or cancelled, and only paused campaigns can
+// be resumed; a campaign that has not sent its first batch resumes as pending.
+// updated_at is left alone because it marks when the last batch was sent.
+func updateBatchStatus(db *sql.DB, batchID int, action string) error {
+	var query string
+	switch action {
+	case batchActionPause:
+		query = `
+            UPDATE public.email_batches
+            SET status = 'paused'
+            WHERE batch_id = $1 AND COALESCE(status, 'pending') IN ('pending', 'processing')
+        `
+	case batchActionResume:
+		query = `
+            UPDATE public.email_batches
+            SET status = CASE WHEN current_batch = 0 THEN 'pending' ELSE 'processing' END
+            WHERE batch_id = $1 AND status = 'paused'
+        `
+	case batchActionCancel:
+		query = `
+            UPDATE public.email_batches
+            SET status = 'cancelled', end_time = NOW()
+            WHERE batch_id = $1 AND COALESCE(status, 'pending') IN ('pending', 'processing', 'paused')
+        `
+	default:
+		return fmt.Errorf("unknown batch action: %s", action)
+	}
+
+	result, err := db.Exec(query, batchID)
+	if err != nil {
+		return fmt.Errorf("failed to %s batch %d: %v", action, batchID, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to %s batch %d: %v", action, batchID, err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("cannot %s batch %d: campaign not found or not in a state that allows it", action, batchID)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBatchInfoNextSendTime(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	updated := start.Add(time.Hour)
+
+	first := BatchInfo{StartTime: start, UpdatedAt: updated, IntervalSeconds: 600}
+	if !first.nextSendTime().Equal(start) {
+		t.Errorf("First batch should be due at the campaign start, got %v", first.nextSendTime())
+	}
+
+	later := BatchInfo{StartTime: start, UpdatedAt: updated, IntervalSeconds: 600, CurrentBatch: 2}
+	if expected := updated.Add(10 * time.Minute); !later.nextSendTime().Equal(expected) {
+		t.Errorf("Expected later batch to be due at %v, got %v", expected, later.nextSendTime())
+	}
+}
+
+func TestBatchInfoIsFinished(t *testing.T) {
+	testCases := []struct {
+		name     string
+		batch    BatchInfo
+		expected bool
+	}{
+		{"Batches remaining", BatchInfo{TotalMessages: 250, BatchSize: 100, CurrentBatch: 2}, false},
+		{"Derived total reached", BatchInfo{TotalMessages: 250, BatchSize: 100, CurrentBatch: 3}, true},
+		{"Explicit total reached", BatchInfo{TotalBatches: sql.NullInt32{Int32: 2, Valid: true}, CurrentBatch: 2}, true},
+		{"Failed campaign", BatchInfo{TotalMessages: 250, BatchSize: 100, Status: sql.NullString{String: batchStatusFailed, Valid: true}}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if finished := tc.batch.isFinished(); finished != tc.expected {
+				t.Errorf("Expected isFinished %v, got %v", tc.expected, finished)
+			}
+		})
+	}
+}
+
+func TestCompleteBatch(t *testing.T) {
+	testCases := []struct {
+		name           string
+		batch          BatchInfo
+		counts         map[string]ProviderSendCount
+		expectedStatus string
+		expectedEnd    bool
+	}{
+		{
+			name:           "Intermediate batch",
+			batch:          BatchInfo{BatchID: 7, TotalBatches: sql.NullInt32{Int32: 3, Valid: true}, CurrentBatch: 0},
+			counts:         map[string]ProviderSendCount{"sendgrid": {Sent: 60}, "postmark": {Sent: 38, Failed: 2}},
+			expectedStatus: batchStatusProcessing,
+		},
+		{
+			name:           "Last batch",
+			batch:          BatchInfo{BatchID: 7, TotalBatches: sql.NullInt32{Int32: 3, Valid: true}, CurrentBatch: 2},
+			counts:         map[string]ProviderSendCount{"sendgrid": {Sent: 100}},
+			expectedStatus: batchStatusCompleted,
+			expectedEnd:    true,
+		},
+		{
+			name:           "Nothing sent",
+			batch:          BatchInfo{BatchID: 7, TotalBatches: sql.NullInt32{Int32: 3, Valid: true}, CurrentBatch: 1},
+			counts:         map[string]ProviderSendCount{"sendgrid": {Failed: 100}},
+			expectedStatus: batchStatusFailed,
+			expectedEnd:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE public.email_batches").
+				WithArgs(tc.batch.BatchID, tc.batch.CurrentBatch+1, tc.expectedStatus, tc.expectedEnd, tc.batch.CurrentBatch).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			for range tc.counts {
+				mock.ExpectExec("INSERT INTO email_batch_provider_sends").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+
+			if err := completeBatch(db, tc.batch, tc.counts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("There were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func batchRows(status string, currentBatch int) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{
+		"batch_id", "total_messages", "batch_size", "interval_seconds", "start_time", "end_time",
+		"current_batch", "created_at", "updated_at", "total_batches", "user_id", "batches_to_kafka", "status",
+	}).AddRow(7, 300, 100, 0, now.Add(-time.Hour), nil, currentBatch, now.Add(-time.Hour), now.Add(-time.Minute), 3, 1, 3, status)
+}
+
+func TestCheckBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	inInterval := sqlmock.NewRows([]string{
+		"batch_id", "total_messages", "batch_size", "interval_seconds", "start_time", "end_time",
+		"current_batch", "created_at", "updated_at", "total_batches", "user_id", "batches_to_kafka", "status",
+	}).AddRow(7, 300, 100, 600, now.Add(-time.Hour), nil, 1, now.Add(-time.Hour), now.Add(-time.Minute), 3, 1, 3, batchStatusProcessing)
+
+	testCases := []struct {
+		name    string
+		rows    *sqlmock.Rows
+		ready   bool
+		retryAt time.Time
+	}{
+		{name: "Due batch is ready", rows: batchRows(batchStatusProcessing, 1), ready: true},
+		{name: "Paused campaign retries once resumed", rows: batchRows(batchStatusPaused, 1), retryAt: now},
+		{name: "Batch inside the interval waits for it", rows: inInterval, retryAt: now.Add(-time.Minute).Add(600 * time.Second)},
+		{name: "Cancelled campaign is skipped", rows: batchRows(batchStatusCancelled, 1)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock.ExpectQuery("SELECT batch_id").WithArgs(7).WillReturnRows(tc.rows)
+
+			_, ready, retryAt, err := checkBatch(db, 7, now)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if ready != tc.ready {
+				t.Errorf("Expected ready %v, got %v", tc.ready, ready)
+			}
+			if !retryAt.Equal(tc.retryAt) {
+				t.Errorf("Expected retry at %v, got %v", tc.retryAt, retryAt)
+			}
+		})
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateBatchStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("SET status = 'paused'").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := updateBatchStatus(db, 7, batchActionPause); err != nil {
+		t.Errorf("Unexpected error pausing batch: %v", err)
+	}
+
+	// Resuming a campaign that is not paused changes nothing
+	mock.ExpectExec("WHERE batch_id = \\$1 AND status = 'paused'").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := updateBatchStatus(db, 7, batchActionResume); err == nil {
+		t.Error("Expected an error resuming a campaign that is not paused")
+	}
+
+	if err := updateBatchStatus(db, 7, "restart"); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"relay-go-consumer/database"
+	"sync"
+	"time"
+)
+
+// weightsKey identifies a set of routing weights. LastBatch is the Unix time
+// of the previous batch of a campaign, or zero when weights are not tied to a
+// batch, since that time decides the narrowest statistics window.
+type weightsKey struct {
+	UserID    int
+	LastBatch int64
+}
+
+var (
+	credentialsCache    *ttlCache[int, Credentials]
+	weightsCache        *ttlCache[weightsKey, RoutingWeights]
+	templateCache       *ttlCache[templateKey, StoredTemplate]
+	nativeTemplateCache *ttlCache[espTemplateKey, string]
+	unsubscribeCache    *ttlCache[int, UnsubscribeSettings]
+	cachesOnce          sync.Once
+)
+
+// initCaches creates the credential, weight, template and unsubscribe settings
+// caches. TTLs come from CREDENTIALS_CACHE_TTL, which also covers unsubscribe
+// settings, WEIGHTS_CACHE_TTL and TEMPLATE_CACHE_TTL; entries
+// are refreshed in the background once they are half way through their TTL.
+func initCaches() {
+	cachesOnce.Do(func() {
+		credentialsCache = newTTLCache(durationFromEnv("CREDENTIALS_CACHE_TTL", 10*time.Minute), fetchESPCredentials)
+		weightsCache = newTTLCache(durationFromEnv("WEIGHTS_CACHE_TTL", 5*time.Minute), loadRoutingWeights)
+		templateCache = newTTLCache(durationFromEnv("TEMPLATE_CACHE_TTL", 10*time.Minute), loadStoredTemplate)
+		nativeTemplateCache = newTTLCache(durationFromEnv("TEMPLATE_CACHE_TTL", 10*time.Minute), loadNativeTemplate)
+		unsubscribeCache = newTTLCache(durationFromEnv("CREDENTIALS_CACHE_TTL", 10*time.Minute), loadUnsubscribeSettings)
+
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				credentialsCache.prune()
+				weightsCache.prune()
+				templateCache.prune()
+				nativeTemplateCache.prune()
+				unsubscribeCache.prune()
+			}
+		}()
+	})
+}
+
+// loadRoutingWeights computes routing weights for a cache miss.
+func loadRoutingWeights(key weightsKey) (RoutingWeights, error) {
+	database.InitDB()
+	db := database.GetDB()
+
+	credentials, err := credentialsCache.Get(key.UserID)
+	if err != nil {
+		return RoutingWeights{}, err
+	}
+
+	settings, err := fetchRoutingSettings(db, key.UserID)
+	if err != nil {
+		return RoutingWeights{}, err
+	}
+
+	var lastBatch time.Time
+	if key.LastBatch != 0 {
+		lastBatch = time.Unix(key.LastBatch, 0).UTC()
+	}
+
+	currentTime := time.Now().UTC()
+	windows := statsWindows(settings.Profile, lastBatch, currentTime)
+	return calculateRoutingWeights(db, key.UserID, credentials, settings, windows, currentTime, nil)
+}
+
+// invalidateUserCaches drops cached credentials, weights, templates and
+// unsubscribe settings for a user, or for every user when userID is zero.
+func invalidateUserCaches(userID int) {
+	initCaches()
+	credentialsCache.Invalidate(func(key int) bool {
+		return userID == 0 || key == userID
+	})
+	weightsCache.Invalidate(func(key weightsKey) bool {
+		return userID == 0 || key.UserID == userID
+	})
+	templateCache.Invalidate(func(key templateKey) bool {
+		return userID == 0 || key.UserID == userID
+	})
+	nativeTemplateCache.Invalidate(func(key espTemplateKey) bool {
+		return userID == 0 || key.UserID == userID
+	})
+	unsubscribeCache.Invalidate(func(key int) bool {
+		return userID == 0 || key == userID
+	})
+	log.Printf("Invalidated cached credentials, weights, templates and unsubscribe settings for user %d", userID)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// messageRenderer renders the content of a message for each personalization.
+// Templates are parsed once per message.
+type messageRenderer struct {
+	subject  string
+	content  []Content
+	parsed   []*Template
+	sections map[string]*Template
+	// textFrom is the index of the HTML content a plain-text alternative is
+	// generated from when the message has none, or -1
+	textFrom int
+}
+
+func newMessageRenderer(emailMessage EmailMessage) (*messageRenderer, error) {
+	sections, err := parseSections(emailMessage.Sections)
+	if err != nil {
+		return nil, err
+	}
+
+	content := emailMessage.Content
+	if len(content) == 0 {
+		if emailMessage.TextBody != "" {
+			content = append(content, Content{Type: "text/plain", Value: emailMessage.TextBody})
+		}
+		if emailMessage.HtmlBody != "" {
+			content = append(content, Content{Type: "text/html", Value: emailMessage.HtmlBody})
+		}
+	}
+
+	r := &messageRenderer{subject: emailMessage.Subject, content: content, sections: sections, textFrom: -1}
+	for i, item := range content {
+		if strings.EqualFold(item.Type, "text/plain") {
+			r.textFrom = -1
+			break
+		}
+		if r.textFrom < 0 && isHTMLContent(item.Type) {
+			r.textFrom = i
+		}
+	}
+	for _, item := range content {
+		t, err := ParseTemplate(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s content: %v", item.Type, err)
+		}
+		r.parsed = append(r.parsed, t)
+	}
+	return r, nil
+}
+
+// Render returns the subject and content for one personalization. The
+// personalization's subject, or the message subject, is rendered as text.
+// Messages with only HTML content get a plain-text part generated from the
+// rendered HTML, placed first as providers expect.
+func (r *messageRenderer) Render(p Personalization) (string, []Content, error) {
+	data := personalizationData(p)
+
+	subject := p.Subject
+	if subject == "" {
+		subject = r.subject
+	}
+	subjectTemplate, err := ParseTemplate(subject)
+	if err != nil {
+		return "", nil, fmt.Errorf("subject: %v", err)
+	}
+	renderedSubject, err := subjectTemplate.Execute(data, r.sections, false)
+	if err != nil {
+		return "", nil, fmt.Errorf("subject: %v", err)
+	}
+
+	rendered := make([]Content, len(r.content))
+	for i, item := range r.content {
+		value, err := r.parsed[i].Execute(data, r.sections, isHTMLContent(item.Type))
+		if err != nil {
+			return "", nil, fmt.Errorf("%s content: %v", item.Type, err)
+		}
+		rendered[i] = Content{Type: item.Type, Value: value}
+	}
+	if r.textFrom >= 0 {
+		text := Content{Type: "text/plain", Value: htmlToText(rendered[r.textFrom].Value)}
+		rendered = append([]Content{text}, rendered...)
+	}
+	return renderedSubject, rendered, nil
+}
+
+// missingValues returns the variables of the subject and content that have
+// no value for p, which would otherwise be sent as blanks.
+func (r *messageRenderer) missingValues(p Personalization) ([]string, error) {
+	data := personalizationData(p)
+
+	subject := p.Subject
+	if subject == "" {
+		subject = r.subject
+	}
+	subjectTemplate, err := ParseTemplate(subject)
+	if err != nil {
+		return nil, fmt.Errorf("subject: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	var missing []string
+	for _, t := range append([]*Template{subjectTemplate}, r.parsed...) {
+		values, err := t.MissingValues(data, r.sections)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				missing = append(missing, value)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// personalizationData merges a personalization's substitutions and template
+// data into the values available to templates. Substitution keys may be
+// written as -name- or {{name}}.
+func personalizationData(p Personalization) map[string]interface{} {
+	data := make(map[string]interface{}, len(p.Substitutions)+len(p.TemplateData))
+	for key, value := range p.Substitutions {
+		data[strings.Trim(key, "-{}")] = value
+	}
+	for key, value := range p.TemplateData {
+		data[key] = value
+	}
+	return data
+}
+
+func isHTMLContent(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "html")
+}
+
+func getContentByType(content []Content, contentType string) string {
+	for _, item := range content {
+		if item.Type == contentType {
+			return item.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// correlationKey is the metadata key carrying the correlation ID on outbound
+// messages, which the providers return in their events.
+const correlationKey = "relay_correlation_id"
+
+// correlationID identifies a personalization across providers: the request's
+// MessageID and the personalization's 1-based index in it. Events carrying it
+// join back to the request whichever provider sent the message.
+func (emailMessage EmailMessage) correlationID(p Personalization) string {
+	if emailMessage.messageID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.%d", emailMessage.messageID, p.Index)
+}
+
+// withCorrelationID returns a copy of metadata with the correlation ID of p
+// added, or metadata itself when there is no ID to add.
+func (emailMessage EmailMessage) withCorrelationID(metadata map[string]string, p Personalization) map[string]string {
+	id := emailMessage.correlationID(p)
+	if id == "" {
+		return metadata
+	}
+	withID := make(map[string]string, len(metadata)+1)
+	for key, value := range metadata {
+		withID[key] = value
+	}
+	withID[correlationKey] = id
+	return withID
+}
+
+// splitCorrelationID returns the MessageID and recipient index of a
+// correlation ID. ok is false for IDs without an index, such as those of
+// SocketLabs bulk messages, which carry only the MessageID.
+func splitCorrelationID(id string) (messageID string, index int, ok bool) {
+	dot := strings.LastIndex(id, ".")
+	if dot <= 0 {
+		return id, 0, false
+	}
+	index, err := strconv.Atoi(id[dot+1:])
+	if err != nil || index < 1 {
+		return id, 0, false
+	}
+	return id[:dot], index, true
+}
+
+// metadataString reads a string value from event metadata decoded as JSON.
+func metadataString(metadata map[string]interface{}, key string) string {
+	value, _ := metadata[key].(string)
+	return value
+}
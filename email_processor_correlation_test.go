@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCorrelationIDOnOutboundMessages(t *testing.T) {
+	emailMessage := expandPersonalizations(EmailMessage{
+		From:       EmailAddress{Email: "sender@example.com"},
+		To:         []EmailAddress{{Email: "a@example.com"}, {Email: "b@example.com"}},
+		Subject:    "Hi",
+		Content:    []Content{{Type: "text/plain", Value: "Hello"}},
+		CustomArgs: map[string]interface{}{"campaign": "spring"},
+		messageID:  "msg-1",
+	})
+
+	postmark, _ := mapEmailMessageToPostmark(emailMessage, newSendResults(2))
+	if len(postmark) != 2 {
+		t.Fatalf("Expected two messages, got %d", len(postmark))
+	}
+	for i, expected := range []string{"msg-1.1", "msg-1.2"} {
+		if postmark[i].Metadata[correlationKey] != expected || postmark[i].Metadata["campaign"] != "spring" {
+			t.Errorf("Expected Postmark metadata with %q, got %v", expected, postmark[i].Metadata)
+		}
+	}
+
+	recipients := sparkPostRecipients(emailMessage, emailMessage.Personalizations[1], nil)
+	metadata, _ := recipients[0].Metadata.(map[string]interface{})
+	if metadata[correlationKey] != "msg-1.2" {
+		t.Errorf("Expected SparkPost recipient metadata with the correlation ID, got %v", recipients[0].Metadata)
+	}
+
+	emailMessage.Credentials = Credentials{SocketLabsAPIKey: "key"}
+	socketlabs := prepareSocketLabsMessages(emailMessage)
+	if socketlabs[0].MessageId != "msg-1.1" {
+		t.Errorf("Expected the SocketLabs MessageId to be the correlation ID, got %q", socketlabs[0].MessageId)
+	}
+
+	// Indexes survive routing a subset of the personalizations
+	emailMessage.Personalizations = emailMessage.Personalizations[1:]
+	if id := emailMessage.correlationID(expandPersonalizations(emailMessage).Personalizations[0]); id != "msg-1.2" {
+		t.Errorf("Expected the original index to be kept, got %q", id)
+	}
+}
+
+func TestCorrelationIDFromEvents(t *testing.T) {
+	sendgrid := standardizeEvent(
+		EventBody{Email: "a@example.com", Event: "delivered", SGMessageID: "sg-1", CorrelationID: "msg-1.1"},
+		SendgridHeaders{XTwilioEmailEventWebhookTimestamp: []string{"1700000000"}},
+	)
+	if sendgrid.CorrelationID != "msg-1.1" {
+		t.Errorf("Expected the SendGrid custom argument, got %q", sendgrid.CorrelationID)
+	}
+
+	postmark := standardizePostmarkEvent(PostmarkEvent{
+		RecordType: "Delivery",
+		MessageID:  "pm-1",
+		Recipient:  "a@example.com",
+		Metadata:   map[string]string{correlationKey: "msg-1.2"},
+	})
+	if postmark.CorrelationID != "msg-1.2" {
+		t.Errorf("Expected the Postmark metadata, got %q", postmark.CorrelationID)
+	}
+
+	event := struct {
+		Msys struct {
+			MessageEvent *MessageEvent `json:"message_event,omitempty"`
+			TrackEvent   *TrackEvent   `json:"track_event,omitempty"`
+		} `json:"msys"`
+	}{}
+	event.Msys.MessageEvent = &MessageEvent{CommonEventFields: CommonEventFields{
+		Type:     "delivery",
+		RcptTo:   "a@example.com",
+		RcptMeta: map[string]interface{}{correlationKey: "msg-1.3"},
+	}}
+	if got := standardizeSparkPostEvent(event).CorrelationID; got != "msg-1.3" {
+		t.Errorf("Expected the SparkPost rcpt_meta, got %q", got)
+	}
+
+	basic := standardizeSocketLabsEvent(SocketLabsBaseEvent{Type: "Delivered", MessageId: "msg-1.4", Address: "a@example.com", DateTime: time.Now()}, SocketlabsWebhookHeaders{})
+	if basic.MessageID != "msg-1.4" || basic.CorrelationID != "msg-1.4" {
+		t.Errorf("Expected the SocketLabs MessageId as key and correlation ID, got %q and %q", basic.MessageID, basic.CorrelationID)
+	}
+	bulk := standardizeSocketLabsEvent(SocketLabsBaseEvent{Type: "Delivered", MessageId: "msg-1", Address: "B@example.com", DateTime: time.Now()}, SocketlabsWebhookHeaders{})
+	if bulk.MessageID != "msg-1:b@example.com" || bulk.CorrelationID != "msg-1" {
+		t.Errorf("Expected a bulk event keyed by recipient, got %q and %q", bulk.MessageID, bulk.CorrelationID)
+	}
+}
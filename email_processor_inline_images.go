@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// cidReference matches cid: URLs in HTML, such as <img src="cid:logo">.
+var cidReference = regexp.MustCompile(`(?i)\bcid:([^"'\s)>]+)`)
+
+// inline reports whether the attachment is an image embedded in the HTML
+// and referenced by its content ID.
+func (a Attachment) inline() bool {
+	return strings.EqualFold(a.Disposition, "inline") && a.ContentID != ""
+}
+
+// normalizeContentID strips the angle brackets and cid: prefix producers copy
+// from Content-ID headers and HTML references.
+func normalizeContentID(contentID string) string {
+	contentID = strings.Trim(strings.TrimSpace(contentID), "<>")
+	if len(contentID) > 4 && strings.EqualFold(contentID[:4], "cid:") {
+		contentID = contentID[4:]
+	}
+	return contentID
+}
+
+// htmlSources returns the HTML the message is rendered from, including
+// sections, which HTML content may include.
+func (emailMessage EmailMessage) htmlSources() []string {
+	var sources []string
+	if len(emailMessage.Content) == 0 {
+		sources = append(sources, emailMessage.HtmlBody)
+	}
+	for _, content := range emailMessage.Content {
+		if isHTMLContent(content.Type) {
+			sources = append(sources, content.Value)
+		}
+	}
+	for _, section := range emailMessage.Sections {
+		sources = append(sources, section)
+	}
+	return sources
+}
+
+// validateInlineImages checks that every cid: reference in the HTML has an
+// inline image attachment with that content ID. References built by
+// templates are only known once rendered and are not checked.
+func validateInlineImages(emailMessage EmailMessage) error {
+	images := make(map[string]bool)
+	for _, attachment := range emailMessage.Attachments {
+		if !attachment.inline() {
+			continue
+		}
+		if !strings.HasPrefix(attachment.Type, "image/") {
+			return fmt.Errorf("inline attachment %q is %s, not an image", attachment.filename(), attachment.Type)
+		}
+		images[attachment.ContentID] = true
+	}
+
+	for _, source := range emailMessage.htmlSources() {
+		for _, match := range cidReference.FindAllStringSubmatch(source, -1) {
+			contentID := match[1]
+			if strings.Contains(contentID, "{{") {
+				continue
+			}
+			if !images[contentID] {
+				return fmt.Errorf("no inline image for cid:%s", contentID)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestInlineImages(t *testing.T) {
+	logo := base64.StdEncoding.EncodeToString(pngHeader)
+	emailMessage := EmailMessage{
+		Content: []Content{{Type: "text/html", Value: `<img src="cid:logo"><img src="cid:{{banner}}">`}},
+		Attachments: []Attachment{
+			{Filename: "logo.png", Content: logo, Disposition: "inline", ContentID: "<logo>"},
+			{Filename: "terms.txt", Content: "SGVsbG8gV29ybGQh", ContentID: "terms"},
+		},
+	}
+
+	prepared, err := prepareAttachments(emailMessage)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if prepared.Attachments[0].ContentID != "logo" || !prepared.Attachments[0].inline() || prepared.Attachments[1].inline() {
+		t.Errorf("Expected only the logo to be inline, got %+v", prepared.Attachments)
+	}
+
+	postmark := convertAttachments(prepared.Attachments)
+	if postmark[0].ContentID != "cid:logo" || postmark[1].ContentID != "" {
+		t.Errorf("Expected a Postmark content ID for the inline image only, got %+v", postmark)
+	}
+	socketlabs := socketLabsAttachments(prepared)
+	if socketlabs[0].ContentID != "logo" || socketlabs[1].ContentID != "" {
+		t.Errorf("Expected a SocketLabs content ID for the inline image only, got %q and %q", socketlabs[0].ContentID, socketlabs[1].ContentID)
+	}
+
+	invalid := []EmailMessage{
+		{HtmlBody: `<img src="cid:missing">`},
+		{Content: []Content{{Type: "text/html", Value: `<img src="cid:logo">`}}, Attachments: []Attachment{{Filename: "logo.png", Content: logo, ContentID: "logo"}}},
+		{Sections: map[string]string{"footer": `<img src='cid:terms'>`}, Attachments: []Attachment{{Filename: "terms.txt", Content: "SGVsbG8gV29ybGQh", Disposition: "inline", ContentID: "terms"}}},
+	}
+	for i, emailMessage := range invalid {
+		if _, err := prepareAttachments(emailMessage); err == nil {
+			t.Errorf("Expected message %d to be rejected", i)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"relay-go-consumer/database"
+	"strings"
+)
+
+// Template modes of a message that references a stored template.
+const (
+	// templateModeLocal renders the template in the consumer (the default)
+	templateModeLocal = "local"
+	// templateModeNative sends the provider's copy of the template with the
+	// personalization data, for providers that can hold it
+	templateModeNative = "native"
+)
+
+// resolvedTemplate records the stored template a message was resolved from
+// when the message asked for native templates.
+type resolvedTemplate struct {
+	key      templateKey
+	subject  string
+	sections map[string]bool
+}
+
+// espTemplateKey identifies a provider's copy of a template version.
+type espTemplateKey struct {
+	UserID     int
+	TemplateID string
+	Version    int
+	Provider   string
+}
+
+// nativeTemplateFor returns the provider template to use for p, or false when
+// p has to be rendered locally: the provider has no copy of the template, p
+// overrides the subject, or a value of p names a section, which only the
+// local engine resolves.
+func (emailMessage EmailMessage) nativeTemplateFor(p Personalization) (string, bool) {
+	if emailMessage.nativeTemplateID == "" || emailMessage.resolved == nil {
+		return "", false
+	}
+
+	subject := p.Subject
+	if subject == "" {
+		subject = emailMessage.Subject
+	}
+	if subject != emailMessage.resolved.subject {
+		return "", false
+	}
+
+	for _, value := range personalizationData(p) {
+		if name, ok := value.(string); ok && emailMessage.resolved.sections[name] {
+			return "", false
+		}
+	}
+	return emailMessage.nativeTemplateID, true
+}
+
+// withNativeTemplate looks up the provider's copy of the message's template,
+// syncing it to the provider on first use. Errors are logged and leave the
+// message to be rendered locally.
+func withNativeTemplate(emailMessage EmailMessage, provider string) EmailMessage {
+	if emailMessage.resolved == nil {
+		return emailMessage
+	}
+	key := emailMessage.resolved.key
+
+	id, err := nativeTemplateCache.Get(espTemplateKey{
+		UserID:     key.UserID,
+		TemplateID: key.TemplateID,
+		Version:    key.Version,
+		Provider:   provider,
+	})
+	if err != nil {
+		log.Printf("Rendering template %s locally for %s: %v", key.TemplateID, provider, err)
+		return emailMessage
+	}
+	emailMessage.nativeTemplateID = id
+	return emailMessage
+}
+
+// loadNativeTemplate returns the provider template ID of a template version,
+// creating the template at the provider if it has not been synced yet. An
+// empty ID means the provider cannot hold this template.
+func loadNativeTemplate(key espTemplateKey) (string, error) {
+	database.InitDB()
+	db := database.GetDB()
+
+	id, err := fetchNativeTemplateID(db, key)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	template, err := templateCache.Get(templateKey{UserID: key.UserID, TemplateID: key.TemplateID, Version: key.Version})
+	if err != nil {
+		return "", err
+	}
+	credentials, err := credentialsCache.Get(key.UserID)
+	if err != nil {
+		return "", err
+	}
+	unsubscribe, err := unsubscribeCache.Get(key.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	// A template the provider cannot express is stored with an empty ID so
+	// that it is not exported again
+	id, err = syncNativeTemplate(template, key.Provider, credentials, unsubscribe.Enabled)
+	if errors.Is(err, errUnsupportedTemplate) {
+		id, err = "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sync template %s version %d to %s: %v", key.TemplateID, key.Version, key.Provider, err)
+	}
+
+	// Another consumer may have synced the same version concurrently; the
+	// first mapping stored wins
+	_, err = db.Exec(`
+        INSERT INTO esp_template_mappings (user_id, template_id, version, provider, provider_template_id)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id, template_id, version, provider) DO NOTHING
+    `, key.UserID, key.TemplateID, key.Version, key.Provider, id)
+	if err != nil {
+		return "", fmt.Errorf("failed to store template mapping: %v", err)
+	}
+	return fetchNativeTemplateID(db, key)
+}
+
+func fetchNativeTemplateID(db *sql.DB, key espTemplateKey) (string, error) {
+	var id string
+	err := db.QueryRow(`
+        SELECT provider_template_id
+        FROM esp_template_mappings
+        WHERE user_id = $1 AND template_id = $2 AND version = $3 AND provider = $4
+    `, key.UserID, key.TemplateID, key.Version, key.Provider).Scan(&id)
+	return id, err
+}
+
+// nativeTemplateContent is a stored template translated into a provider's
+// template language.
+type nativeTemplateContent struct {
+	Name     string
+	Subject  string
+	HtmlBody string
+	TextBody string
+}
+
+// exportStoredTemplate translates a stored template for a provider.
+func exportStoredTemplate(template StoredTemplate, dialect templateDialect) (nativeTemplateContent, error) {
+	sections, err := parseSections(template.Sections)
+	if err != nil {
+		return nativeTemplateContent{}, err
+	}
+
+	export := func(src string, htmlMode bool) (string, error) {
+		if src == "" {
+			return "", nil
+		}
+		parsed, err := ParseTemplate(src)
+		if err != nil {
+			return "", err
+		}
+		return parsed.Export(dialect, sections, htmlMode)
+	}
+
+	content := nativeTemplateContent{Name: fmt.Sprintf("%s v%d", template.TemplateID, template.Version)}
+	if content.Subject, err = export(template.Subject, false); err != nil {
+		return nativeTemplateContent{}, err
+	}
+	if content.HtmlBody, err = export(template.HtmlBody, true); err != nil {
+		return nativeTemplateContent{}, err
+	}
+	if content.TextBody, err = export(template.TextBody, false); err != nil {
+		return nativeTemplateContent{}, err
+	}
+	return content, nil
+}
+
+// syncNativeTemplate creates the template at the provider and returns its ID.
+// With listUnsubscribe set, a SparkPost template also carries the
+// List-Unsubscribe headers, since transmissions using it cannot add them.
+func syncNativeTemplate(template StoredTemplate, provider string, credentials Credentials, listUnsubscribe bool) (string, error) {
+	var dialect templateDialect
+	switch provider {
+	case "sendgrid":
+		dialect = dialectHandlebars
+	case "postmark":
+		dialect = dialectMustache
+	case "sparkpost":
+		dialect = dialectSparkPost
+	default:
+		return "", errUnsupportedTemplate
+	}
+
+	content, err := exportStoredTemplate(template, dialect)
+	if err != nil {
+		return "", err
+	}
+
+	switch provider {
+	case "sendgrid":
+		return createSendGridTemplate(credentials.SendgridAPIKey, content)
+	case "postmark":
+		return createPostmarkTemplate(credentials.PostmarkServerToken, content)
+	default:
+		if listUnsubscribe {
+			return createSparkPostTemplate(credentials.SparkpostAPIKey, sparkPostTemplateID(template)+sparkPostUnsubscribeSuffix, content, listUnsubscribeHeaders)
+		}
+		return createSparkPostTemplate(credentials.SparkpostAPIKey, sparkPostTemplateID(template), content, nil)
+	}
+}
+
+// sparkPostUnsubscribeSuffix marks the IDs of SparkPost templates that carry
+// the List-Unsubscribe headers.
+const sparkPostUnsubscribeSuffix = "-lu"
+
+// sparkPostTemplateHeaderNames returns the recipient headers a synced
+// SparkPost template fills in, sorted, which must match a recipient's for
+// the template to be used.
+func sparkPostTemplateHeaderNames(templateID string) []string {
+	if strings.HasSuffix(templateID, sparkPostUnsubscribeSuffix) {
+		return listUnsubscribeHeaders
+	}
+	return nil
+}
+
+var invalidSparkPostTemplateID = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// sparkPostTemplateID derives a valid SparkPost template ID, which allows only
+// lowercase letters, digits, underscores and hyphens.
+func sparkPostTemplateID(template StoredTemplate) string {
+	id := invalidSparkPostTemplateID.ReplaceAllString(strings.ToLower(template.TemplateID), "-")
+	return fmt.Sprintf("relay-%s-v%d", id, template.Version)
+}
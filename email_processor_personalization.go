@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envelope is the sender, copies, headers and custom arguments of one
+// personalization: its own values where set, the message's otherwise.
+// RecipientHeaders differ for every recipient and are sent per recipient by
+// providers that group recipients.
+type envelope struct {
+	From             EmailAddress
+	ReplyTo          EmailAddress
+	Cc               []EmailAddress
+	Bcc              []EmailAddress
+	Headers          map[string]string
+	RecipientHeaders map[string]string
+	CustomArgs       map[string]interface{}
+}
+
+// envelopeFor applies the overrides of p to the message. From and ReplyTo
+// replace the message's values; headers and custom arguments are merged, with
+// p winning on conflicts. Tracking metadata is the base of the custom
+// arguments. Copies are the personalization's own, since
+// expandPersonalizations hands the message's copies to a single
+// personalization.
+func (emailMessage EmailMessage) envelopeFor(p Personalization) envelope {
+	env := envelope{
+		From:             emailMessage.From,
+		ReplyTo:          emailMessage.ReplyTo,
+		Cc:               p.Cc,
+		Bcc:              p.Bcc,
+		RecipientHeaders: p.recipientHeaders,
+	}
+	if p.From.Email != "" {
+		env.From = p.From
+	}
+	if p.ReplyTo.Email != "" {
+		env.ReplyTo = p.ReplyTo
+	}
+
+	if len(emailMessage.Headers)+len(p.Headers) > 0 {
+		env.Headers = make(map[string]string, len(emailMessage.Headers)+len(p.Headers))
+		for key, value := range emailMessage.Headers {
+			env.Headers[key] = value
+		}
+		for key, value := range p.Headers {
+			env.Headers[key] = value
+		}
+	}
+	if len(emailMessage.Tracking.Metadata)+len(emailMessage.CustomArgs)+len(p.CustomArgs) > 0 {
+		env.CustomArgs = make(map[string]interface{}, len(emailMessage.Tracking.Metadata)+len(emailMessage.CustomArgs)+len(p.CustomArgs))
+		for key, value := range emailMessage.Tracking.Metadata {
+			env.CustomArgs[key] = value
+		}
+		for key, value := range emailMessage.CustomArgs {
+			env.CustomArgs[key] = value
+		}
+		for key, value := range p.CustomArgs {
+			env.CustomArgs[key] = value
+		}
+	}
+	return env
+}
+
+// customArgStrings returns the custom arguments as strings, the only type
+// every provider accepts as metadata.
+func (env envelope) customArgStrings() map[string]string {
+	if len(env.CustomArgs) == 0 {
+		return nil
+	}
+	args := make(map[string]string, len(env.CustomArgs))
+	for key, value := range env.CustomArgs {
+		switch v := value.(type) {
+		case string:
+			args[key] = v
+		case nil:
+			args[key] = ""
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				encoded = []byte(fmt.Sprint(v))
+			}
+			args[key] = string(encoded)
+		}
+	}
+	return args
+}
+
+// allHeaders returns the shared and recipient headers together, for
+// providers that send every personalization as its own message.
+func (env envelope) allHeaders() map[string]string {
+	if len(env.RecipientHeaders) == 0 {
+		return env.Headers
+	}
+	headers := make(map[string]string, len(env.Headers)+len(env.RecipientHeaders))
+	for key, value := range env.Headers {
+		headers[key] = value
+	}
+	for key, value := range env.RecipientHeaders {
+		headers[key] = value
+	}
+	return headers
+}
+
+// groupKey identifies the parts of the envelope a provider sends once per
+// request, so that recipients sharing them can go out together. Copies are
+// addressed per recipient and are not part of it, and recipient headers only
+// by name, since their values are passed per recipient.
+func (env envelope) groupKey() string {
+	headers := make([]string, 0, len(env.Headers))
+	for key, value := range env.Headers {
+		headers = append(headers, key+": "+value)
+	}
+	sort.Strings(headers)
+
+	key, _ := json.Marshal([]interface{}{env.From, env.ReplyTo, headers, env.recipientHeaderNames()})
+	return string(key)
+}
+
+// recipientHeaderNames returns the names of the recipient headers, sorted.
+func (env envelope) recipientHeaderNames() []string {
+	names := make([]string, 0, len(env.RecipientHeaders))
+	for name := range env.RecipientHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var nonFieldCharacters = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// recipientHeaderField names the merge or substitution field that carries
+// the value of a recipient header, for providers that take headers once per
+// request and fill them in per recipient: List-Unsubscribe is carried in
+// RelayHeaderListUnsubscribe.
+func recipientHeaderField(name string) string {
+	field := "RelayHeader"
+	for _, word := range nonFieldCharacters.Split(name, -1) {
+		if word != "" {
+			field += strings.ToUpper(word[:1]) + strings.ToLower(word[1:])
+		}
+	}
+	return field
+}
+
+// EmailAddressList is a list of addresses that also accepts a single address
+// in JSON, as personalizations used to carry one recipient.
+type EmailAddressList []EmailAddress
+
+func (l *EmailAddressList) UnmarshalJSON(data []byte) error {
+	var addresses []EmailAddress
+	if err := json.Unmarshal(data, &addresses); err == nil {
+		*l = addresses
+		return nil
+	}
+
+	var address EmailAddress
+	if err := json.Unmarshal(data, &address); err != nil {
+		return err
+	}
+	*l = EmailAddressList{address}
+	return nil
+}
+
+// primaryRecipient is the first To address, which routing and logging use to
+// identify the personalization.
+func (p Personalization) primaryRecipient() EmailAddress {
+	if len(p.To) == 0 {
+		return EmailAddress{}
+	}
+	return p.To[0]
+}
+
+// mergeAddresses appends the addresses in extra that are not already in
+// addresses, comparing emails case-insensitively.
+func mergeAddresses(addresses, extra []EmailAddress) []EmailAddress {
+	seen := make(map[string]bool, len(addresses)+len(extra))
+	merged := make([]EmailAddress, 0, len(addresses)+len(extra))
+	for _, address := range append(append([]EmailAddress{}, addresses...), extra...) {
+		key := strings.ToLower(address.Email)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, address)
+	}
+	return merged
+}
+
+// formatAddress writes an address as a header value, with the display name
+// quoted when it contains specials such as commas, and RFC 2047 encoded when
+// it is not ASCII.
+func formatAddress(address EmailAddress) string {
+	if address.Name == "" {
+		return address.Email
+	}
+	return (&mail.Address{Name: address.Name, Address: address.Email}).String()
+}
+
+// formatAddressList writes addresses as a comma separated header value.
+func formatAddressList(addresses []EmailAddress) string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = formatAddress(address)
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeFor(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:       EmailAddress{Email: "news@example.com", Name: "News"},
+		Headers:    map[string]string{"X-Campaign": "spring", "X-Priority": "3"},
+		CustomArgs: map[string]interface{}{"campaign": "spring"},
+	}
+
+	env := emailMessage.envelopeFor(Personalization{To: EmailAddressList{{Email: "a@example.com"}}})
+	assert.Equal(t, emailMessage.From, env.From)
+	assert.Empty(t, env.Cc)
+
+	env = emailMessage.envelopeFor(Personalization{
+		To:         EmailAddressList{{Email: "b@example.com"}},
+		From:       EmailAddress{Email: "sales@example.com"},
+		ReplyTo:    EmailAddress{Email: "rep@example.com", Name: "Rep"},
+		Cc:         []EmailAddress{{Email: "manager@example.com"}},
+		Headers:    map[string]string{"X-Priority": "1"},
+		CustomArgs: map[string]interface{}{"account": 42},
+	})
+	assert.Equal(t, "sales@example.com", env.From.Email)
+	assert.Equal(t, `"Rep" <rep@example.com>`, formatAddress(env.ReplyTo))
+	assert.Equal(t, []EmailAddress{{Email: "manager@example.com"}}, env.Cc)
+	assert.Equal(t, map[string]string{"X-Campaign": "spring", "X-Priority": "1"}, env.Headers)
+	assert.Equal(t, map[string]string{"campaign": "spring", "account": "42"}, env.customArgStrings())
+}
+
+func TestExpandPersonalizationsSendsCopiesOnce(t *testing.T) {
+	var emailMessage EmailMessage
+	err := json.Unmarshal([]byte(`{
+		"Cc": ["archive@example.com", "Manager <manager@example.com>"],
+		"Personalizations": [
+			{"To": "a@example.com", "Cc": ["manager@example.com"]},
+			{"To": [{"email": "b@example.com", "name": "B"}, "c@example.com"]}
+		]
+	}`), &emailMessage)
+	assert.NoError(t, err)
+
+	expanded := expandPersonalizations(emailMessage)
+	assert.Empty(t, expanded.Cc)
+	assert.Equal(t, []EmailAddress{{Email: "manager@example.com"}, {Email: "archive@example.com"}}, expanded.Personalizations[0].Cc)
+	assert.Empty(t, expanded.Personalizations[1].Cc)
+	assert.Equal(t, EmailAddressList{{Email: "b@example.com", Name: "B"}, {Email: "c@example.com"}}, expanded.Personalizations[1].To)
+
+	// The caller's personalizations are left untouched
+	assert.Len(t, emailMessage.Personalizations[0].Cc, 1)
+}
+
+func TestMapEmailMessageToPostmarkOverrides(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:       EmailAddress{Email: "news@example.com"},
+		Content:    []Content{{Type: "text/plain", Value: "Hi {{name}}"}},
+		Categories: []string{"newsletter"},
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "a@example.com"}}, Subject: "First"},
+			{
+				To:         EmailAddressList{{Email: "b@example.com"}},
+				Subject:    "Second",
+				From:       EmailAddress{Email: "sales@example.com", Name: "Sales"},
+				ReplyTo:    EmailAddress{Email: "rep@example.com"},
+				Headers:    map[string]string{"X-Account": "42"},
+				CustomArgs: map[string]interface{}{"account": "42"},
+			},
+		},
+	}
+
+	messages, indexes := mapEmailMessageToPostmark(emailMessage, newSendResults(len(emailMessage.Personalizations)))
+	assert.Len(t, messages, 2)
+	assert.Equal(t, []int{0, 1}, indexes)
+
+	assert.Equal(t, "news@example.com", messages[0].From)
+	assert.Equal(t, "First", messages[0].Subject)
+	assert.Equal(t, "newsletter", messages[0].Tag)
+	assert.Empty(t, messages[0].ReplyTo)
+
+	assert.Equal(t, `"Sales" <sales@example.com>`, messages[1].From)
+	assert.Equal(t, "Second", messages[1].Subject)
+	assert.Equal(t, "rep@example.com", messages[1].ReplyTo)
+	assert.Equal(t, []CustomHeader{{Name: "X-Account", Value: "42"}}, messages[1].Headers)
+	assert.Equal(t, map[string]string{"account": "42"}, messages[1].Metadata)
+}
+
+func TestSparkPostRecipientHeaders(t *testing.T) {
+	env := envelope{
+		Headers:          map[string]string{"X-Campaign": "spring"},
+		RecipientHeaders: map[string]string{"List-Unsubscribe": "<https://unsub.example.com/a>", "List-Unsubscribe-Post": "List-Unsubscribe=One-Click"},
+	}
+	headers := sparkPostHeaders(env)
+	if headers["X-Campaign"] != "spring" || headers["List-Unsubscribe"] != "{{{RelayHeaderListUnsubscribe}}}" || headers["List-Unsubscribe-Post"] != "{{{RelayHeaderListUnsubscribePost}}}" {
+		t.Errorf("Unexpected transmission headers %v", headers)
+	}
+
+	if _, ok := headers["Cc"]; ok {
+		t.Errorf("Expected no Cc header without copies, got %v", headers)
+	}
+
+	env.Cc = []EmailAddress{{Email: "bob@example.com", Name: "Bob"}, {Email: "cy@example.com"}}
+	headers = sparkPostHeaders(env)
+	if headers["Cc"] != `"Bob" <bob@example.com>, cy@example.com` || headers["X-Campaign"] != "spring" {
+		t.Errorf("Expected the Cc header to list the copies, got %v", headers)
+	}
+
+	// Only templates synced with the List-Unsubscribe headers can send them
+	if !equalStrings(env.recipientHeaderNames(), sparkPostTemplateHeaderNames("relay-welcome-v2"+sparkPostUnsubscribeSuffix)) {
+		t.Errorf("Expected a template with List-Unsubscribe headers to match the recipient")
+	}
+	if equalStrings(env.recipientHeaderNames(), sparkPostTemplateHeaderNames("relay-welcome-v2")) {
+		t.Errorf("Expected a template without List-Unsubscribe headers not to match the recipient")
+	}
+}
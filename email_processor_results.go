@@ -0,0 +1,81 @@
+package main
+
+import "errors"
+
+// errNotSent marks a personalization a provider has not reported on, for
+// example because an earlier request in the same send failed.
+var errNotSent = errors.New("not sent")
+
+// sendResults holds the outcome of each personalization handed to a
+// provider, in the order of EmailMessage.Personalizations. A nil entry means
+// the provider accepted the personalization.
+type sendResults []error
+
+func newSendResults(n int) sendResults {
+	results := make(sendResults, n)
+	for i := range results {
+		results[i] = errNotSent
+	}
+	return results
+}
+
+// setAll records the same outcome for several personalizations, as when a
+// single bulk request succeeds or fails as a whole.
+func (r sendResults) setAll(indexes []int, err error) {
+	for _, i := range indexes {
+		r[i] = err
+	}
+}
+
+// sent returns how many personalizations were accepted.
+func (r sendResults) sent() int {
+	sent := 0
+	for _, err := range r {
+		if err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// lastErr returns the last failure, or nil when everything was accepted.
+func (r sendResults) lastErr() error {
+	for i := len(r) - 1; i >= 0; i-- {
+		if r[i] != nil {
+			return r[i]
+		}
+	}
+	return nil
+}
+
+// chunkRecipients splits indexes into consecutive runs of at most limit
+// recipients, for providers that limit how many addresses one request may
+// carry. recipients counts the addresses of the personalization at an index,
+// which are kept together.
+func chunkRecipients(indexes []int, recipients func(i int) int, limit int) [][]int {
+	var result [][]int
+	var chunk []int
+	total := 0
+	for _, i := range indexes {
+		count := recipients(i)
+		if len(chunk) > 0 && total+count > limit {
+			result = append(result, chunk)
+			chunk, total = nil, 0
+		}
+		chunk = append(chunk, i)
+		total += count
+	}
+	if len(chunk) > 0 {
+		result = append(result, chunk)
+	}
+	return result
+}
+
+// allIndexes returns the index of every personalization in r.
+func allIndexes(r sendResults) []int {
+	indexes := make([]int, len(r))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendResults(t *testing.T) {
+	results := newSendResults(3)
+	assert.Equal(t, 0, results.sent())
+	assert.Equal(t, errNotSent, results.lastErr())
+
+	failure := errors.New("rejected")
+	results.setAll([]int{0, 2}, nil)
+	results[1] = failure
+	assert.Equal(t, 2, results.sent())
+	assert.Equal(t, failure, results.lastErr())
+}
+
+func TestChunkRecipients(t *testing.T) {
+	// The second personalization fills a request with its copies
+	counts := []int{1, 2, 1}
+	recipients := func(i int) int { return counts[i] }
+	assert.Equal(t, [][]int{{0, 1}, {2}}, chunkRecipients([]int{0, 1, 2}, recipients, 3))
+	assert.Equal(t, [][]int{{0, 2}}, chunkRecipients([]int{0, 2}, recipients, 3))
+	assert.Equal(t, [][]int{{1}}, chunkRecipients([]int{1}, recipients, 1), "A personalization over the limit is sent alone")
+	assert.Nil(t, chunkRecipients(nil, recipients, 3))
+}
+
+func TestChunkPostmarkMessages(t *testing.T) {
+	messages := []PostMarkMessage{
+		{To: "a@example.com", HtmlBody: strings.Repeat("a", 400)},
+		{To: "b@example.com", HtmlBody: strings.Repeat("b", 400)},
+		{To: "c@example.com"},
+		{To: "d@example.com"},
+		{To: "e@example.com"},
+	}
+
+	// Two large messages do not fit one request, and the small ones are
+	// still split by count
+	assert.Equal(t, [][]int{{0}, {1, 2}, {3, 4}}, chunkPostmarkMessages([]int{0, 1, 2, 3, 4}, messages, 2, 1000))
+	assert.Equal(t, [][]int{{0, 1, 2, 3, 4}}, chunkPostmarkMessages([]int{0, 1, 2, 3, 4}, messages, 500, 50<<20))
+}
+
+func TestRecordPostmarkResults(t *testing.T) {
+	results := newSendResults(4)
+	// Messages 0 and 1 of the batch belong to personalizations 1 and 3
+	indexes := []int{1, 3}
+	recordPostmarkResults(results, indexes, []int{0, 1}, []postmarkBatchResult{
+		{ErrorCode: 0, To: "a@example.com"},
+		{ErrorCode: 406, Message: "Inactive recipient", To: "b@example.com"},
+	}, nil)
+
+	assert.Equal(t, errNotSent, results[0])
+	assert.NoError(t, results[1])
+	assert.ErrorContains(t, results[3], "Code=406")
+
+	recordPostmarkResults(results, indexes, []int{0, 1}, []postmarkBatchResult{{}}, nil)
+	assert.ErrorContains(t, results[1], "1 results for 2 messages")
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ScoringProfile holds the user-tunable parameters of provider weighting.
+// Rates are multiplied by their coefficient and summed; bounce, spam and
+// deferral coefficients are subtracted.
+type ScoringProfile struct {
+	OpenWeight     float64 `json:"open_weight"`
+	DeliveryWeight float64 `json:"delivery_weight"`
+	BounceWeight   float64 `json:"bounce_weight"`
+	SpamWeight     float64 `json:"spam_weight"`
+	DeferredWeight float64 `json:"deferred_weight"`
+	MinSampleSize  int     `json:"min_sample_size"`
+	// BanditMinShare is the share of traffic every eligible provider keeps
+	// under the bandit strategy, so a provider with a bad month is still
+	// explored
+	BanditMinShare  float64                  `json:"bandit_min_share"`
+	DecayWindowDays int                      `json:"decay_window_days"`
+	HalfLifeHours   float64                  `json:"half_life_hours"`
+	ProviderLimits  map[string]ProviderLimit `json:"provider_limits"`
+}
+
+// ProviderLimit bounds the weight, out of 1,000, a provider may receive.
+type ProviderLimit struct {
+	Floor   int `json:"floor"`
+	Ceiling int `json:"ceiling"`
+}
+
+// DefaultScoringProfile reproduces the original fixed formula.
+var DefaultScoringProfile = ScoringProfile{
+	OpenWeight:      0.5,
+	DeliveryWeight:  0.2,
+	BounceWeight:    0.3,
+	SpamWeight:      0.2,
+	DeferredWeight:  0,
+	MinSampleSize:   100,
+	BanditMinShare:  0.05,
+	DecayWindowDays: 30,
+	HalfLifeHours:   168,
+}
+
+// RoutingSettings holds a user's routing strategy and scoring profile.
+type RoutingSettings struct {
+	Strategy RoutingStrategy
+	Profile  ScoringProfile
+}
+
+// DefaultRoutingSettings is used for users without a user_routing_settings row.
+var DefaultRoutingSettings = RoutingSettings{Strategy: StrategyFormula, Profile: DefaultScoringProfile}
+
+// fetchRoutingSettings loads the user's routing settings. Fields missing from
+// the stored scoring profile keep their default values, and the resulting
+// profile is validated before use.
+func fetchRoutingSettings(db *sql.DB, userID int) (RoutingSettings, error) {
+	var strategy string
+	var rawProfile []byte
+	err := db.QueryRow(`
+        SELECT strategy, scoring_profile
+        FROM user_routing_settings
+        WHERE user_id = $1
+    `, userID).Scan(&strategy, &rawProfile)
+	if err == sql.ErrNoRows {
+		return DefaultRoutingSettings, nil
+	}
+	if err != nil {
+		return RoutingSettings{}, fmt.Errorf("failed to query routing settings: %v", err)
+	}
+
+	settings := RoutingSettings{Strategy: RoutingStrategy(strategy), Profile: DefaultScoringProfile}
+	switch settings.Strategy {
+	case StrategyFormula, StrategyBandit:
+	default:
+		return RoutingSettings{}, fmt.Errorf("unknown routing strategy %q for user ID %d", strategy, userID)
+	}
+
+	if len(rawProfile) > 0 {
+		if err := json.Unmarshal(rawProfile, &settings.Profile); err != nil {
+			return RoutingSettings{}, fmt.Errorf("failed to parse scoring profile for user ID %d: %v", userID, err)
+		}
+	}
+	if err := settings.Profile.Validate(); err != nil {
+		return RoutingSettings{}, fmt.Errorf("invalid scoring profile for user ID %d: %v", userID, err)
+	}
+
+	return settings, nil
+}
+
+// Validate checks that the profile can produce sensible weights.
+func (p ScoringProfile) Validate() error {
+	coefficients := map[string]float64{
+		"open_weight":     p.OpenWeight,
+		"delivery_weight": p.DeliveryWeight,
+		"bounce_weight":   p.BounceWeight,
+		"spam_weight":     p.SpamWeight,
+		"deferred_weight": p.DeferredWeight,
+	}
+	for name, value := range coefficients {
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%s must be a non-negative number, got %v", name, value)
+		}
+	}
+	if p.OpenWeight == 0 && p.DeliveryWeight == 0 {
+		return fmt.Errorf("at least one of open_weight and delivery_weight must be positive")
+	}
+	if p.MinSampleSize < 0 {
+		return fmt.Errorf("min_sample_size must not be negative, got %d", p.MinSampleSize)
+	}
+	if p.BanditMinShare < 0 || math.IsNaN(p.BanditMinShare) || p.BanditMinShare > 0.5 {
+		return fmt.Errorf("bandit_min_share must be between 0 and 0.5, got %v", p.BanditMinShare)
+	}
+	if p.DecayWindowDays < 1 || p.DecayWindowDays > 365 {
+		return fmt.Errorf("decay_window_days must be between 1 and 365, got %d", p.DecayWindowDays)
+	}
+	if p.HalfLifeHours < 0 || math.IsNaN(p.HalfLifeHours) || p.HalfLifeHours > 24*365 {
+		return fmt.Errorf("half_life_hours must be between 0 and 8760, got %v", p.HalfLifeHours)
+	}
+
+	totalFloor := 0
+	for provider, limit := range p.ProviderLimits {
+		switch provider {
+		case "sendgrid", "postmark", "socketlabs", "sparkpost":
+		default:
+			return fmt.Errorf("provider_limits references unknown provider %q", provider)
+		}
+		if limit.Floor < 0 || limit.Floor > 1000 {
+			return fmt.Errorf("floor for %s must be between 0 and 1000, got %d", provider, limit.Floor)
+		}
+		if limit.Ceiling < 0 || limit.Ceiling > 1000 {
+			return fmt.Errorf("ceiling for %s must be between 0 and 1000, got %d", provider, limit.Ceiling)
+		}
+		if limit.Ceiling != 0 && limit.Ceiling < limit.Floor {
+			return fmt.Errorf("ceiling for %s (%d) is below its floor (%d)", provider, limit.Ceiling, limit.Floor)
+		}
+		totalFloor += limit.Floor
+	}
+	if totalFloor > 1000 {
+		return fmt.Errorf("provider floors add up to %d, more than 1000", totalFloor)
+	}
+
+	return nil
+}
+
+// score applies the profile's coefficients to a provider's rates.
+func (p ScoringProfile) score(s ProviderStats) float64 {
+	total := s.TotalEvents
+	score := p.OpenWeight*s.OpenEvents/total +
+		p.DeliveryWeight*s.DeliveredEvents/total -
+		p.BounceWeight*s.BounceEvents/total -
+		p.SpamWeight*s.SpamReportEvents/total -
+		p.DeferredWeight*s.DeferredEvents/total
+	return math.Max(score, 0)
+}
+
+// halfLife is the age at which an event counts half as much as a new one.
+// Zero disables decay.
+func (p ScoringProfile) halfLife() time.Duration {
+	return time.Duration(p.HalfLifeHours * float64(time.Hour))
+}
+
+// scoreProviders converts statistics into weights using the configured
+// strategy and then applies the profile's provider floors and ceilings. The
+// bandit strategy samples from rng.
+func (r RoutingSettings) scoreProviders(stats []ProviderStats, credentials Credentials, rng *rand.Rand) map[string]int {
+	var weights map[string]int
+	if r.Strategy == StrategyBandit {
+		weights = thompsonSamplingWeights(stats, credentials, r.Profile, rng)
+	} else {
+		weights = scoreProviderStats(stats, credentials, r.Profile)
+	}
+	return applyProviderLimits(weights, r.Profile.ProviderLimits, credentials)
+}
+
+// applyProviderLimits clamps weights to each provider's floor and ceiling and
+// spreads the difference over the unclamped providers in proportion to their
+// weights, repeating until no limit is violated. Floors are only granted to
+// providers with valid credentials.
+func applyProviderLimits(weights map[string]int, limits map[string]ProviderLimit, credentials Credentials) map[string]int {
+	if len(limits) == 0 || len(weights) == 0 {
+		return weights
+	}
+
+	limitFor := func(provider string) (float64, float64) {
+		limit := limits[strings.ToLower(provider)]
+		floor, ceiling := float64(limit.Floor), float64(limit.Ceiling)
+		if limit.Ceiling == 0 {
+			ceiling = 1000
+		}
+		if !isValidProvider(provider, credentials) {
+			floor = 0
+		}
+		return floor, ceiling
+	}
+
+	providers := make([]string, 0, len(weights))
+	for provider := range weights {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	shares := make(map[string]float64, len(providers))
+	clamped := make(map[string]bool, len(providers))
+	for _, provider := range providers {
+		shares[provider] = float64(weights[provider])
+	}
+
+	for pass := 0; pass < len(providers); pass++ {
+		violated := false
+		for _, provider := range providers {
+			if clamped[provider] {
+				continue
+			}
+			floor, ceiling := limitFor(provider)
+			if shares[provider] < floor {
+				shares[provider] = floor
+				clamped[provider] = true
+				violated = true
+			} else if shares[provider] > ceiling {
+				shares[provider] = ceiling
+				clamped[provider] = true
+				violated = true
+			}
+		}
+		if !violated {
+			break
+		}
+
+		fixed, free := 0.0, 0.0
+		for _, provider := range providers {
+			if clamped[provider] {
+				fixed += shares[provider]
+			} else {
+				free += shares[provider]
+			}
+		}
+		if free == 0 {
+			break
+		}
+		for _, provider := range providers {
+			if !clamped[provider] {
+				shares[provider] = shares[provider] / free * math.Max(1000-fixed, 0)
+			}
+		}
+	}
+
+	return normalizeWeights(shares)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFetchRoutingSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	testCases := []struct {
+		name      string
+		rows      *sqlmock.Rows
+		expectErr bool
+		check     func(t *testing.T, settings RoutingSettings)
+	}{
+		{
+			name: "No settings row",
+			rows: sqlmock.NewRows([]string{"strategy", "scoring_profile"}),
+			check: func(t *testing.T, settings RoutingSettings) {
+				if settings.Strategy != StrategyFormula || settings.Profile.OpenWeight != DefaultScoringProfile.OpenWeight {
+					t.Errorf("Expected default settings, got %+v", settings)
+				}
+			},
+		},
+		{
+			name: "Partial profile keeps defaults",
+			rows: sqlmock.NewRows([]string{"strategy", "scoring_profile"}).
+				AddRow("bandit", []byte(`{"open_weight": 0.8, "provider_limits": {"sendgrid": {"floor": 100, "ceiling": 600}}}`)),
+			check: func(t *testing.T, settings RoutingSettings) {
+				if settings.Strategy != StrategyBandit {
+					t.Errorf("Expected bandit strategy, got %s", settings.Strategy)
+				}
+				if settings.Profile.OpenWeight != 0.8 || settings.Profile.BounceWeight != DefaultScoringProfile.BounceWeight {
+					t.Errorf("Expected open weight override on top of defaults, got %+v", settings.Profile)
+				}
+				if settings.Profile.ProviderLimits["sendgrid"].Ceiling != 600 {
+					t.Errorf("Expected sendgrid ceiling of 600, got %+v", settings.Profile.ProviderLimits)
+				}
+			},
+		},
+		{
+			name: "Negative coefficient",
+			rows: sqlmock.NewRows([]string{"strategy", "scoring_profile"}).
+				AddRow("formula", []byte(`{"spam_weight": -1}`)),
+			expectErr: true,
+		},
+		{
+			name: "Floors above total",
+			rows: sqlmock.NewRows([]string{"strategy", "scoring_profile"}).
+				AddRow("formula", []byte(`{"provider_limits": {"sendgrid": {"floor": 600}, "postmark": {"floor": 600}}}`)),
+			expectErr: true,
+		},
+		{
+			name:      "Unknown strategy",
+			rows:      sqlmock.NewRows([]string{"strategy", "scoring_profile"}).AddRow("roulette", nil),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock.ExpectQuery("SELECT strategy, scoring_profile").WithArgs(1).WillReturnRows(tc.rows)
+
+			settings, err := fetchRoutingSettings(db, 1)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, got settings %+v", settings)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			} else {
+				tc.check(t, settings)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("There were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestApplyProviderLimits(t *testing.T) {
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm", SparkpostAPIKey: "sp"}
+	weights := map[string]int{"sendgrid": 800, "postmark": 200, "sparkpost": 0}
+	limits := map[string]ProviderLimit{
+		"sendgrid":  {Ceiling: 500},
+		"sparkpost": {Floor: 100},
+	}
+
+	limited := applyProviderLimits(weights, limits, credentials)
+
+	if limited["sendgrid"] != 500 {
+		t.Errorf("Sendgrid should be capped at 500, got %v", limited)
+	}
+	if limited["sparkpost"] != 100 {
+		t.Errorf("Sparkpost should be raised to its floor of 100, got %v", limited)
+	}
+	if limited["postmark"] != 400 {
+		t.Errorf("Postmark should absorb the remaining weight, got %v", limited)
+	}
+}
+
+func TestScoreProviderStatsMinSampleSize(t *testing.T) {
+	profile := DefaultScoringProfile
+	profile.MinSampleSize = 500
+
+	stats := []ProviderStats{
+		{"sendgrid", 1000, 950, 20, 500, 10, 1},
+		{"postmark", 1000, 900, 50, 300, 10, 1},
+		{"sparkpost", 10, 0, 10, 0, 0, 5}, // Terrible, but far too few events to judge
+	}
+
+	weights := scoreProviderStats(stats, Credentials{}, profile)
+
+	if weights["sparkpost"] == 0 {
+		t.Errorf("Provider below the minimum sample size should get an average share, got %v", weights)
+	}
+	if weights["sparkpost"] >= weights["sendgrid"] || weights["sparkpost"] <= weights["postmark"] {
+		t.Errorf("Sparse provider should sit between the measured providers, got %v", weights)
+	}
+}
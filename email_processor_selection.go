@@ -0,0 +1,157 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SenderAffinity controls which part of a recipient address is hashed when
+// choosing a provider, so that a recipient keeps landing on the same ESP for
+// every batch of a campaign.
+type SenderAffinity int
+
+const (
+	// AffinityNone picks a provider at random for every personalization.
+	AffinityNone SenderAffinity = iota
+	// AffinityRecipient pins each recipient address to a provider.
+	AffinityRecipient
+	// AffinityDomain pins every recipient of a domain to a provider.
+	AffinityDomain
+)
+
+// SenderSelector chooses an ESP for each personalization according to the
+// calculated weights. Providers are always visited in name order so that a
+// given random source produces the same routing on every run.
+type SenderSelector struct {
+	rand     *rand.Rand
+	affinity SenderAffinity
+	campaign string
+}
+
+// NewSenderSelector creates a selector that draws from source and hashes
+// recipients within campaign. A nil source is seeded from the clock.
+func NewSenderSelector(source rand.Source, affinity SenderAffinity, campaign string) *SenderSelector {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	return &SenderSelector{
+		rand:     rand.New(source),
+		affinity: affinity,
+		campaign: campaign,
+	}
+}
+
+// senderAffinityFromEnv reads SENDER_AFFINITY ("recipient", "domain" or
+// "none"), defaulting to recipient affinity.
+func senderAffinityFromEnv() SenderAffinity {
+	switch strings.ToLower(os.Getenv("SENDER_AFFINITY")) {
+	case "none":
+		return AffinityNone
+	case "domain":
+		return AffinityDomain
+	default:
+		return AffinityRecipient
+	}
+}
+
+// Select returns the provider for recipient. With affinity enabled it uses
+// weighted rendezvous hashing: every provider gets a pseudo-random score
+// derived from the campaign, the affinity key and the provider name, scaled by
+// its weight, and the best score wins. Each provider is therefore chosen with
+// probability weight/total, and a change in weights only moves the recipients
+// whose winning provider lost share.
+func (s *SenderSelector) Select(weights map[string]int, recipient string) string {
+	providers := weightedProviders(weights)
+	if len(providers) == 0 {
+		return ""
+	}
+
+	key := s.affinityKey(recipient)
+	if key == "" {
+		return s.randomProvider(providers, weights)
+	}
+
+	best := ""
+	bestScore := math.Inf(1)
+	for _, provider := range providers {
+		score := -math.Log(hashUnit(s.campaign, key, provider)) / float64(weights[provider])
+		if score < bestScore {
+			best = provider
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+func (s *SenderSelector) affinityKey(recipient string) string {
+	recipient = strings.ToLower(strings.TrimSpace(recipient))
+	switch s.affinity {
+	case AffinityRecipient:
+		return recipient
+	case AffinityDomain:
+		if domain := recipientDomain(recipient); domain != "" {
+			return domain
+		}
+		return recipient
+	default:
+		return ""
+	}
+}
+
+func (s *SenderSelector) randomProvider(providers []string, weights map[string]int) string {
+	totalWeight := 0
+	for _, provider := range providers {
+		totalWeight += weights[provider]
+	}
+
+	randomValue := s.rand.Intn(totalWeight)
+	cumulativeWeight := 0
+
+	for _, provider := range providers {
+		cumulativeWeight += weights[provider]
+		if randomValue < cumulativeWeight {
+			return provider
+		}
+	}
+
+	return providers[len(providers)-1]
+}
+
+// weightedProviders returns the providers with a positive weight, sorted by
+// name so iteration order does not depend on Go's map ordering.
+func weightedProviders(weights map[string]int) []string {
+	providers := make([]string, 0, len(weights))
+	for provider, weight := range weights {
+		if weight > 0 {
+			providers = append(providers, provider)
+		}
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// hashUnit maps its parts to a stable float in the open interval (0, 1).
+func hashUnit(parts ...string) float64 {
+	hasher := fnv.New64a()
+	for _, part := range parts {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+
+	// FNV alone mixes the last bytes poorly, so finish with the splitmix64
+	// finalizer before taking the top 53 bits.
+	h := hasher.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return (float64(h>>11) + 0.5) / (1 << 53)
+}
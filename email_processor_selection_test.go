@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSenderSelectorSeededRandomIsReproducible(t *testing.T) {
+	weights := map[string]int{"sendgrid": 400, "postmark": 300, "sparkpost": 200, "socketlabs": 100}
+
+	first := NewSenderSelector(rand.NewSource(42), AffinityNone, "")
+	second := NewSenderSelector(rand.NewSource(42), AffinityNone, "")
+
+	for i := 0; i < 100; i++ {
+		a := first.Select(weights, "")
+		b := second.Select(weights, "")
+		if a != b {
+			t.Fatalf("Selection %d differs between identically seeded selectors: %s vs %s", i, a, b)
+		}
+	}
+}
+
+func TestSenderSelectorRecipientAffinity(t *testing.T) {
+	weights := map[string]int{"sendgrid": 250, "postmark": 250, "sparkpost": 250, "socketlabs": 250}
+
+	firstBatch := NewSenderSelector(rand.NewSource(1), AffinityRecipient, "batch:7")
+	secondBatch := NewSenderSelector(rand.NewSource(2), AffinityRecipient, "batch:7")
+
+	for i := 0; i < 200; i++ {
+		recipient := fmt.Sprintf("user%d@example.com", i)
+		a := firstBatch.Select(weights, recipient)
+		b := secondBatch.Select(weights, recipient)
+		if a != b {
+			t.Fatalf("Recipient %s moved from %s to %s within one campaign", recipient, a, b)
+		}
+	}
+
+	if firstBatch.Select(weights, "User1@Example.com ") != firstBatch.Select(weights, "user1@example.com") {
+		t.Errorf("Recipient affinity should ignore case and surrounding whitespace")
+	}
+}
+
+func TestSenderSelectorDomainAffinity(t *testing.T) {
+	weights := map[string]int{"sendgrid": 500, "postmark": 500}
+	selector := NewSenderSelector(rand.NewSource(1), AffinityDomain, "batch:9")
+
+	for _, domain := range []string{"gmail.com", "outlook.com", "yahoo.com", "example.org"} {
+		expected := selector.Select(weights, "first@"+domain)
+		for i := 0; i < 20; i++ {
+			if got := selector.Select(weights, fmt.Sprintf("user%d@%s", i, domain)); got != expected {
+				t.Fatalf("Domain %s routed to both %s and %s", domain, expected, got)
+			}
+		}
+	}
+}
+
+func TestSenderSelectorHonorsWeights(t *testing.T) {
+	weights := map[string]int{"sendgrid": 600, "postmark": 300, "sparkpost": 100, "socketlabs": 0}
+	selector := NewSenderSelector(rand.NewSource(1), AffinityRecipient, "batch:1")
+
+	const recipients = 20000
+	counts := make(map[string]int)
+	for i := 0; i < recipients; i++ {
+		counts[selector.Select(weights, fmt.Sprintf("user%d@example.com", i))]++
+	}
+
+	if counts["socketlabs"] != 0 {
+		t.Errorf("Provider with zero weight should never be selected, got %d", counts["socketlabs"])
+	}
+
+	for provider, weight := range weights {
+		expected := float64(weight) / 1000
+		actual := float64(counts[provider]) / recipients
+		if math.Abs(expected-actual) > 0.02 {
+			t.Errorf("Provider %s received %.3f of traffic, expected about %.3f", provider, actual, expected)
+		}
+	}
+}
+
+func TestSenderSelectorNoWeights(t *testing.T) {
+	selector := NewSenderSelector(rand.NewSource(1), AffinityRecipient, "")
+	if got := selector.Select(map[string]int{"sendgrid": 0}, "user@example.com"); got != "" {
+		t.Errorf("Expected no provider when all weights are zero, got %s", got)
+	}
+}
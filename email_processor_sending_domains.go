@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// senderDomain returns the domain of an address, lowercase and in punycode
+// as it is configured at the providers.
+func senderDomain(address EmailAddress) string {
+	address = asciiDomain(address)
+	at := strings.LastIndex(address.Email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(address.Email[at+1:], "."))
+}
+
+// authorizedProviders returns the providers whose sending domains cover the
+// domain of from: the domain itself or a parent domain, which providers
+// accept for subdomains with relaxed DMARC alignment.
+func (c Credentials) authorizedProviders(from EmailAddress) map[string]bool {
+	domain := senderDomain(from)
+	authorized := make(map[string]bool)
+	if domain == "" {
+		return authorized
+	}
+	for provider, domains := range c.SendingDomains {
+		for _, configured := range domains {
+			configured = senderDomain(EmailAddress{Email: "@" + strings.TrimSpace(configured)})
+			if configured != "" && (domain == configured || strings.HasSuffix(domain, "."+configured)) {
+				authorized[provider] = true
+				break
+			}
+		}
+	}
+	return authorized
+}
+
+// authorizedWeights keeps the weights of the providers that may send for the
+// domain of from: those whose sending domains cover it, and those with no
+// sending domains configured, which are not restricted.
+func (c Credentials) authorizedWeights(weights map[string]int, from EmailAddress) map[string]int {
+	authorized := c.authorizedProviders(from)
+	filtered := make(map[string]int, len(weights))
+	for provider, weight := range weights {
+		if authorized[provider] || len(c.SendingDomains[provider]) == 0 {
+			filtered[provider] = weight
+		}
+	}
+	return filtered
+}
+
+// unrestrictedWarnings records the users and providers already warned about.
+var unrestrictedWarnings sync.Map
+
+// warnUnrestrictedProviders logs, once per user and provider, the configured
+// providers without sending domains, which may send for any From domain.
+func (c Credentials) warnUnrestrictedProviders(userID int) {
+	for _, provider := range []string{"sendgrid", "postmark", "socketlabs", "sparkpost"} {
+		if !isValidProvider(provider, c) || len(c.SendingDomains[provider]) > 0 {
+			continue
+		}
+		if _, warned := unrestrictedWarnings.LoadOrStore(fmt.Sprintf("%d:%s", userID, provider), true); !warned {
+			log.Printf("Warning: %s has no sending domains for user %d and may send for any From domain", provider, userID)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestAuthorizedProviders(t *testing.T) {
+	credentials := Credentials{
+		SendingDomains: map[string][]string{
+			"sendgrid":  {"example.com"},
+			"postmark":  {"mail.example.com"},
+			"sparkpost": {"bücher.de"},
+		},
+	}
+
+	testCases := []struct {
+		from     string
+		expected []string
+	}{
+		{"news@example.com", []string{"sendgrid"}},
+		{"news@Mail.Example.com", []string{"postmark", "sendgrid"}},
+		{"news@notexample.com", nil},
+		{"news@xn--bcher-kva.de", []string{"sparkpost"}},
+		{"news@bücher.de", []string{"sparkpost"}},
+		{"", nil},
+	}
+	for _, tc := range testCases {
+		authorized := credentials.authorizedProviders(EmailAddress{Email: tc.from})
+		if len(authorized) != len(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.from, tc.expected, authorized)
+			continue
+		}
+		for _, provider := range tc.expected {
+			if !authorized[provider] {
+				t.Errorf("%s: expected %s to be authorized, got %v", tc.from, provider, authorized)
+			}
+		}
+	}
+}
+
+func TestSendEmailsImmediatelySkipsUnauthorizedProviders(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "news@other.com"},
+		Subject: "Hi",
+		Content: []Content{{Type: "text/plain", Value: "Hello"}},
+		To:      []EmailAddress{{Email: "ann@example.com"}},
+		Credentials: Credentials{
+			SendgridAPIKey: "key",
+			SendingDomains: map[string][]string{"sendgrid": {"example.com"}},
+		},
+	}
+	weights := RoutingWeights{Global: map[string]int{"sendgrid": 1000}}
+
+	counts := sendEmailsImmediately(emailMessage, weights, NewSenderSelector(nil, AffinityNone, ""))
+	if counts[""].Failed != 1 || counts["sendgrid"].Sent+counts["sendgrid"].Failed != 0 {
+		t.Errorf("Expected the recipient to fail without reaching SendGrid, got %+v", counts)
+	}
+}
+
+func TestAuthorizedWeights(t *testing.T) {
+	credentials := Credentials{
+		SendingDomains: map[string][]string{
+			"sendgrid": {"example.com"},
+			"postmark": {"other.com"},
+		},
+	}
+	weights := map[string]int{"sendgrid": 500, "postmark": 300, "sparkpost": 200}
+
+	filtered := credentials.authorizedWeights(weights, EmailAddress{Email: "news@example.com"})
+	if len(filtered) != 2 || filtered["sendgrid"] != 500 || filtered["sparkpost"] != 200 {
+		t.Errorf("Expected SendGrid and the unrestricted SparkPost, got %v", filtered)
+	}
+	if len(weights) != 3 {
+		t.Errorf("Expected the input weights to be left unchanged, got %v", weights)
+	}
+}
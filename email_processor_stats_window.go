@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"math/rand"
+	"time"
+)
+
+// statsWindows lists the start times of the statistics windows to try,
+// narrowest first. Later batches of a campaign pass the time of the previous
+// batch as lastBatch so weights react to what that batch just experienced;
+// the windows then widen to a week, the profile's lookback window and finally
+// three times that window (capped at a year).
+func statsWindows(profile ScoringProfile, lastBatch time.Time, now time.Time) []time.Time {
+	var windows []time.Time
+	if !lastBatch.IsZero() && lastBatch.Before(now) {
+		windows = append(windows, lastBatch)
+	}
+
+	if profile.DecayWindowDays > 7 {
+		windows = append(windows, now.AddDate(0, 0, -7))
+	}
+	windows = append(windows, now.AddDate(0, 0, -profile.DecayWindowDays))
+
+	widest := profile.DecayWindowDays * 3
+	if widest > 365 {
+		widest = 365
+	}
+	if widest > profile.DecayWindowDays {
+		windows = append(windows, now.AddDate(0, 0, -widest))
+	}
+
+	return windows
+}
+
+// calculateRoutingWeights computes routing weights from the narrowest window
+// in windows that holds at least the profile's minimum sample size of
+// (decayed) events across all providers. When no window has enough data the
+// widest one is used; when it is empty, every provider with valid credentials
+// is given an equal weight. The bandit strategy draws from source, or from a
+// clock-seeded source when nil.
+func calculateRoutingWeights(db *sql.DB, userID int, credentials Credentials, settings RoutingSettings, windows []time.Time, now time.Time, source rand.Source) (RoutingWeights, error) {
+	var groupStats map[string][]ProviderStats
+	for _, start := range windows {
+		var err error
+		groupStats, err = getProviderStatsByMailboxProvider(db, userID, start, now, settings.Profile.halfLife())
+		if err != nil {
+			return RoutingWeights{}, err
+		}
+
+		sample := 0.0
+		for _, s := range mergeProviderStats(groupStats) {
+			sample += s.TotalEvents
+		}
+		if sample >= float64(settings.Profile.MinSampleSize) {
+			break
+		}
+	}
+
+	return routingWeightsFromStats(groupStats, credentials, settings, source), nil
+}
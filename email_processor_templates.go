@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"relay-go-consumer/database"
+)
+
+// StoredTemplate is a version of a template kept in the email_templates table.
+type StoredTemplate struct {
+	TemplateID string
+	Version    int
+	Subject    string
+	HtmlBody   string
+	TextBody   string
+	Sections   map[string]string
+}
+
+// templateKey identifies a stored template of a user. A zero Version means
+// the latest active version.
+type templateKey struct {
+	UserID     int
+	TemplateID string
+	Version    int
+}
+
+// fetchStoredTemplate loads a template owned by the user. Without a version
+// the highest active version is used.
+func fetchStoredTemplate(db *sql.DB, key templateKey) (StoredTemplate, error) {
+	var template StoredTemplate
+	var subject, htmlBody, textBody sql.NullString
+	var sections []byte
+
+	err := db.QueryRow(`
+        SELECT template_id, version, subject, html_body, text_body, sections
+        FROM email_templates
+        WHERE user_id = $1 AND template_id = $2
+          AND (($3 = 0 AND active) OR version = $3)
+        ORDER BY version DESC
+        LIMIT 1
+    `, key.UserID, key.TemplateID, key.Version).Scan(
+		&template.TemplateID,
+		&template.Version,
+		&subject,
+		&htmlBody,
+		&textBody,
+		&sections,
+	)
+	if err == sql.ErrNoRows {
+		if key.Version != 0 {
+			return StoredTemplate{}, fmt.Errorf("template %s version %d not found for user %d", key.TemplateID, key.Version, key.UserID)
+		}
+		return StoredTemplate{}, fmt.Errorf("no active version of template %s found for user %d", key.TemplateID, key.UserID)
+	}
+	if err != nil {
+		return StoredTemplate{}, fmt.Errorf("failed to query template %s: %v", key.TemplateID, err)
+	}
+
+	template.Subject = subject.String
+	template.HtmlBody = htmlBody.String
+	template.TextBody = textBody.String
+	if len(sections) > 0 {
+		if err := json.Unmarshal(sections, &template.Sections); err != nil {
+			return StoredTemplate{}, fmt.Errorf("invalid sections in template %s version %d: %v", key.TemplateID, template.Version, err)
+		}
+	}
+
+	// Parse once here so a broken template is reported when it is loaded
+	// rather than once per recipient
+	if _, err := newMessageRenderer(template.apply(EmailMessage{})); err != nil {
+		return StoredTemplate{}, fmt.Errorf("template %s version %d: %v", key.TemplateID, template.Version, err)
+	}
+
+	return template, nil
+}
+
+// loadStoredTemplate loads a template for a cache miss.
+func loadStoredTemplate(key templateKey) (StoredTemplate, error) {
+	database.InitDB()
+	return fetchStoredTemplate(database.GetDB(), key)
+}
+
+// apply uses the template as the content of emailMessage. A subject in the
+// message takes precedence over the template's, and message sections
+// override template sections with the same name.
+func (t StoredTemplate) apply(emailMessage EmailMessage) EmailMessage {
+	emailMessage.Content = nil
+	emailMessage.HtmlBody = t.HtmlBody
+	emailMessage.TextBody = t.TextBody
+	if emailMessage.Subject == "" {
+		emailMessage.Subject = t.Subject
+	}
+
+	sections := make(map[string]string, len(t.Sections)+len(emailMessage.Sections))
+	for name, value := range parseSectionsDynamic(t.Sections) {
+		sections[name] = value
+	}
+	for name, value := range parseSectionsDynamic(emailMessage.Sections) {
+		sections[name] = value
+	}
+	emailMessage.Sections = sections
+	return emailMessage
+}
+
+// resolveStoredTemplate replaces the content of a message that references a
+// stored template with that template.
+func resolveStoredTemplate(emailMessage EmailMessage, userID int) (EmailMessage, error) {
+	if emailMessage.TemplateID == "" {
+		return emailMessage, nil
+	}
+
+	template, err := templateCache.Get(templateKey{
+		UserID:     userID,
+		TemplateID: emailMessage.TemplateID,
+		Version:    emailMessage.TemplateVersion,
+	})
+	if err != nil {
+		return emailMessage, err
+	}
+
+	switch emailMessage.TemplateMode {
+	case "", templateModeLocal:
+	case templateModeNative:
+		// The providers' copies only have the template's own sections
+		if len(emailMessage.Sections) == 0 {
+			sections := make(map[string]bool, len(template.Sections))
+			for name := range parseSectionsDynamic(template.Sections) {
+				sections[name] = true
+			}
+			emailMessage.resolved = &resolvedTemplate{
+				key:      templateKey{UserID: userID, TemplateID: template.TemplateID, Version: template.Version},
+				subject:  template.Subject,
+				sections: sections,
+			}
+		}
+	default:
+		return emailMessage, fmt.Errorf("unknown template mode %q", emailMessage.TemplateMode)
+	}
+	return template.apply(emailMessage), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFetchStoredTemplate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"template_id", "version", "subject", "html_body", "text_body", "sections"}
+	mock.ExpectQuery("SELECT template_id, version").WithArgs(1, "welcome", 0).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("welcome", 3, "Welcome {{name}}", "<p>Hi {{name}}</p>{{> footer}}", nil, []byte(`{"-footer-": "<p>Bye</p>"}`)))
+	mock.ExpectQuery("SELECT template_id, version").WithArgs(1, "broken", 2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("broken", 2, "", "{{#if name}}", nil, nil))
+	mock.ExpectQuery("SELECT template_id, version").WithArgs(1, "missing", 0).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	template, err := fetchStoredTemplate(db, templateKey{UserID: 1, TemplateID: "welcome"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if template.Version != 3 || template.Sections["-footer-"] != "<p>Bye</p>" {
+		t.Errorf("Unexpected template: %+v", template)
+	}
+
+	if _, err := fetchStoredTemplate(db, templateKey{UserID: 1, TemplateID: "broken", Version: 2}); err == nil {
+		t.Error("Expected an error for a template that does not parse")
+	}
+	if _, err := fetchStoredTemplate(db, templateKey{UserID: 1, TemplateID: "missing"}); err == nil {
+		t.Error("Expected an error for a missing template")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStoredTemplateApply(t *testing.T) {
+	template := StoredTemplate{
+		Subject:  "Welcome {{name}}",
+		HtmlBody: "<p>Hi {{name}}</p>{{> footer}}",
+		Sections: map[string]string{"-footer-": "<p>Bye</p>"},
+	}
+	emailMessage := template.apply(EmailMessage{
+		Content:  []Content{{Type: "text/html", Value: "inline content is replaced"}},
+		Sections: map[string]string{"footer": "<p>See you, {{name}}</p>"},
+	})
+
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	subject, content, err := renderer.Render(Personalization{Substitutions: map[string]string{"name": "Ann"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if subject != "Welcome Ann" {
+		t.Errorf("Expected the template subject, got %q", subject)
+	}
+	if html := getContentByType(content, "text/html"); html != "<p>Hi Ann</p><p>See you, Ann</p>" {
+		t.Errorf("Expected the message section to override the template section, got %q", html)
+	}
+}
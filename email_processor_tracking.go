@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+// Tracking is the provider-agnostic tracking and metadata block of a message.
+// Unset toggles leave each provider's account default in place.
+type Tracking struct {
+	Opens  *bool `json:"opens,omitempty"`
+	Clicks *bool `json:"clicks,omitempty"`
+	// MessageStream selects a Postmark message stream, "outbound" by default
+	MessageStream string `json:"message_stream,omitempty"`
+	// Tags label the message in provider reporting. The first tag is used
+	// where a provider allows only one: the Postmark tag, the SparkPost
+	// campaign and the SocketLabs mailing ID.
+	Tags []string `json:"tags,omitempty"`
+	// Metadata is returned by the providers in their events, like custom
+	// arguments, which take precedence over it
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// tags returns the tracking tags followed by the message's categories,
+// without duplicates.
+func (emailMessage EmailMessage) tags() []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range append(append([]string{}, emailMessage.Tracking.Tags...), emailMessage.Categories...) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// primaryTag is the tag used by providers that accept only one.
+func (emailMessage EmailMessage) primaryTag() string {
+	if tags := emailMessage.tags(); len(tags) > 0 {
+		return tags[0]
+	}
+	return ""
+}
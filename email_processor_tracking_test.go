@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackingTagsAndMetadata(t *testing.T) {
+	emailMessage := EmailMessage{
+		Categories: []string{"newsletter", "spring"},
+		CustomArgs: map[string]interface{}{"source": "api"},
+		Tracking: Tracking{
+			Tags:     []string{"spring", "promo"},
+			Metadata: map[string]string{"source": "tracking", "team": "growth"},
+		},
+	}
+
+	assert.Equal(t, []string{"spring", "promo", "newsletter"}, emailMessage.tags())
+	assert.Equal(t, "spring", emailMessage.primaryTag())
+
+	env := emailMessage.envelopeFor(Personalization{})
+	assert.Equal(t, map[string]string{"source": "api", "team": "growth"}, env.customArgStrings())
+}
+
+func TestPostmarkTrackingSettings(t *testing.T) {
+	disabled := false
+	emailMessage := EmailMessage{
+		From:             EmailAddress{Email: "news@example.com"},
+		Content:          []Content{{Type: "text/plain", Value: "Hi"}},
+		Personalizations: []Personalization{{To: EmailAddressList{{Email: "a@example.com"}}}},
+	}
+
+	messages, _ := mapEmailMessageToPostmark(emailMessage, newSendResults(1))
+	assert.True(t, messages[0].TrackOpens)
+	assert.Equal(t, "HtmlOnly", messages[0].TrackLinks)
+	assert.Equal(t, "outbound", messages[0].MessageStream)
+
+	emailMessage.Tracking = Tracking{Opens: &disabled, Clicks: &disabled, MessageStream: "broadcast", Tags: []string{"promo"}}
+	messages, _ = mapEmailMessageToPostmark(emailMessage, newSendResults(1))
+	assert.False(t, messages[0].TrackOpens)
+	assert.Equal(t, "None", messages[0].TrackLinks)
+	assert.Equal(t, "broadcast", messages[0].MessageStream)
+	assert.Equal(t, "promo", messages[0].Tag)
+
+	assert.Nil(t, sparkPostOptions(Tracking{}))
+	assert.Equal(t, &disabled, sparkPostOptions(emailMessage.Tracking).ClickTracking)
+}
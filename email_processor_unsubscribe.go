@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"relay-go-consumer/database"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/lib/pq"
+)
+
+// unsubscribeURLKey is the template variable holding a recipient's
+// unsubscribe link, for content that places the link itself.
+const unsubscribeURLKey = "unsubscribe_url"
+
+// unsubscribeTokenVersion prefixes every token, so the format can change
+// without breaking links already delivered.
+const unsubscribeTokenVersion = "v1"
+
+// UnsubscribeSettings is a user's List-Unsubscribe configuration. BaseURL is
+// the HTTPS endpoint that accepts one-click POSTs and link clicks, with the
+// token added as the token query parameter. Mailto optionally adds a mailto:
+// alternative, and FooterHTML and FooterText are added to content that does
+// not use {{unsubscribe_url}} itself.
+type UnsubscribeSettings struct {
+	Enabled    bool
+	BaseURL    string
+	Mailto     string
+	Secret     string
+	FooterHTML string
+	FooterText string
+}
+
+// unsubscribeClaims is what a token identifies: the recipient, the user who
+// sent the message and the message's correlation ID.
+type unsubscribeClaims struct {
+	UserID        int    `json:"u"`
+	Email         string `json:"e"`
+	CorrelationID string `json:"c,omitempty"`
+}
+
+// fetchUnsubscribeSettings loads the user's unsubscribe settings. Users
+// without a row, or with unsubscribe disabled, get no headers.
+func fetchUnsubscribeSettings(db *sql.DB, userID int) (UnsubscribeSettings, error) {
+	var settings UnsubscribeSettings
+	var mailto, footerHTML, footerText sql.NullString
+	err := db.QueryRow(`
+        SELECT enabled, base_url, mailto, secret, footer_html, footer_text
+        FROM user_unsubscribe_settings
+        WHERE user_id = $1
+    `, userID).Scan(&settings.Enabled, &settings.BaseURL, &mailto, &settings.Secret, &footerHTML, &footerText)
+	if err == sql.ErrNoRows {
+		return UnsubscribeSettings{}, nil
+	}
+	if err != nil {
+		return UnsubscribeSettings{}, fmt.Errorf("failed to query unsubscribe settings: %v", err)
+	}
+	settings.Mailto = mailto.String
+	settings.FooterHTML = footerHTML.String
+	settings.FooterText = footerText.String
+
+	if !settings.Enabled {
+		return settings, nil
+	}
+	if !strings.HasPrefix(settings.BaseURL, "https://") {
+		return UnsubscribeSettings{}, fmt.Errorf("unsubscribe base URL for user ID %d must be https, got %q", userID, settings.BaseURL)
+	}
+	if settings.Secret == "" {
+		return UnsubscribeSettings{}, fmt.Errorf("no unsubscribe secret for user ID %d", userID)
+	}
+	return settings, nil
+}
+
+// loadUnsubscribeSettings fetches unsubscribe settings for a cache miss.
+func loadUnsubscribeSettings(userID int) (UnsubscribeSettings, error) {
+	database.InitDB()
+	return fetchUnsubscribeSettings(database.GetDB(), userID)
+}
+
+// signUnsubscribeToken returns "v1.<claims>.<signature>", the claims as
+// base64url JSON and the signature an HMAC-SHA256 of both with the user's
+// secret.
+func signUnsubscribeToken(secret string, claims unsubscribeClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal unsubscribe claims: %v", err)
+	}
+	signed := unsubscribeTokenVersion + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + unsubscribeSignature(secret, signed), nil
+}
+
+func unsubscribeSignature(secret, signed string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseUnsubscribeToken checks the format of a token and returns its claims,
+// which are not trusted until verifyUnsubscribeToken checks the signature.
+func parseUnsubscribeToken(token string) (unsubscribeClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != unsubscribeTokenVersion {
+		return unsubscribeClaims{}, fmt.Errorf("malformed unsubscribe token")
+	}
+	if signature, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil || len(signature) != sha256.Size {
+		return unsubscribeClaims{}, fmt.Errorf("malformed unsubscribe token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return unsubscribeClaims{}, fmt.Errorf("malformed unsubscribe token claims: %v", err)
+	}
+
+	var claims unsubscribeClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return unsubscribeClaims{}, fmt.Errorf("malformed unsubscribe token claims: %v", err)
+	}
+	if claims.UserID <= 0 || claims.Email == "" {
+		return unsubscribeClaims{}, fmt.Errorf("unsubscribe token has no user or recipient")
+	}
+	return claims, nil
+}
+
+// verifyUnsubscribeToken checks that a token was signed with secret.
+func verifyUnsubscribeToken(secret, token string) bool {
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 || secret == "" {
+		return false
+	}
+	expected := unsubscribeSignature(secret, token[:dot])
+	return hmac.Equal([]byte(token[dot+1:]), []byte(expected))
+}
+
+// listUnsubscribeHeaders are the recipient headers withUnsubscribe adds,
+// sorted.
+var listUnsubscribeHeaders = []string{"List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// withUnsubscribe gives every personalization its signed unsubscribe link as
+// the unsubscribe_url variable, and List-Unsubscribe and
+// List-Unsubscribe-Post recipient headers for one-click unsubscribe
+// (RFC 8058), unless the message already sets List-Unsubscribe. The footer is added to content
+// that does not place the link itself.
+func withUnsubscribe(emailMessage EmailMessage, settings UnsubscribeSettings, userID int) (EmailMessage, error) {
+	if !settings.Enabled {
+		return emailMessage, nil
+	}
+	emailMessage = expandPersonalizations(emailMessage)
+
+	for i, p := range emailMessage.Personalizations {
+		env := emailMessage.envelopeFor(p)
+		token, err := signUnsubscribeToken(settings.Secret, unsubscribeClaims{
+			UserID:        userID,
+			Email:         strings.ToLower(p.primaryRecipient().Email),
+			CorrelationID: emailMessage.correlationID(p),
+		})
+		if err != nil {
+			return emailMessage, err
+		}
+		link := unsubscribeLink(settings.BaseURL, token)
+
+		substitutions := make(map[string]string, len(p.Substitutions)+1)
+		for key, value := range p.Substitutions {
+			substitutions[key] = value
+		}
+		substitutions[unsubscribeURLKey] = link
+		p.Substitutions = substitutions
+
+		if !hasHeader(env.Headers, "List-Unsubscribe") {
+			targets := "<" + link + ">"
+			if settings.Mailto != "" {
+				targets += ", <mailto:" + settings.Mailto + "?subject=" + url.PathEscape("unsubscribe "+token) + ">"
+			}
+			p.recipientHeaders = map[string]string{
+				"List-Unsubscribe":      targets,
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			}
+		}
+		emailMessage.Personalizations[i] = p
+	}
+
+	return withUnsubscribeFooter(emailMessage, settings), nil
+}
+
+// suppressUnsubscribed removes every To address that has unsubscribed from
+// the user's mail, along with personalizations left without one, and returns
+// each removed address as a rejected recipient. Addresses are compared as
+// they appear in unsubscribe tokens, lowercased.
+func suppressUnsubscribed(db *sql.DB, emailMessage EmailMessage, userID int) (EmailMessage, []rejectedRecipient, error) {
+	emailMessage = expandPersonalizations(emailMessage)
+	if len(emailMessage.Personalizations) == 0 {
+		return emailMessage, nil, nil
+	}
+
+	var emails []string
+	for _, p := range emailMessage.Personalizations {
+		for _, to := range p.To {
+			emails = append(emails, strings.ToLower(to.Email))
+		}
+	}
+
+	rows, err := db.Query(`
+        SELECT email
+        FROM unsubscribes
+        WHERE user_id = $1 AND email = ANY($2)
+    `, userID, pq.Array(emails))
+	if err != nil {
+		return emailMessage, nil, fmt.Errorf("failed to query unsubscribes: %v", err)
+	}
+	defer rows.Close()
+
+	unsubscribed := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return emailMessage, nil, fmt.Errorf("failed to scan unsubscribe: %v", err)
+		}
+		unsubscribed[email] = true
+	}
+	if err := rows.Err(); err != nil {
+		return emailMessage, nil, fmt.Errorf("failed to query unsubscribes: %v", err)
+	}
+	if len(unsubscribed) == 0 {
+		return emailMessage, nil, nil
+	}
+
+	var kept []Personalization
+	var suppressed []rejectedRecipient
+	for _, p := range emailMessage.Personalizations {
+		var to EmailAddressList
+		for _, address := range p.To {
+			if !unsubscribed[strings.ToLower(address.Email)] {
+				to = append(to, address)
+				continue
+			}
+			rejected := p
+			rejected.To = EmailAddressList{address}
+			suppressed = append(suppressed, rejectedRecipient{
+				Personalization: rejected,
+				Issues:          []validationIssue{{Code: issueUnsubscribed, Field: "to", Detail: "the recipient unsubscribed"}},
+			})
+		}
+		if len(to) > 0 {
+			p.To = to
+			kept = append(kept, p)
+		}
+	}
+	emailMessage.Personalizations = kept
+	return emailMessage, suppressed, nil
+}
+
+// unsubscribeLink adds the token to the base URL's query.
+func unsubscribeLink(baseURL, token string) string {
+	separator := "?"
+	if strings.Contains(baseURL, "?") {
+		separator = "&"
+	}
+	return baseURL + separator + "token=" + token
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// withUnsubscribeFooter adds the HTML footer before </body> of HTML content
+// and the text footer to the end of plain-text content. Content that uses
+// {{unsubscribe_url}} already has a link and is left as it is.
+func withUnsubscribeFooter(emailMessage EmailMessage, settings UnsubscribeSettings) EmailMessage {
+	if len(emailMessage.Content) == 0 {
+		emailMessage.HtmlBody = addFooter(emailMessage.HtmlBody, settings.FooterHTML, true)
+		emailMessage.TextBody = addFooter(emailMessage.TextBody, settings.FooterText, false)
+		return emailMessage
+	}
+
+	content := make([]Content, len(emailMessage.Content))
+	for i, item := range emailMessage.Content {
+		if isHTMLContent(item.Type) {
+			item.Value = addFooter(item.Value, settings.FooterHTML, true)
+		} else {
+			item.Value = addFooter(item.Value, settings.FooterText, false)
+		}
+		content[i] = item
+	}
+	emailMessage.Content = content
+	return emailMessage
+}
+
+func addFooter(value, footer string, html bool) string {
+	if value == "" || footer == "" || strings.Contains(value, unsubscribeURLKey) {
+		return value
+	}
+	if !html {
+		return strings.TrimRight(value, "\n") + "\n\n" + footer
+	}
+	if end := strings.LastIndex(strings.ToLower(value), "</body>"); end >= 0 {
+		return value[:end] + footer + value[end:]
+	}
+	return value + footer
+}
+
+// UnsubscribeWebhookPayload is published by the unsubscribe endpoint for
+// every one-click POST, link click or mailto reply it receives.
+type UnsubscribeWebhookPayload struct {
+	Headers map[string][]string `json:"headers"`
+	Body    UnsubscribeRequest  `json:"body"`
+}
+
+// UnsubscribeRequest is one unsubscribe. Method is "one_click", "link" or
+// "mailto", and ReceivedAt defaults to the time it is processed.
+type UnsubscribeRequest struct {
+	Token      string    `json:"token"`
+	Method     string    `json:"method"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// ProcessUnsubscribeEvents records unsubscribes whose token is well formed
+// and signed with the sending user's secret; others are logged and dropped.
+func ProcessUnsubscribeEvents(msg *sarama.ConsumerMessage) {
+	var payload UnsubscribeWebhookPayload
+	err := json.Unmarshal(msg.Value, &payload)
+	if err != nil {
+		log.Printf("Failed to unmarshal unsubscribe event: %v", err)
+		return
+	}
+
+	claims, err := parseUnsubscribeToken(payload.Body.Token)
+	if err != nil {
+		log.Printf("Rejected unsubscribe event: %v", err)
+		return
+	}
+
+	initCaches()
+	settings, err := unsubscribeCache.Get(claims.UserID)
+	if err != nil {
+		log.Printf("Failed to fetch unsubscribe settings for user %d: %v", claims.UserID, err)
+		return
+	}
+	if !verifyUnsubscribeToken(settings.Secret, payload.Body.Token) {
+		log.Printf("Rejected unsubscribe event for user %d: invalid token signature", claims.UserID)
+		return
+	}
+
+	database.InitDB()
+	if err := saveUnsubscribe(database.GetDB(), claims, payload.Body); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// saveUnsubscribe records the first unsubscribe of a recipient from a user's
+// mail; repeated requests for the same recipient are ignored.
+func saveUnsubscribe(db *sql.DB, claims unsubscribeClaims, request UnsubscribeRequest) error {
+	receivedAt := request.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now().UTC()
+	}
+	messageID, index, _ := splitCorrelationID(claims.CorrelationID)
+
+	_, err := db.Exec(`
+        INSERT INTO unsubscribes (user_id, email, correlation_id, message_id, recipient_index, method, unsubscribed_at)
+        VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, ''), $7)
+        ON CONFLICT (user_id, email) DO NOTHING
+    `, claims.UserID, claims.Email, claims.CorrelationID, messageID, index, request.Method, receivedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save unsubscribe: %v", err)
+	}
+	return nil
+}
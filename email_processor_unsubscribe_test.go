@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testUnsubscribeSettings = UnsubscribeSettings{
+	Enabled:    true,
+	BaseURL:    "https://unsub.example.com/u",
+	Mailto:     "unsubscribe@example.com",
+	Secret:     "s3cret",
+	FooterHTML: `<p><a href="{{unsubscribe_url}}">Unsubscribe</a></p>`,
+	FooterText: "Unsubscribe: {{unsubscribe_url}}",
+}
+
+func TestUnsubscribeTokenRoundTrip(t *testing.T) {
+	claims := unsubscribeClaims{UserID: 7, Email: "ann@example.com", CorrelationID: "msg-1.2"}
+	token, err := signUnsubscribeToken("s3cret", claims)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	parsed, err := parseUnsubscribeToken(token)
+	if err != nil {
+		t.Fatalf("Expected a well-formed token, got %v", err)
+	}
+	if parsed != claims {
+		t.Errorf("Expected claims %+v, got %+v", claims, parsed)
+	}
+	if !verifyUnsubscribeToken("s3cret", token) {
+		t.Errorf("Expected the token to verify with its secret")
+	}
+	if verifyUnsubscribeToken("other", token) {
+		t.Errorf("Expected the token not to verify with another secret")
+	}
+
+	// Changing the claims invalidates the signature
+	parts := strings.Split(token, ".")
+	forged, _ := signUnsubscribeToken("s3cret", unsubscribeClaims{UserID: 7, Email: "bob@example.com"})
+	tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+	if verifyUnsubscribeToken("s3cret", tampered) {
+		t.Errorf("Expected a tampered token not to verify")
+	}
+}
+
+func TestParseUnsubscribeTokenRejectsMalformed(t *testing.T) {
+	valid, _ := signUnsubscribeToken("s3cret", unsubscribeClaims{UserID: 7, Email: "ann@example.com"})
+	noUser, _ := signUnsubscribeToken("s3cret", unsubscribeClaims{Email: "ann@example.com"})
+	parts := strings.Split(valid, ".")
+
+	for name, token := range map[string]string{
+		"empty":             "",
+		"wrong version":     "v2." + parts[1] + "." + parts[2],
+		"missing signature": parts[0] + "." + parts[1],
+		"short signature":   parts[0] + "." + parts[1] + ".abc",
+		"claims not base64": parts[0] + ".***." + parts[2],
+		"claims not JSON":   parts[0] + ".bm90LWpzb24." + parts[2],
+		"no user":           noUser,
+	} {
+		if _, err := parseUnsubscribeToken(token); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWithUnsubscribe(t *testing.T) {
+	emailMessage := EmailMessage{
+		messageID: "msg-1",
+		Content: []Content{
+			{Type: "text/plain", Value: "Hello"},
+			{Type: "text/html", Value: "<html><body><p>Hello</p></body></html>"},
+		},
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "Ann@Example.com"}}},
+			{To: EmailAddressList{{Email: "bob@example.com"}}, Headers: map[string]string{"list-unsubscribe": "<https://producer.example.com>"}},
+		},
+	}
+
+	result, err := withUnsubscribe(emailMessage, testUnsubscribeSettings, 7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ann := result.Personalizations[0]
+	link := ann.Substitutions[unsubscribeURLKey]
+	if !strings.HasPrefix(link, "https://unsub.example.com/u?token=v1.") {
+		t.Fatalf("Expected a signed unsubscribe link, got %q", link)
+	}
+	token := strings.TrimPrefix(link, "https://unsub.example.com/u?token=")
+	claims, err := parseUnsubscribeToken(token)
+	if err != nil || !verifyUnsubscribeToken("s3cret", token) {
+		t.Fatalf("Expected a valid token, got %v", err)
+	}
+	if claims.Email != "ann@example.com" || claims.CorrelationID != "msg-1.1" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	header := ann.recipientHeaders["List-Unsubscribe"]
+	if !strings.HasPrefix(header, "<"+link+">, <mailto:unsubscribe@example.com?subject=unsubscribe%20v1.") {
+		t.Errorf("Unexpected List-Unsubscribe header %q", header)
+	}
+	if ann.recipientHeaders["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("Expected a one-click List-Unsubscribe-Post header, got %q", ann.recipientHeaders["List-Unsubscribe-Post"])
+	}
+	if len(ann.Headers) != 0 {
+		t.Errorf("Expected the unsubscribe headers to be kept out of the shared headers, got %v", ann.Headers)
+	}
+
+	// Recipients with their own links still go out together
+	second, _ := withUnsubscribe(EmailMessage{
+		From:             EmailAddress{Email: "news@example.com"},
+		Personalizations: []Personalization{{To: EmailAddressList{{Email: "ann@example.com"}}}, {To: EmailAddressList{{Email: "cy@example.com"}}}},
+	}, testUnsubscribeSettings, 7)
+	first, other := second.envelopeFor(second.Personalizations[0]), second.envelopeFor(second.Personalizations[1])
+	if first.groupKey() != other.groupKey() {
+		t.Errorf("Expected recipients with different unsubscribe links to share a group")
+	}
+	if first.allHeaders()["List-Unsubscribe"] == other.allHeaders()["List-Unsubscribe"] {
+		t.Errorf("Expected each recipient to keep its own List-Unsubscribe header")
+	}
+
+	// A header set by the producer is kept
+	bob := result.Personalizations[1]
+	if len(bob.recipientHeaders) != 0 || bob.Headers["list-unsubscribe"] != "<https://producer.example.com>" {
+		t.Errorf("Expected the producer's header to be kept, got %v", bob.Headers)
+	}
+	if emailMessage.Personalizations[0].Headers != nil {
+		t.Errorf("Expected the original message to be left unchanged")
+	}
+
+	if result.Content[0].Value != "Hello\n\nUnsubscribe: {{unsubscribe_url}}" {
+		t.Errorf("Unexpected text content %q", result.Content[0].Value)
+	}
+	if result.Content[1].Value != `<html><body><p>Hello</p><p><a href="{{unsubscribe_url}}">Unsubscribe</a></p></body></html>` {
+		t.Errorf("Unexpected HTML content %q", result.Content[1].Value)
+	}
+}
+
+func TestWithUnsubscribeKeepsContentWithLink(t *testing.T) {
+	emailMessage := EmailMessage{
+		HtmlBody: `<a href="{{unsubscribe_url}}">Leave</a>`,
+		To:       []EmailAddress{{Email: "ann@example.com"}},
+	}
+	result, err := withUnsubscribe(emailMessage, testUnsubscribeSettings, 7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.HtmlBody != emailMessage.HtmlBody {
+		t.Errorf("Expected content that places the link to be kept, got %q", result.HtmlBody)
+	}
+
+	disabled, _ := withUnsubscribe(emailMessage, UnsubscribeSettings{}, 7)
+	if len(disabled.Personalizations) != 0 {
+		t.Errorf("Expected disabled settings to leave the message unchanged")
+	}
+}
+
+func TestFetchUnsubscribeSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"enabled", "base_url", "mailto", "secret", "footer_html", "footer_text"}
+	testCases := []struct {
+		name      string
+		rows      *sqlmock.Rows
+		expectErr bool
+		enabled   bool
+	}{
+		{name: "No settings row", rows: sqlmock.NewRows(columns)},
+		{name: "Enabled", rows: sqlmock.NewRows(columns).AddRow(true, "https://unsub.example.com", nil, "s3cret", nil, nil), enabled: true},
+		{name: "Plain HTTP", rows: sqlmock.NewRows(columns).AddRow(true, "http://unsub.example.com", nil, "s3cret", nil, nil), expectErr: true},
+		{name: "No secret", rows: sqlmock.NewRows(columns).AddRow(true, "https://unsub.example.com", nil, "", nil, nil), expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock.ExpectQuery("SELECT enabled, base_url, mailto, secret, footer_html, footer_text").
+				WithArgs(7).
+				WillReturnRows(tc.rows)
+
+			settings, err := fetchUnsubscribeSettings(db, 7)
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("Expected error: %v, got %v", tc.expectErr, err)
+			}
+			if settings.Enabled != tc.enabled {
+				t.Errorf("Expected enabled %v, got %+v", tc.enabled, settings)
+			}
+		})
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveUnsubscribe(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	receivedAt := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	mock.ExpectExec("INSERT INTO unsubscribes").
+		WithArgs(7, "ann@example.com", "msg-1.2", "msg-1", 2, "one_click", receivedAt).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	claims := unsubscribeClaims{UserID: 7, Email: "ann@example.com", CorrelationID: "msg-1.2"}
+	if err := saveUnsubscribe(db, claims, UnsubscribeRequest{Method: "one_click", ReceivedAt: receivedAt}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSuppressUnsubscribed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	emailMessage := EmailMessage{
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "Ann@Example.com"}}},
+			{To: EmailAddressList{{Email: "bob@example.com"}}},
+		},
+	}
+
+	mock.ExpectQuery("SELECT email\\s+FROM unsubscribes").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("ann@example.com"))
+
+	result, suppressed, err := suppressUnsubscribed(db, emailMessage, 7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Personalizations) != 1 || result.Personalizations[0].primaryRecipient().Email != "bob@example.com" {
+		t.Errorf("Expected only bob to be sent, got %+v", result.Personalizations)
+	}
+	if len(suppressed) != 1 || suppressed[0].Personalization.Index != 1 || suppressed[0].Issues[0].Code != issueUnsubscribed {
+		t.Errorf("Expected ann to be rejected as unsubscribed, got %+v", suppressed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSuppressUnsubscribedMultipleTo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	emailMessage := EmailMessage{
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "ann@example.com"}, {Email: "Bob@Example.com"}, {Email: "cy@example.com"}}},
+			{To: EmailAddressList{{Email: "dee@example.com"}, {Email: "eve@example.com"}}},
+		},
+	}
+
+	mock.ExpectQuery("SELECT email\\s+FROM unsubscribes").
+		WithArgs(7, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("bob@example.com").AddRow("dee@example.com").AddRow("eve@example.com"))
+
+	result, suppressed, err := suppressUnsubscribed(db, emailMessage, 7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Personalizations) != 1 {
+		t.Fatalf("Expected only the first personalization to be sent, got %+v", result.Personalizations)
+	}
+	if to := result.Personalizations[0].To; len(to) != 2 || to[0].Email != "ann@example.com" || to[1].Email != "cy@example.com" {
+		t.Errorf("Expected bob to be removed from the To addresses, got %+v", to)
+	}
+
+	var emails []string
+	for _, r := range suppressed {
+		emails = append(emails, r.Personalization.primaryRecipient().Email)
+	}
+	if len(suppressed) != 3 || emails[0] != "Bob@Example.com" || emails[1] != "dee@example.com" || emails[2] != "eve@example.com" {
+		t.Errorf("Expected bob, dee and eve to be rejected as unsubscribed, got %v", emails)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Codes of the reasons a recipient is rejected before sending.
+const (
+	issueMissingRecipient      = "missing_recipient"
+	issueMissingFrom           = "missing_from"
+	issueInvalidAddress        = "invalid_address"
+	issueMissingContent        = "missing_content"
+	issueHeaderInjection       = "header_injection"
+	issueInvalidHeader         = "invalid_header"
+	issueInvalidAttachment     = "invalid_attachment"
+	issueAttachmentTooLarge    = "attachment_too_large"
+	issueUnresolvedPlaceholder = "unresolved_placeholder"
+	issueInvalidTemplate       = "invalid_template"
+	issueUnsubscribed          = "unsubscribed"
+)
+
+// validationIssue is one reason a recipient was rejected.
+type validationIssue struct {
+	Code   string `json:"code"`
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+func (i validationIssue) String() string {
+	return fmt.Sprintf("%s: %s (%s)", i.Field, i.Detail, i.Code)
+}
+
+// rejectedRecipient is a personalization that failed validation and was not
+// handed to any provider.
+type rejectedRecipient struct {
+	Personalization Personalization
+	Issues          []validationIssue
+}
+
+// validateEmailMessage prepares the attachments and checks the message and
+// each of its personalizations before any provider is called. It returns
+// the message with only the personalizations that passed, and the others
+// with the reasons they were rejected.
+func validateEmailMessage(emailMessage EmailMessage) (EmailMessage, []rejectedRecipient) {
+	emailMessage = expandPersonalizations(emailMessage)
+	if len(emailMessage.Personalizations) == 0 {
+		return emailMessage, []rejectedRecipient{{
+			Issues: []validationIssue{{Code: issueMissingRecipient, Field: "to", Detail: "the message has no recipients"}},
+		}}
+	}
+
+	var messageIssues []validationIssue
+	prepared, err := prepareAttachments(emailMessage)
+	if err != nil {
+		messageIssues = append(messageIssues, validationIssue{Code: issueInvalidAttachment, Field: "attachments", Detail: err.Error()})
+	} else {
+		emailMessage = prepared
+	}
+	messageIssues = append(messageIssues, validateMessageFields(emailMessage)...)
+
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		messageIssues = append(messageIssues, validationIssue{Code: issueInvalidTemplate, Field: "content", Detail: err.Error()})
+	}
+
+	var valid []Personalization
+	var rejected []rejectedRecipient
+	for _, p := range emailMessage.Personalizations {
+		issues := append([]validationIssue{}, messageIssues...)
+		if renderer != nil {
+			issues = append(issues, validatePersonalization(emailMessage, renderer, p)...)
+		}
+		if len(issues) > 0 {
+			rejected = append(rejected, rejectedRecipient{Personalization: p, Issues: issues})
+			continue
+		}
+		valid = append(valid, p)
+	}
+
+	emailMessage.Personalizations = valid
+	return emailMessage, rejected
+}
+
+// validateMessageFields checks what every personalization shares: content
+// and the total attachment size.
+func validateMessageFields(emailMessage EmailMessage) []validationIssue {
+	var issues []validationIssue
+	hasContent := emailMessage.HtmlBody != "" || emailMessage.TextBody != ""
+	for _, content := range emailMessage.Content {
+		if strings.TrimSpace(content.Value) != "" {
+			hasContent = true
+		}
+	}
+	if !hasContent {
+		issues = append(issues, validationIssue{Code: issueMissingContent, Field: "content", Detail: "the message has no content"})
+	}
+
+	largest := 0
+	for _, limit := range attachmentLimits {
+		if limit > largest {
+			largest = limit
+		}
+	}
+	if size := emailMessage.attachmentSize(); size > largest {
+		issues = append(issues, validationIssue{Code: issueAttachmentTooLarge, Field: "attachments", Detail: fmt.Sprintf("attachments are %d bytes, no provider accepts more than %d", size, largest)})
+	}
+	return issues
+}
+
+// validatePersonalization checks the addresses, headers and subject of one
+// personalization, and that every template variable it renders has a value.
+func validatePersonalization(emailMessage EmailMessage, renderer *messageRenderer, p Personalization) []validationIssue {
+	var issues []validationIssue
+	env := emailMessage.envelopeFor(p)
+
+	if len(p.To) == 0 {
+		issues = append(issues, validationIssue{Code: issueMissingRecipient, Field: "to", Detail: "the personalization has no recipients"})
+	}
+	if env.From.Email == "" {
+		issues = append(issues, validationIssue{Code: issueMissingFrom, Field: "from", Detail: "no sender address"})
+	} else {
+		issues = append(issues, validateAddresses("from", []EmailAddress{env.From})...)
+	}
+	if env.ReplyTo.Email != "" {
+		issues = append(issues, validateAddresses("reply_to", []EmailAddress{env.ReplyTo})...)
+	}
+	issues = append(issues, validateAddresses("to", p.To)...)
+	issues = append(issues, validateAddresses("cc", env.Cc)...)
+	issues = append(issues, validateAddresses("bcc", env.Bcc)...)
+
+	subject := p.Subject
+	if subject == "" {
+		subject = emailMessage.Subject
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		issues = append(issues, validationIssue{Code: issueHeaderInjection, Field: "subject", Detail: "the subject contains a line break"})
+	}
+	issues = append(issues, validateHeaders(env.allHeaders())...)
+
+	missing, err := renderer.missingValues(p)
+	if err != nil {
+		issues = append(issues, validationIssue{Code: issueInvalidTemplate, Field: "content", Detail: err.Error()})
+	}
+	for _, name := range missing {
+		issues = append(issues, validationIssue{Code: issueUnresolvedPlaceholder, Field: "content", Detail: fmt.Sprintf("no value for %q", name)})
+	}
+	return issues
+}
+
+func validateAddresses(field string, addresses []EmailAddress) []validationIssue {
+	var issues []validationIssue
+	for _, address := range addresses {
+		if err := checkEmailAddress(address.Email); err != nil {
+			issues = append(issues, validationIssue{Code: issueInvalidAddress, Field: field, Detail: fmt.Sprintf("%q: %v", address.Email, err)})
+		} else if strings.ContainsAny(address.Name, "\r\n") {
+			issues = append(issues, validationIssue{Code: issueHeaderInjection, Field: field, Detail: fmt.Sprintf("the name of %s contains a line break", address.Email)})
+		}
+	}
+	return issues
+}
+
+// checkEmailAddress checks an address against the RFC 5322 addr-spec, with
+// UTF-8 allowed as in RFC 6532 and an internationalized domain that must
+// convert to valid punycode.
+func checkEmailAddress(email string) error {
+	if email == "" {
+		return fmt.Errorf("empty address")
+	}
+	if len(email) > 254 {
+		return fmt.Errorf("longer than 254 bytes")
+	}
+	// Quoted local parts come back unquoted, so compare the formatted forms
+	parsed, err := mail.ParseAddress("<" + email + ">")
+	if err != nil || parsed.String() != "<"+email+">" {
+		return fmt.Errorf("not a valid address")
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	if len(local) > 64 {
+		return fmt.Errorf("local part longer than 64 bytes")
+	}
+	if strings.HasPrefix(domain, "[") {
+		return nil
+	}
+	if !strings.Contains(domain, ".") {
+		return fmt.Errorf("domain %q is not fully qualified", domain)
+	}
+	if _, err := idna.Lookup.ToASCII(domain); err != nil {
+		return fmt.Errorf("invalid domain %q: %v", domain, err)
+	}
+	return nil
+}
+
+// validateHeaders rejects header names that are not RFC 5322 field names and
+// values with line breaks, which could add headers of their own.
+func validateHeaders(headers map[string]string) []validationIssue {
+	var issues []validationIssue
+	for name, value := range headers {
+		if !isHeaderName(name) {
+			issues = append(issues, validationIssue{Code: issueInvalidHeader, Field: "headers", Detail: fmt.Sprintf("invalid header name %q", name)})
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			issues = append(issues, validationIssue{Code: issueHeaderInjection, Field: "headers", Detail: fmt.Sprintf("header %s contains a line break", name)})
+		}
+	}
+	return issues
+}
+
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// storeRejectedRecipients records rejected recipients with their reasons, so
+// they can be reviewed and resent once fixed.
+func storeRejectedRecipients(db *sql.DB, kafkaMessage KafkaMessage, rejected []rejectedRecipient) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range rejected {
+		reasons, err := json.Marshal(r.Issues)
+		if err != nil {
+			return fmt.Errorf("failed to marshal rejection reasons: %v", err)
+		}
+		personalization, err := json.Marshal(r.Personalization)
+		if err != nil {
+			return fmt.Errorf("failed to marshal rejected personalization: %v", err)
+		}
+
+		_, err = tx.Exec(`
+            INSERT INTO rejected_recipients (user_id, batch_id, message_id, recipient_index, recipient, reasons, personalization)
+            VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7)
+        `, kafkaMessage.UserID, kafkaMessage.BatchID, kafkaMessage.MessageID, r.Personalization.Index, r.Personalization.primaryRecipient().Email, reasons, personalization)
+		if err != nil {
+			return fmt.Errorf("failed to store rejected recipient: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit rejected recipients: %v", err)
+	}
+	return nil
+}
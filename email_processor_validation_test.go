@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckEmailAddress(t *testing.T) {
+	for _, email := range []string{"ann@example.com", `"ann smith"@example.com`, "josé@exämple.com", "用户@例子.广告", "ops@[192.0.2.1]"} {
+		if err := checkEmailAddress(email); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", email, err)
+		}
+	}
+	for _, email := range []string{"", "ann", "ann@localhost", "ann..smith@example.com", "Ann <ann@example.com>", "ann@exa_mple.com", "ann@-example.com", strings.Repeat("a", 65) + "@example.com"} {
+		if err := checkEmailAddress(email); err == nil {
+			t.Errorf("Expected %q to be invalid", email)
+		}
+	}
+}
+
+func TestValidateEmailMessage(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "sender@example.com"},
+		Subject: "Hi {{name}}",
+		Content: []Content{{Type: "text/html", Value: "<p>{{#if vip}}{{tier}}{{/if}} {{city | default \"there\"}}</p>"}},
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "ann@example.com"}}, Substitutions: map[string]string{"name": "Ann"}},
+			{To: EmailAddressList{{Email: "not an address"}}, Substitutions: map[string]string{"name": "Bob"}},
+			{To: EmailAddressList{{Email: "cy@example.com"}}},
+			{To: EmailAddressList{{Email: "di@example.com"}}, Substitutions: map[string]string{"name": "Di"}, Headers: map[string]string{"X-Note": "a\r\nBcc: evil@example.com"}},
+		},
+	}
+
+	valid, rejected := validateEmailMessage(emailMessage)
+	if len(valid.Personalizations) != 1 || valid.Personalizations[0].primaryRecipient().Email != "ann@example.com" {
+		t.Fatalf("Expected only Ann to pass, got %+v", valid.Personalizations)
+	}
+	expected := map[int]string{2: issueInvalidAddress, 3: issueUnresolvedPlaceholder, 4: issueHeaderInjection}
+	if len(rejected) != len(expected) {
+		t.Fatalf("Expected %d rejections, got %+v", len(expected), rejected)
+	}
+	for _, r := range rejected {
+		if len(r.Issues) != 1 || r.Issues[0].Code != expected[r.Personalization.Index] {
+			t.Errorf("Unexpected issues for recipient %d: %v", r.Personalization.Index, r.Issues)
+		}
+	}
+
+	_, rejected = validateEmailMessage(EmailMessage{To: []EmailAddress{{Email: "ann@example.com"}}, Subject: "Hi"})
+	if len(rejected) != 1 || len(rejected[0].Issues) != 2 || rejected[0].Issues[0].Code != issueMissingContent || rejected[0].Issues[1].Code != issueMissingFrom {
+		t.Errorf("Expected missing content and sender, got %+v", rejected)
+	}
+}
+
+func TestStoreRejectedRecipients(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	rejected := []rejectedRecipient{{
+		Personalization: Personalization{To: EmailAddressList{{Email: "cy@example.com"}}, Index: 3},
+		Issues:          []validationIssue{{Code: issueUnresolvedPlaceholder, Field: "content", Detail: `no value for "name"`}},
+	}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO rejected_recipients").
+		WithArgs(5, 9, "msg-1", 3, "cy@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := storeRejectedRecipients(db, KafkaMessage{UserID: 5, BatchID: 9, MessageID: "msg-1"}, rejected); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
@@ -2,148 +2,321 @@ package main
 
 import (
 	"database/sql"
+	"math/rand"
+	"sort"
+	"strings"
 	"time"
 )
 
+// ProviderStats holds event counts for one provider. Counts are fractional
+// when events are time-decayed, in which case they are effective counts.
 type ProviderStats struct {
 	Name             string
-	TotalEvents      int
-	DeliveredEvents  int
-	BounceEvents     int
-	OpenEvents       int
-	DeferredEvents   int
-	SpamReportEvents int
+	TotalEvents      float64
+	DeliveredEvents  float64
+	BounceEvents     float64
+	OpenEvents       float64
+	DeferredEvents   float64
+	SpamReportEvents float64
 }
 
-func getProviderStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]ProviderStats, error) {
+// getProviderStatsByMailboxProvider reads per-provider statistics for a user
+// from the hourly rollups maintained by the event pipeline (see
+// provider_stats_rollup.go), split by the mailbox provider group of the
+// recipient. Hours are included when they start within [startTime, endTime).
+// Events recorded before the group was captured are reported as mailboxOther.
+//
+// With a positive halfLife every hourly rollup is weighted by
+// 0.5^(age/halfLife), measured from endTime, so yesterday's bounces count more
+// than last month's. A zero halfLife counts every hour in the range equally.
+func getProviderStatsByMailboxProvider(db *sql.DB, userID int, startTime, endTime time.Time, halfLife time.Duration) (map[string][]ProviderStats, error) {
 	query := `
     SELECT 
-        esp.provider_name,
-        COUNT(*) as total_events,
-        SUM(CASE WHEN e.delivered THEN 1 ELSE 0 END) as delivered_events,
-        SUM(CASE WHEN e.bounce THEN 1 ELSE 0 END) as bounce_events,
-        SUM(CASE WHEN e.open THEN 1 ELSE 0 END) as open_events,
-        SUM(CASE WHEN e.deferred THEN 1 ELSE 0 END) as deferred_events,
-        SUM(CASE WHEN e.dropped AND e.dropped_reason LIKE '%spam%' THEN 1 ELSE 0 END) as spam_report_events
-    FROM 
-        events e
-    JOIN 
-        message_user_associations mua ON e.message_id = mua.message_id
-    JOIN 
-        email_service_providers esp ON mua.esp_id = esp.esp_id
-    WHERE 
-        esp.user_id = $1
-        AND e.processed_time >= $2
-        AND e.processed_time < $3
+        mailbox_provider,
+        provider,
+        SUM(total_events * w) as total_events,
+        SUM(delivered * w) as delivered_events,
+        SUM(bounced * w) as bounce_events,
+        SUM(opened * w) as open_events,
+        SUM(deferred * w) as deferred_events,
+        SUM(complaints * w) as spam_report_events
+    FROM (
+        SELECT 
+            r.*,
+            CASE WHEN $4::float8 > 0
+                THEN EXP(-LN(2) * GREATEST($3 - EXTRACT(EPOCH FROM r.bucket_start), 0) / $4::float8)
+                ELSE 1
+            END as w
+        FROM 
+            provider_stats_hourly r
+        WHERE 
+            r.user_id = $1
+            AND r.bucket_start >= date_trunc('hour', to_timestamp($2))
+            AND r.bucket_start < to_timestamp($3)
+    ) weighted
     GROUP BY 
-        esp.provider_name
+        mailbox_provider, provider
     `
 
-	rows, err := db.Query(query, userID, startTime.Unix(), endTime.Unix())
+	rows, err := db.Query(query, userID, startTime.Unix(), endTime.Unix(), halfLife.Seconds())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var stats []ProviderStats
+	stats := make(map[string][]ProviderStats)
 	for rows.Next() {
+		var group string
 		var s ProviderStats
-		if err := rows.Scan(&s.Name, &s.TotalEvents, &s.DeliveredEvents, &s.BounceEvents, &s.OpenEvents, &s.DeferredEvents, &s.SpamReportEvents); err != nil {
+		if err := rows.Scan(&group, &s.Name, &s.TotalEvents, &s.DeliveredEvents, &s.BounceEvents, &s.OpenEvents, &s.DeferredEvents, &s.SpamReportEvents); err != nil {
 			return nil, err
 		}
-		stats = append(stats, s)
+		stats[group] = append(stats[group], s)
 	}
 
-	return stats, nil
+	return stats, rows.Err()
 }
 
-// calculateWeights determines the distribution of emails across different ESP providers
-// based on their performance over the last 30 days. It considers multiple factors including
-// open rates, successful deliveries, bounces, and spam reports. The function:
+// scoreProviderStats determines the distribution of emails across different ESP
+// providers based on their performance. It considers open rates, successful
+// deliveries, bounces, deferrals and spam reports. The function:
 //
-// 1. Fetches comprehensive event statistics for each provider from the database.
-// 2. Calculates a score for each provider based on a weighted formula:
-//   - Open rate (50% weight): Higher open rates increase the score significantly.
-//   - Success rate (20% weight): Higher delivery rates increase the score.
-//   - Bounce rate (30% weight): Higher bounce rates decrease the score.
-//   - Spam report rate (20% weight): Higher spam reports decrease the score.
+// 1. Calculates a score for each provider by multiplying each rate by the profile's
+// coefficient. The default profile uses:
+//   - Open rate (+0.5): Higher open rates increase the score significantly.
+//   - Success rate (+0.2): Higher delivery rates increase the score.
+//   - Bounce rate (-0.3): Higher bounce rates decrease the score.
+//   - Spam report rate (-0.2): Higher spam reports decrease the score.
 //
+// Negative scores count as zero.
+// 2. Providers with fewer events than the profile's minimum sample size, including
+// providers with valid credentials and no statistics at all, are given the average
+// score of the providers that have enough data.
 // 3. Normalizes these scores into weights that sum to 1,000, providing fine-grained control.
-// 4. Adjusts weights to zero for providers with invalid or missing credentials.
-// 5. If no provider has a positive score, it distributes weight equally among valid providers.
+// 4. If no provider has a positive score, it distributes weight equally among valid providers.
 //
-// The resulting weights determine the proportion of emails to be sent through each provider,
-// favoring those with better overall performance while maintaining some traffic to all
-// valid providers. This approach allows for dynamic load balancing and optimization of
-// email deliverability across multiple ESPs, with a strong emphasis on open rates and
-// spam prevention.
-func calculateWeightsForTimeRange(db *sql.DB, userID int, credentials Credentials, startTime, endTime time.Time) (map[string]int, error) {
-	stats, err := getProviderStats(db, userID, startTime, endTime)
-	if err != nil {
-		return nil, err
-	}
-
-	weights := make(map[string]int)
+// Users can override every coefficient, the minimum sample size, the lookback window and
+// per-provider floors and ceilings with a scoring profile (see ScoringProfile).
+func scoreProviderStats(stats []ProviderStats, credentials Credentials, profile ScoringProfile) map[string]int {
+	scores := make(map[string]float64)
 	totalScore := 0.0
+	var sparse []string
 
+	seen := make(map[string]bool, len(stats))
 	for _, s := range stats {
-		if s.TotalEvents > 0 {
-			openRate := float64(s.OpenEvents) / float64(s.TotalEvents)
-			successRate := float64(s.DeliveredEvents) / float64(s.TotalEvents)
-			bounceRate := float64(s.BounceEvents) / float64(s.TotalEvents)
-			spamRate := float64(s.SpamReportEvents) / float64(s.TotalEvents)
-
-			// Calculate score with appropriate weightings
-			score := (openRate * 0.5) + (successRate * 0.2) - (bounceRate * 0.3) - (spamRate * 0.2)
-			if score < 0 {
-				score = 0 // Ensure the score doesn't go negative
-			}
+		if s.TotalEvents == 0 {
+			continue
+		}
+		seen[s.Name] = true
+		if s.TotalEvents < float64(profile.MinSampleSize) {
+			sparse = append(sparse, s.Name)
+			continue
+		}
 
-			totalScore += score
-			weights[s.Name] = int(score * 1000) // Scale for granularity
+		score := profile.score(s)
+		totalScore += score
+		scores[s.Name] = score
+	}
+	for _, provider := range providerNames {
+		if !seen[provider] && isValidProvider(provider, credentials) {
+			sparse = append(sparse, provider)
 		}
 	}
 
-	if totalScore > 0 {
-		for provider := range weights {
-			normalizedWeight := int(float64(weights[provider]) / totalScore * 1000)
-			weights[provider] = normalizedWeight
+	// Providers without enough data are neither rewarded nor punished
+	if len(sparse) > 0 {
+		average := 0.0
+		if len(scores) > 0 {
+			average = totalScore / float64(len(scores))
 		}
-	} else {
+		for _, provider := range sparse {
+			scores[provider] = average
+			totalScore += average
+		}
+	}
+
+	if totalScore == 0 {
 		// Assign equal weight to valid providers if totalScore is 0
-		validProviders := 0
-		for provider := range weights {
+		for provider := range scores {
 			if isValidProvider(provider, credentials) {
-				validProviders++
+				scores[provider] = 1
+			} else {
+				scores[provider] = 0
 			}
 		}
+	}
 
-		if validProviders > 0 {
-			equalWeight := 1000 / validProviders
-			for provider := range weights {
-				if isValidProvider(provider, credentials) {
-					weights[provider] = equalWeight
-				} else {
-					weights[provider] = 0
-				}
-			}
+	return normalizeWeights(scores)
+}
+
+// normalizeWeights scales scores to integer weights that sum to exactly 1,000.
+// Rounding uses the largest remainder method so no weight is lost to
+// truncation. Providers are ordered by name to keep ties deterministic.
+func normalizeWeights(scores map[string]float64) map[string]int {
+	weights := make(map[string]int, len(scores))
+	totalScore := 0.0
+	providers := make([]string, 0, len(scores))
+	for provider, score := range scores {
+		weights[provider] = 0
+		if score > 0 {
+			totalScore += score
+			providers = append(providers, provider)
 		}
 	}
+	if totalScore == 0 {
+		return weights
+	}
+	sort.Strings(providers)
+
+	remainders := make(map[string]float64, len(providers))
+	assigned := 0
+	for _, provider := range providers {
+		exact := scores[provider] / totalScore * 1000
+		weights[provider] = int(exact)
+		remainders[provider] = exact - float64(weights[provider])
+		assigned += weights[provider]
+	}
+
+	sort.SliceStable(providers, func(i, j int) bool {
+		return remainders[providers[i]] > remainders[providers[j]]
+	})
+	for i := 0; assigned < 1000; i++ {
+		weights[providers[i%len(providers)]]++
+		assigned++
+	}
 
-	return weights, nil
+	return weights
 }
 
+// providerNames lists every provider the consumer can send through.
+var providerNames = []string{"sendgrid", "postmark", "socketlabs", "sparkpost"}
+
 func isValidProvider(provider string, credentials Credentials) bool {
-	switch provider {
-	case "SocketLabs":
+	switch strings.ToLower(provider) {
+	case "socketlabs":
 		return credentials.SocketLabsServerID != "" && credentials.SocketLabsAPIKey != ""
-	case "Postmark":
+	case "postmark":
 		return credentials.PostmarkServerToken != ""
-	case "SendGrid":
+	case "sendgrid":
 		return credentials.SendgridAPIKey != ""
-	case "SparkPost":
+	case "sparkpost":
 		return credentials.SparkpostAPIKey != ""
 	default:
 		return false
 	}
 }
+
+// RoutingWeights holds the global provider weights along with weights tuned
+// for individual mailbox provider groups (Gmail, Outlook, Yahoo, ...).
+type RoutingWeights struct {
+	Global            map[string]int
+	ByMailboxProvider map[string]map[string]int
+}
+
+// For returns the weights to use for a recipient address, falling back to the
+// global weights when its mailbox provider has no dedicated weights.
+func (r RoutingWeights) For(recipient string) map[string]int {
+	if weights, ok := r.ByMailboxProvider[mailboxProviderGroup(recipientDomain(recipient), "")]; ok {
+		return weights
+	}
+	return r.Global
+}
+
+// without returns the weights with the given providers removed. A mailbox
+// provider group left without providers falls back to the global weights.
+func (r RoutingWeights) without(providers map[string]bool) RoutingWeights {
+	filter := func(weights map[string]int) map[string]int {
+		filtered := make(map[string]int, len(weights))
+		for provider, weight := range weights {
+			if !providers[provider] {
+				filtered[provider] = weight
+			}
+		}
+		return filtered
+	}
+
+	result := RoutingWeights{Global: filter(r.Global)}
+	if r.ByMailboxProvider != nil {
+		result.ByMailboxProvider = make(map[string]map[string]int, len(r.ByMailboxProvider))
+		for group, weights := range r.ByMailboxProvider {
+			if filtered := filter(weights); len(filtered) > 0 {
+				result.ByMailboxProvider[group] = filtered
+			}
+		}
+	}
+	return result
+}
+
+// routingWeightsFromStats scores the global and per-group statistics. Within
+// a group, a provider with fewer events than the profile's minimum sample size
+// is scored on its global statistics instead, and a group where every provider
+// is sparse simply uses the global weights. The bandit strategy draws from
+// source; a nil source is seeded from the clock.
+func routingWeightsFromStats(groupStats map[string][]ProviderStats, credentials Credentials, settings RoutingSettings, source rand.Source) RoutingWeights {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	rng := rand.New(source)
+
+	globalStats := mergeProviderStats(groupStats)
+	routing := RoutingWeights{
+		Global:            settings.scoreProviders(globalStats, credentials, rng),
+		ByMailboxProvider: make(map[string]map[string]int),
+	}
+
+	for group, stats := range groupStats {
+		if group == mailboxOther {
+			continue
+		}
+
+		byName := make(map[string]ProviderStats, len(stats))
+		for _, s := range stats {
+			byName[s.Name] = s
+		}
+
+		blended := make([]ProviderStats, 0, len(globalStats))
+		dense := false
+		for _, global := range globalStats {
+			if s, ok := byName[global.Name]; ok && s.TotalEvents >= float64(settings.Profile.MinSampleSize) {
+				blended = append(blended, s)
+				dense = true
+			} else {
+				blended = append(blended, global)
+			}
+		}
+
+		if dense {
+			routing.ByMailboxProvider[group] = settings.scoreProviders(blended, credentials, rng)
+		}
+	}
+
+	return routing
+}
+
+// mergeProviderStats sums per-group statistics into one entry per provider,
+// ordered by provider name.
+func mergeProviderStats(groupStats map[string][]ProviderStats) []ProviderStats {
+	totals := make(map[string]*ProviderStats)
+	for _, stats := range groupStats {
+		for _, s := range stats {
+			total, ok := totals[s.Name]
+			if !ok {
+				total = &ProviderStats{Name: s.Name}
+				totals[s.Name] = total
+			}
+			total.TotalEvents += s.TotalEvents
+			total.DeliveredEvents += s.DeliveredEvents
+			total.BounceEvents += s.BounceEvents
+			total.OpenEvents += s.OpenEvents
+			total.DeferredEvents += s.DeferredEvents
+			total.SpamReportEvents += s.SpamReportEvents
+		}
+	}
+
+	merged := make([]ProviderStats, 0, len(totals))
+	for _, total := range totals {
+		merged = append(merged, *total)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name < merged[j].Name })
+	return merged
+}
@@ -1,91 +1,140 @@
 package main
 
 import (
-	"math"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
-func TestCalculateWeightsForTimeRange(t *testing.T) {
+func TestCalculateRoutingWeightsByMailboxProvider(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
 	}
 	defer db.Close()
 
-	testCases := []struct {
-		name     string
-		mockData []ProviderStats
-	}{
-		{
-			name: "Balanced data",
-			mockData: []ProviderStats{
-				{"Provider A", 1000, 800, 50, 600, 10, 20},
-				{"Provider B", 1200, 900, 60, 650, 15, 25},
-				{"Provider C", 1100, 850, 55, 620, 12, 22},
-				{"Provider D", 1300, 950, 40, 670, 8, 15},
-			},
-		},
-		{
-			name: "Data with anomaly",
-			mockData: []ProviderStats{
-				{"Provider A", 100, 80, 5, 60, 1, 2},
-				{"Provider B", 120, 90, 39, 65, 2, 3}, // High bounce rate
-				{"Provider C", 110, 85, 6, 62, 1, 2},
-				{"Provider D", 130, 95, 4, 67, 1, 2},
-			},
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			rows := sqlmock.NewRows([]string{"provider_name", "total_events", "delivered_events", "bounce_events", "open_events", "deferred_events", "spam_report_events"})
-			for _, stat := range tc.mockData {
-				rows.AddRow(stat.Name, stat.TotalEvents, stat.DeliveredEvents, stat.BounceEvents, stat.OpenEvents, stat.DeferredEvents, stat.SpamReportEvents)
-			}
-
-			mock.ExpectQuery("SELECT esp.provider_name, COUNT.*").WillReturnRows(rows)
-
-			userID := 1
-			credentials := Credentials{}
-			startTime := time.Now().AddDate(0, -1, 0)
-			endTime := time.Now()
-
-			weights, err := calculateWeightsForTimeRange(db, userID, credentials, startTime, endTime)
-			if err != nil {
-				t.Fatalf("Error calculating weights: %v", err)
-			}
-
-			// Check if weights sum to approximately 1000
-			totalWeight := 0
-			for _, weight := range weights {
-				totalWeight += weight
-			}
-			if math.Abs(float64(totalWeight-1000)) > 1 {
-				t.Errorf("Total weight should be close to 1000, got %d", totalWeight)
-			}
-
-			// Check if weights are reasonable (non-zero for valid providers)
-			for provider, weight := range weights {
-				if isValidProvider(provider, credentials) && weight == 0 {
-					t.Errorf("Weight for valid provider %s should not be zero", provider)
-				}
-			}
-
-			// For the anomaly case, check if the problematic provider has a lower weight
-			if tc.name == "Data with anomaly" {
-				if weights["Provider B"] >= weights["Provider A"] || weights["Provider B"] >= weights["Provider C"] || weights["Provider B"] >= weights["Provider D"] {
-					t.Errorf("Provider B should have a lower weight due to high bounce rate. Weights: %v", weights)
-				}
-			}
-
-			t.Logf("Calculated weights: %v", weights)
-
-			if err := mock.ExpectationsWereMet(); err != nil {
-				t.Errorf("There were unfulfilled expectations: %s", err)
-			}
-		})
+	rows := sqlmock.NewRows([]string{"mailbox_provider", "provider_name", "total_events", "delivered_events", "bounce_events", "open_events", "deferred_events", "spam_report_events"}).
+		// Gmail has enough data for both providers and sendgrid performs badly there
+		AddRow("gmail", "sendgrid", 1000, 700, 250, 100, 10, 5).
+		AddRow("gmail", "postmark", 1000, 950, 10, 600, 5, 0).
+		// Yahoo is too sparse to trust
+		AddRow("yahoo", "sendgrid", 20, 19, 0, 15, 0, 0).
+		AddRow("yahoo", "postmark", 20, 10, 9, 1, 0, 0).
+		AddRow("other", "sendgrid", 5000, 4700, 100, 2500, 20, 5).
+		AddRow("other", "postmark", 5000, 4600, 150, 2000, 20, 10)
+
+	mock.ExpectQuery("SELECT mailbox_provider, provider.*FROM provider_stats_hourly").WillReturnRows(rows)
+
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+	routing, err := calculateRoutingWeights(db, 1, credentials, DefaultRoutingSettings, []time.Time{time.Now().AddDate(0, 0, -30)}, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("Error calculating routing weights: %v", err)
+	}
+
+	for group, weights := range map[string]map[string]int{"global": routing.Global, "gmail": routing.ByMailboxProvider[mailboxGmail]} {
+		total := 0
+		for _, weight := range weights {
+			total += weight
+		}
+		if total != 1000 {
+			t.Errorf("Weights for %s should sum to 1000, got %d (%v)", group, total, weights)
+		}
+	}
+
+	gmail := routing.For("someone@gmail.com")
+	if gmail["postmark"] <= gmail["sendgrid"] {
+		t.Errorf("Postmark should be preferred for Gmail recipients, got %v", gmail)
+	}
+	if routing.Global["sendgrid"] <= routing.Global["postmark"]*8/10 {
+		t.Errorf("Global weights should stay close between providers, got %v", routing.Global)
+	}
+
+	if _, ok := routing.ByMailboxProvider[mailboxYahoo]; ok {
+		t.Errorf("Sparse Yahoo data should fall back to global weights")
+	}
+	if got := routing.For("someone@yahoo.com"); got["sendgrid"] != routing.Global["sendgrid"] {
+		t.Errorf("Yahoo recipients should use global weights, got %v", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCalculateRoutingWeightsWidensSparseWindows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"mailbox_provider", "provider_name", "total_events", "delivered_events", "bounce_events", "open_events", "deferred_events", "spam_report_events"}
+	now := time.Now().UTC()
+	lastBatch := now.Add(-10 * time.Minute)
+
+	windows := statsWindows(DefaultScoringProfile, lastBatch, now)
+	if len(windows) != 4 || !windows[0].Equal(lastBatch) {
+		t.Fatalf("Expected the last batch window followed by wider windows, got %v", windows)
+	}
+	for i := 1; i < len(windows); i++ {
+		if !windows[i].Before(windows[i-1]) {
+			t.Fatalf("Windows should widen, got %v", windows)
+		}
+	}
+
+	halfLife := DefaultScoringProfile.halfLife().Seconds()
+
+	// The quiet interval since the last batch has almost no data
+	mock.ExpectQuery("SELECT mailbox_provider").
+		WithArgs(1, windows[0].Unix(), now.Unix(), halfLife).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("other", "sendgrid", 3, 3, 0, 1, 0, 0))
+	mock.ExpectQuery("SELECT mailbox_provider").
+		WithArgs(1, windows[1].Unix(), now.Unix(), halfLife).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("other", "sendgrid", 400.5, 390.2, 5.1, 200.7, 1, 0).
+			AddRow("other", "postmark", 300.25, 200.5, 90.75, 20.5, 1, 0))
+
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+	routing, err := calculateRoutingWeights(db, 1, credentials, DefaultRoutingSettings, windows, now, nil)
+	if err != nil {
+		t.Fatalf("Error calculating routing weights: %v", err)
+	}
+
+	if routing.Global["postmark"] == 0 || routing.Global["sendgrid"] <= routing.Global["postmark"] {
+		t.Errorf("Weights should come from the one week window, got %v", routing.Global)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCalculateRoutingWeightsWithoutStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"mailbox_provider", "provider_name", "total_events", "delivered_events", "bounce_events", "open_events", "deferred_events", "spam_report_events"}
+	now := time.Now().UTC()
+	windows := []time.Time{now.AddDate(0, 0, -30)}
+	mock.ExpectQuery("SELECT mailbox_provider").
+		WithArgs(1, windows[0].Unix(), now.Unix(), DefaultScoringProfile.halfLife().Seconds()).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	credentials := Credentials{SendgridAPIKey: "sg", PostmarkServerToken: "pm"}
+	routing, err := calculateRoutingWeights(db, 1, credentials, DefaultRoutingSettings, windows, now, nil)
+	if err != nil {
+		t.Fatalf("Error calculating routing weights: %v", err)
+	}
+
+	if routing.Global["sendgrid"] != 500 || routing.Global["postmark"] != 500 || len(routing.Global) != 2 {
+		t.Errorf("Expected equal weights for the configured providers, got %v", routing.Global)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
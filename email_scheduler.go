@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"relay-go-consumer/database"
+	"sort"
+	"time"
+
+	// Timezones are resolved from the embedded database so scheduling does
+	// not depend on tzdata being installed in the container
+	_ "time/tzdata"
+)
+
+// Statuses stored in scheduled_messages.status. Rows left in
+// scheduledStatusDispatching were claimed by a consumer that stopped before
+// sending finished; they are not retried automatically so a recipient is
+// never sent the same message twice.
+const (
+	scheduledStatusPending     = "pending"
+	scheduledStatusDispatching = "dispatching"
+	scheduledStatusSent        = "sent"
+	scheduledStatusCancelled   = "cancelled"
+)
+
+// scheduledBatchSize is the number of due messages claimed per poll.
+const scheduledBatchSize = 100
+
+// sendAtLocalLayout is accepted for send_at values without a UTC offset.
+const sendAtLocalLayout = "2006-01-02T15:04:05"
+
+// sendTime resolves when a recipient should receive a message. send_at is
+// either RFC 3339 ("2024-05-01T09:00:00-04:00") or a clock time without an
+// offset ("2024-05-01T09:00:00"), which is read as UTC. When the recipient
+// has a timezone, the date and clock time of send_at are read in that
+// timezone instead, so "09:00" means 9am wherever each recipient is.
+func sendTime(sendAt, timezone string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, sendAt)
+	if err != nil {
+		t, err = time.Parse(sendAtLocalLayout, sendAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid send_at %q: %v", sendAt, err)
+		}
+	}
+	if timezone == "" {
+		return t, nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, location), nil
+}
+
+// hasSendAt reports whether the message or any of its recipients asks for a
+// send time.
+func (kafkaMessage KafkaMessage) hasSendAt() bool {
+	if kafkaMessage.SendAt != "" {
+		return true
+	}
+	for _, p := range kafkaMessage.Body.Personalizations {
+		if p.SendAt != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// splitBySendTime groups personalizations by their send time, which is their
+// own send_at or else the message's. Recipients due at or before now, or
+// without a send time, are returned separately.
+func splitBySendTime(sendAt string, personalizations []Personalization, now time.Time) ([]Personalization, map[time.Time][]Personalization, error) {
+	var due []Personalization
+	future := make(map[time.Time][]Personalization)
+
+	for _, p := range personalizations {
+		recipientSendAt := sendAt
+		if p.SendAt != "" {
+			recipientSendAt = p.SendAt
+		}
+		if recipientSendAt == "" {
+			due = append(due, p)
+			continue
+		}
+
+		at, err := sendTime(recipientSendAt, p.Timezone)
+		if err != nil && p.Timezone != "" {
+			log.Printf("Ignoring timezone for %s: %v", p.primaryRecipient().Email, err)
+			at, err = sendTime(recipientSendAt, "")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		p.SendAt = ""
+		if !at.After(now) {
+			due = append(due, p)
+			continue
+		}
+		at = at.UTC()
+		future[at] = append(future[at], p)
+	}
+
+	return due, future, nil
+}
+
+// scheduleFutureRecipients stores the recipients of kafkaMessage whose send
+// time is after now, one row per send time, and leaves only the recipients
+// that are already due in the message. When none of a batch message's
+// recipients are due, sending its earliest row advances the campaign instead.
+func scheduleFutureRecipients(db *sql.DB, kafkaMessage *KafkaMessage, now time.Time) error {
+	body := expandPersonalizations(kafkaMessage.Body)
+	body.To = nil
+	body.Credentials = Credentials{}
+
+	due, future, err := splitBySendTime(kafkaMessage.SendAt, body.Personalizations, now)
+	if err != nil {
+		return err
+	}
+
+	if len(future) > 0 {
+		times := make([]time.Time, 0, len(future))
+		for at := range future {
+			times = append(times, at)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		for k, at := range times {
+			scheduled := *kafkaMessage
+			scheduled.SendAt = ""
+			scheduled.Body = body
+			scheduled.Body.Personalizations = future[at]
+
+			payload, err := json.Marshal(scheduled)
+			if err != nil {
+				return fmt.Errorf("failed to marshal scheduled message: %v", err)
+			}
+			advancesBatch := kafkaMessage.BatchID != 0 && len(due) == 0 && k == 0
+
+			_, err = tx.Exec(`
+                INSERT INTO scheduled_messages (user_id, batch_id, message_id, send_at, payload, advances_batch)
+                VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+            `, kafkaMessage.UserID, kafkaMessage.BatchID, kafkaMessage.MessageID, at, payload, advancesBatch)
+			if err != nil {
+				return fmt.Errorf("failed to store scheduled message: %v", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit scheduled messages: %v", err)
+		}
+		log.Printf("Scheduled %d recipients of message %s", len(body.Personalizations)-len(due), kafkaMessage.MessageID)
+	}
+
+	kafkaMessage.Body = body
+	kafkaMessage.Body.Personalizations = due
+	kafkaMessage.SendAt = ""
+	return nil
+}
+
+// parkBatchMessage stores a batch message whose campaign is paused or not yet
+// due so the scheduler hands it back at retryAt, instead of holding up the
+// consumer until then. Sending a parked message advances the campaign.
+func parkBatchMessage(db *sql.DB, kafkaMessage KafkaMessage, retryAt time.Time) error {
+	kafkaMessage.Body.Credentials = Credentials{}
+	payload, err := json.Marshal(kafkaMessage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch message: %v", err)
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO scheduled_messages (user_id, batch_id, message_id, send_at, payload, advances_batch)
+        VALUES ($1, $2, $3, $4, $5, TRUE)
+    `, kafkaMessage.UserID, kafkaMessage.BatchID, kafkaMessage.MessageID, retryAt.UTC(), payload)
+	if err != nil {
+		return fmt.Errorf("failed to park batch message: %v", err)
+	}
+	return nil
+}
+
+// scheduledMessage is a claimed row of scheduled_messages. AdvancesBatch is
+// set for parked batch messages, which still count as their campaign's next
+// batch.
+type scheduledMessage struct {
+	ID            int64
+	Message       KafkaMessage
+	AdvancesBatch bool
+}
+
+// claimDueMessages marks up to limit due messages as dispatching and returns
+// them. SKIP LOCKED lets every consumer instance poll the table without two
+// of them claiming the same row. Messages of cancelled campaigns are
+// cancelled, and those of paused campaigns stay pending until resumed.
+func claimDueMessages(db *sql.DB, limit int) ([]scheduledMessage, error) {
+	_, err := db.Exec(`
+        UPDATE scheduled_messages s
+        SET status = $1
+        FROM email_batches b
+        WHERE s.batch_id = b.batch_id AND s.status = $2 AND b.status = 'cancelled'
+    `, scheduledStatusCancelled, scheduledStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel scheduled messages: %v", err)
+	}
+
+	rows, err := db.Query(`
+        UPDATE scheduled_messages
+        SET status = $1, dispatched_at = NOW()
+        WHERE id IN (
+            SELECT s.id
+            FROM scheduled_messages s
+            LEFT JOIN email_batches b ON s.batch_id = b.batch_id
+            WHERE s.status = $2
+              AND s.send_at <= NOW()
+              AND b.status IS DISTINCT FROM 'paused'
+            ORDER BY s.send_at, s.id
+            LIMIT $3
+            FOR UPDATE OF s SKIP LOCKED
+        )
+        RETURNING id, payload, advances_batch
+    `, scheduledStatusDispatching, scheduledStatusPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim scheduled messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []scheduledMessage
+	for rows.Next() {
+		var m scheduledMessage
+		var payload []byte
+		if err := rows.Scan(&m.ID, &payload, &m.AdvancesBatch); err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled message: %v", err)
+		}
+		if err := json.Unmarshal(payload, &m.Message); err != nil {
+			log.Printf("Failed to parse scheduled message %d: %v", m.ID, err)
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+func markScheduledMessage(db *sql.DB, id int64, status string) error {
+	_, err := db.Exec(`UPDATE scheduled_messages SET status = $2 WHERE id = $1`, id, status)
+	if err != nil {
+		return fmt.Errorf("failed to update scheduled message %d: %v", id, err)
+	}
+	return nil
+}
+
+// RunScheduler dispatches scheduled messages as they become due. It never
+// returns.
+func RunScheduler(interval time.Duration) {
+	database.InitDB()
+	db := database.GetDB()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		for {
+			messages, err := claimDueMessages(db, scheduledBatchSize)
+			if err != nil {
+				log.Printf("%v", err)
+				break
+			}
+			for _, m := range messages {
+				processEmailMessage(db, m.Message, m.AdvancesBatch)
+				if err := markScheduledMessage(db, m.ID, scheduledStatusSent); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+			if len(messages) < scheduledBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSendTime(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sendAt   string
+		timezone string
+		expected string
+	}{
+		{"RFC 3339", "2024-05-01T09:00:00-04:00", "", "2024-05-01T13:00:00Z"},
+		{"No offset is UTC", "2024-05-01T09:00:00", "", "2024-05-01T09:00:00Z"},
+		{"Recipient timezone", "2024-05-01T09:00:00", "America/New_York", "2024-05-01T13:00:00Z"},
+		{"Timezone overrides offset", "2024-05-01T09:00:00Z", "Asia/Tokyo", "2024-05-01T00:00:00Z"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			at, err := sendTime(tc.sendAt, tc.timezone)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := at.UTC().Format(time.RFC3339); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+
+	if _, err := sendTime("tomorrow", ""); err == nil {
+		t.Error("Expected an error for an invalid send_at")
+	}
+}
+
+func TestSplitBySendTimePerRecipient(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	personalizations := []Personalization{
+		{To: EmailAddressList{{Email: "now@example.com"}}},
+		{To: EmailAddressList{{Email: "later@example.com"}}, SendAt: "2024-05-02T09:00:00Z"},
+	}
+
+	due, future, err := splitBySendTime("", personalizations, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(due) != 1 || due[0].primaryRecipient().Email != "now@example.com" {
+		t.Errorf("Expected only the recipient without send_at to be due, got %+v", due)
+	}
+	later := future[time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)]
+	if len(later) != 1 || later[0].SendAt != "" {
+		t.Errorf("Expected the recipient to be scheduled with send_at cleared, got %+v", future)
+	}
+}
+
+func TestScheduleFutureRecipients(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	kafkaMessage := KafkaMessage{
+		MessageID: "msg-1",
+		UserID:    1,
+		SendAt:    "2024-05-01T09:00:00",
+		Body: EmailMessage{
+			Credentials: Credentials{SendgridAPIKey: "secret"},
+			Personalizations: []Personalization{
+				{To: EmailAddressList{{Email: "london@example.com"}}, Timezone: "Europe/London"},
+				{To: EmailAddressList{{Email: "newyork@example.com"}}, Timezone: "America/New_York"},
+				{To: EmailAddressList{{Email: "la@example.com"}}, Timezone: "America/Los_Angeles"},
+			},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO scheduled_messages").
+		WithArgs(1, 0, "msg-1", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO scheduled_messages").
+		WithArgs(1, 0, "msg-1", time.Date(2024, 5, 1, 16, 0, 0, 0, time.UTC), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	if err := scheduleFutureRecipients(db, &kafkaMessage, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(kafkaMessage.Body.Personalizations) != 1 || kafkaMessage.Body.Personalizations[0].primaryRecipient().Email != "london@example.com" {
+		t.Errorf("Only the London recipient should be sent now, got %+v", kafkaMessage.Body.Personalizations)
+	}
+	if kafkaMessage.SendAt != "" {
+		t.Errorf("Expected send_at to be cleared, got %q", kafkaMessage.SendAt)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestScheduleFutureRecipientsAllFutureBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	kafkaMessage := KafkaMessage{
+		BatchID:   7,
+		MessageID: "msg-1",
+		UserID:    1,
+		SendAt:    "2024-05-01T09:00:00",
+		Body: EmailMessage{
+			Personalizations: []Personalization{
+				{To: EmailAddressList{{Email: "newyork@example.com"}}, Timezone: "America/New_York"},
+				{To: EmailAddressList{{Email: "la@example.com"}}, Timezone: "America/Los_Angeles"},
+			},
+		},
+	}
+
+	// Only the earliest row advances the campaign
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO scheduled_messages .* advances_batch").
+		WithArgs(1, 7, "msg-1", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), sqlmock.AnyArg(), true).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO scheduled_messages .* advances_batch").
+		WithArgs(1, 7, "msg-1", time.Date(2024, 5, 1, 16, 0, 0, 0, time.UTC), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	if err := scheduleFutureRecipients(db, &kafkaMessage, now); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(kafkaMessage.Body.Personalizations) != 0 {
+		t.Errorf("No recipient should be sent now, got %+v", kafkaMessage.Body.Personalizations)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestParkBatchMessage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	retryAt := time.Date(2024, 5, 1, 12, 10, 0, 0, time.UTC)
+	kafkaMessage := KafkaMessage{
+		BatchID:   7,
+		MessageID: "msg-1",
+		UserID:    1,
+		Body: EmailMessage{
+			Credentials:      Credentials{SendgridAPIKey: "secret"},
+			Personalizations: []Personalization{{To: EmailAddressList{{Email: "ann@example.com"}}}},
+		},
+	}
+
+	mock.ExpectExec("INSERT INTO scheduled_messages .* advances_batch").
+		WithArgs(1, 7, "msg-1", retryAt, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := parkBatchMessage(db, kafkaMessage, retryAt); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -13,6 +13,7 @@ require (
 	github.com/sendgrid/sendgrid-go v3.16.0+incompatible
 	github.com/socketlabs/socketlabs-go v1.4.0
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/net v0.28.0
 )
 
 require (
@@ -41,5 +42,5 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
 )
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockAtoms are elements that start on a new paragraph in plain text.
+var blockAtoms = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Div: true, atom.Dl: true, atom.Fieldset: true, atom.Figure: true,
+	atom.Footer: true, atom.Form: true, atom.Header: true, atom.Hr: true,
+	atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true,
+	atom.Section: true, atom.Table: true, atom.Ul: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+// skippedAtoms are elements whose content is never shown.
+var skippedAtoms = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Template: true, atom.Title: true,
+}
+
+var extraBlankLines = regexp.MustCompile(`\n{3,}`)
+
+// htmlToText converts HTML content to a readable plain-text alternative.
+// Paragraphs are separated by blank lines, links are kept as "text (url)",
+// list items start with a marker and each table row becomes one line.
+func htmlToText(content string) string {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return ""
+	}
+
+	w := &textWriter{}
+	w.node(doc)
+
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.TrimSpace(extraBlankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// textWriter collapses whitespace the way a browser does and holds back
+// line breaks until there is more text to write, so that nested blocks do not
+// pile up blank lines.
+type textWriter struct {
+	b      strings.Builder
+	breaks int
+	space  bool
+	pre    int
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if w.pre > 0 {
+			w.raw(n.Data)
+		} else {
+			w.text(n.Data)
+		}
+		return
+	case html.ElementNode:
+	case html.DocumentNode:
+		w.children(n)
+		return
+	default:
+		return
+	}
+
+	if skippedAtoms[n.DataAtom] {
+		return
+	}
+	if blockAtoms[n.DataAtom] {
+		w.lineBreak(2)
+		defer w.lineBreak(2)
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		if w.breaks < 2 {
+			w.breaks++
+		}
+	case atom.Img:
+		if alt := attr(n, "alt"); strings.TrimSpace(alt) != "" {
+			w.space = true
+			w.text(alt)
+			w.space = true
+		}
+	case atom.A:
+		w.link(n)
+	case atom.Li:
+		w.lineBreak(1)
+		w.raw(listMarker(n))
+		w.children(n)
+		w.lineBreak(1)
+	case atom.Tr:
+		w.lineBreak(1)
+		w.children(n)
+		w.lineBreak(1)
+	case atom.Td, atom.Th:
+		w.space = true
+		w.children(n)
+		w.space = true
+	case atom.Pre:
+		w.pre++
+		w.children(n)
+		w.pre--
+	default:
+		w.children(n)
+	}
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+// link writes the link text followed by the URL, unless the text already
+// shows it or the link goes nowhere.
+func (w *textWriter) link(n *html.Node) {
+	start := w.b.Len()
+	w.children(n)
+	text := w.b.String()[start:]
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+	shown := strings.TrimPrefix(href, "mailto:")
+	if strings.Contains(text, shown) {
+		return
+	}
+	if strings.TrimSpace(text) == "" {
+		w.text(shown)
+		return
+	}
+	w.space = true
+	w.raw("(" + shown + ")")
+}
+
+// listMarker numbers the items of ordered lists and bullets the others.
+func listMarker(n *html.Node) string {
+	if n.Parent == nil || n.Parent.DataAtom != atom.Ol {
+		return "- "
+	}
+	number := 1
+	if start, err := strconv.Atoi(attr(n.Parent, "start")); err == nil {
+		number = start
+	}
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode && s.DataAtom == atom.Li {
+			number++
+		}
+	}
+	return strconv.Itoa(number) + ". "
+}
+
+func (w *textWriter) text(s string) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		if s != "" {
+			w.space = true
+		}
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		w.space = true
+	}
+	w.raw(strings.Join(fields, " "))
+	last := s[len(s)-1]
+	w.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+// raw writes s as is, after any pending line break or space.
+func (w *textWriter) raw(s string) {
+	if s == "" {
+		return
+	}
+	if w.b.Len() > 0 {
+		if w.breaks > 0 {
+			w.b.WriteString(strings.Repeat("\n", w.breaks))
+		} else if w.space {
+			w.b.WriteByte(' ')
+		}
+	}
+	w.breaks = 0
+	w.space = false
+	w.b.WriteString(s)
+}
+
+func (w *textWriter) lineBreak(n int) {
+	if n > w.breaks {
+		w.breaks = n
+	}
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
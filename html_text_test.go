@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{"paragraphs", "<p>Hello   <b>Ann</b>,</p><p>Thanks<br>for your order.</p>", "Hello Ann,\n\nThanks\nfor your order."},
+		{"links", `<p>See <a href="https://example.com/o/1">your order</a> or <a href="https://example.com">https://example.com</a>.</p>`, "See your order (https://example.com/o/1) or https://example.com."},
+		{"mailto and anchors", `<a href="mailto:help@example.com">help@example.com</a> <a href="#top">top</a>`, "help@example.com top"},
+		{"lists", "<ul><li>Boots</li><li>Socks</li></ul><ol start=\"3\"><li>One</li><li>Two</li></ol>", "- Boots\n- Socks\n\n3. One\n4. Two"},
+		{"tables", "<table><tr><th>Item</th><th>Price</th></tr><tr><td>Boots</td><td>&euro;80</td></tr></table>", "Item Price\nBoots €80"},
+		{"hidden content", "<html><head><title>T</title><style>p{}</style></head><body><script>x()</script><img alt=\"Logo\">Hi</body></html>", "Logo Hi"},
+		{"preformatted", "<pre>a  b\n  c</pre>", "a  b\n  c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.html); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRendererGeneratesTextFromHTML(t *testing.T) {
+	renderer, err := newMessageRenderer(EmailMessage{HtmlBody: "<p>Hi {{name}}</p>"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, content, err := renderer.Render(Personalization{Substitutions: map[string]string{"name": "Ann & Bob"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(content) != 2 || content[0].Type != "text/plain" || content[0].Value != "Hi Ann & Bob" {
+		t.Errorf("Expected a text part first, got %+v", content)
+	}
+
+	renderer, _ = newMessageRenderer(EmailMessage{Content: []Content{{Type: "text/html", Value: "<p>Hi</p>"}, {Type: "text/plain", Value: "Hello"}}})
+	if _, content, _ := renderer.Render(Personalization{}); len(content) != 2 || getContentByType(content, "text/plain") != "Hello" {
+		t.Errorf("Expected the supplied text part to be kept, got %+v", content)
+	}
+}
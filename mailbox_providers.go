@@ -0,0 +1,73 @@
+package main
+
+import "strings"
+
+// Mailbox provider groups used to route recipients by where their inbox is
+// hosted. Anything we cannot classify falls into mailboxOther.
+const (
+	mailboxGmail   = "gmail"
+	mailboxOutlook = "outlook"
+	mailboxYahoo   = "yahoo"
+	mailboxApple   = "apple"
+	mailboxOther   = "other"
+)
+
+var mailboxDomainGroups = map[string]string{
+	"gmail.com":      mailboxGmail,
+	"googlemail.com": mailboxGmail,
+	"outlook.com":    mailboxOutlook,
+	"hotmail.com":    mailboxOutlook,
+	"live.com":       mailboxOutlook,
+	"msn.com":        mailboxOutlook,
+	"yahoo.com":      mailboxYahoo,
+	"ymail.com":      mailboxYahoo,
+	"rocketmail.com": mailboxYahoo,
+	"aol.com":        mailboxYahoo,
+	"icloud.com":     mailboxApple,
+	"me.com":         mailboxApple,
+	"mac.com":        mailboxApple,
+}
+
+// mailboxProviderGroup classifies a recipient domain into a mailbox provider
+// group. When the ESP reports the mailbox provider itself (SparkPost does) that
+// value wins, since it also covers custom domains hosted by Google or
+// Microsoft.
+func mailboxProviderGroup(domain, reported string) string {
+	reported = strings.ToLower(reported)
+	switch {
+	case strings.Contains(reported, "gmail"), strings.Contains(reported, "google"):
+		return mailboxGmail
+	case strings.Contains(reported, "outlook"), strings.Contains(reported, "hotmail"), strings.Contains(reported, "microsoft"), strings.Contains(reported, "office 365"):
+		return mailboxOutlook
+	case strings.Contains(reported, "yahoo"), strings.Contains(reported, "aol"), strings.Contains(reported, "verizon"):
+		return mailboxYahoo
+	case strings.Contains(reported, "apple"), strings.Contains(reported, "icloud"):
+		return mailboxApple
+	}
+
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if group, ok := mailboxDomainGroups[domain]; ok {
+		return group
+	}
+
+	// Regional variants such as hotmail.co.uk or yahoo.fr
+	if label, _, found := strings.Cut(domain, "."); found {
+		switch label {
+		case "hotmail", "outlook", "live":
+			return mailboxOutlook
+		case "yahoo":
+			return mailboxYahoo
+		}
+	}
+
+	return mailboxOther
+}
+
+// recipientDomain returns the lower-cased domain part of an email address.
+func recipientDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
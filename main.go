@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"relay-go-consumer/database"
+	"strconv"
 	"sync"
 	"time"
 
@@ -31,6 +32,8 @@ func main() {
 		database.SeedDB(db)
 
 		fmt.Println("Database seeded successfully")
+	} else if flag.Arg(0) == "batch" {
+		runBatchCommand(flag.Args()[1:])
 	} else {
 
 		kafkaBrokers := []string{os.Getenv("KAFKA_BROKERS")}
@@ -39,6 +42,8 @@ func main() {
 		postmarkWebhookTopic := os.Getenv("WEBHOOK_TOPIC_POSTMARK")
 		socketlabsWebhookTopic := os.Getenv("WEBHOOK_TOPIC_SOCKETLABS")
 		sparkpostWebhookTopic := os.Getenv("WEBHOOK_TOPIC_SPARKPOST")
+		unsubscribeWebhookTopic := os.Getenv("WEBHOOK_TOPIC_UNSUBSCRIBE")
+		controlTopic := os.Getenv("KAFKA_CONTROL_TOPIC")
 		offsetReset := os.Getenv("KAFKA_OFFSET_RESET")
 
 		// Set the offset reset policy based on the environment variable
@@ -60,11 +65,7 @@ func main() {
 		var wg sync.WaitGroup
 
 		// Consume messages from each topic with a unique consumer group
-		topics := []struct {
-			topic     string
-			group     string
-			processor func(*sarama.ConsumerMessage)
-		}{
+		topics := []topicProcessor{
 			{emailTopic, "email-group", ProcessEmailMessages},
 			{sendgridWebhookTopic, "sendgrid-group", ProcessSendgridEvents},
 			{postmarkWebhookTopic, "postmark-group", ProcessPostmarkEvents},
@@ -72,6 +73,17 @@ func main() {
 			{sparkpostWebhookTopic, "sparkpost-group", ProcessSparkPostEvents},
 		}
 
+		if unsubscribeWebhookTopic != "" {
+			topics = append(topics, topicProcessor{unsubscribeWebhookTopic, "unsubscribe-group", ProcessUnsubscribeEvents})
+		}
+
+		// Every consumer instance keeps its own caches, so each one needs to see
+		// every control message and joins the control topic with its own group
+		if controlTopic != "" {
+			hostname, _ := os.Hostname()
+			topics = append(topics, topicProcessor{controlTopic, "control-group-" + hostname, ProcessControlMessages})
+		}
+
 		for _, t := range topics {
 			wg.Add(1)
 			go func(topic, group string, processor func(*sarama.ConsumerMessage)) {
@@ -80,11 +92,41 @@ func main() {
 			}(t.topic, t.group, t.processor)
 		}
 
+		// Scheduled messages are dispatched by every instance; claims are
+		// exclusive so each message is sent once
+		go RunScheduler(durationFromEnv("SCHEDULER_POLL_INTERVAL", 15*time.Second))
+
 		// Wait for all goroutines to finish (which they never will in this case)
 		wg.Wait()
 	}
 }
 
+// runBatchCommand handles "batch <pause|resume|cancel> <batch_id>".
+func runBatchCommand(args []string) {
+	if len(args) != 2 {
+		log.Fatal("Usage: batch <pause|resume|cancel> <batch_id>")
+	}
+	batchID, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatalf("Invalid batch ID %q: %v", args[1], err)
+	}
+
+	database.InitDB()
+	db := database.GetDB()
+	defer database.CloseDB()
+
+	if err := updateBatchStatus(db, batchID, args[0]); err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("Batch %d: %s applied\n", batchID, args[0])
+}
+
+type topicProcessor struct {
+	topic     string
+	group     string
+	processor func(*sarama.ConsumerMessage)
+}
+
 func consumeTopic(brokers []string, topic string, groupID string, config *sarama.Config, processFunc func(*sarama.ConsumerMessage)) {
 	for {
 		consumer, err := sarama.NewConsumerGroup(brokers, groupID, config)
@@ -4,26 +4,30 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"strings"
+	"strconv"
 )
 
 type PostMarkMessage struct {
-	From          string            `json:"From"`
-	To            string            `json:"To"`
-	Cc            string            `json:"Cc"`
-	Bcc           string            `json:"Bcc"`
-	Subject       string            `json:"Subject"`
-	Tag           string            `json:"Tag"`
-	HtmlBody      string            `json:"HtmlBody"`
-	TextBody      string            `json:"TextBody"`
-	ReplyTo       string            `json:"ReplyTo"`
-	Metadata      map[string]string `json:"Metadata"`
-	Headers       []CustomHeader    `json:"Headers"`
-	Attachments   []Attachment      `json:"Attachments"`
-	TrackOpens    bool              `json:"TrackOpens"`
-	TrackLinks    string            `json:"TrackLinks"`
-	MessageStream string            `json:"MessageStream"`
+	From          string                 `json:"From"`
+	To            string                 `json:"To"`
+	Cc            string                 `json:"Cc"`
+	Bcc           string                 `json:"Bcc"`
+	Subject       string                 `json:"Subject,omitempty"`
+	Tag           string                 `json:"Tag"`
+	HtmlBody      string                 `json:"HtmlBody,omitempty"`
+	TextBody      string                 `json:"TextBody,omitempty"`
+	TemplateId    int64                  `json:"TemplateId,omitempty"`
+	TemplateModel map[string]interface{} `json:"TemplateModel,omitempty"`
+	ReplyTo       string                 `json:"ReplyTo"`
+	Metadata      map[string]string      `json:"Metadata"`
+	Headers       []CustomHeader         `json:"Headers"`
+	Attachments   []PostmarkAttachment   `json:"Attachments"`
+	TrackOpens    bool                   `json:"TrackOpens"`
+	TrackLinks    string                 `json:"TrackLinks"`
+	MessageStream string                 `json:"MessageStream"`
 }
 
 type CustomHeader struct {
@@ -31,164 +35,298 @@ type CustomHeader struct {
 	Value string `json:"Value"`
 }
 
-func SendEmailWithPostmark(emailMessage EmailMessage) error {
+// postmarkBatchLimit is the most messages Postmark accepts in one batch call,
+// and postmarkBatchSizeLimit the largest request body, attachments included.
+// The size limit leaves room for the JSON around the messages.
+const (
+	postmarkBatchLimit     = 500
+	postmarkBatchSizeLimit = 50<<20 - 1024
+)
+
+// postmarkBatchResult is Postmark's response for one message of a batch, in
+// the order the messages were sent.
+type postmarkBatchResult struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+	MessageID string `json:"MessageID"`
+	To        string `json:"To"`
+}
+
+// SendEmailWithPostmark sends the personalizations through Postmark's batch
+// endpoints and reports the outcome of each personalization.
+func SendEmailWithPostmark(emailMessage EmailMessage) sendResults {
+	results := newSendResults(len(emailMessage.Personalizations))
+
 	// Extract credentials from the email message
 	serverToken := emailMessage.Credentials.PostmarkServerToken
-	apiURL := "https://api.postmarkapp.com/email"
 
 	// Strip credentials from the email message
 	emailMessage.Credentials = Credentials{}
 
-	postmarkMessages := mapEmailMessageToPostmark(emailMessage)
+	postmarkMessages, indexes := mapEmailMessageToPostmark(emailMessage, results)
 
-	for _, msg := range postmarkMessages {
-		jsonData, err := json.Marshal(msg)
-		if err != nil {
-			return fmt.Errorf("failed to marshal email message: %v", err)
+	// Messages using a Postmark template go to their own endpoint
+	var plain, templated []int
+	for j, msg := range postmarkMessages {
+		if msg.TemplateId != 0 {
+			templated = append(templated, j)
+		} else {
+			plain = append(plain, j)
+		}
+	}
+
+	for _, chunk := range chunkPostmarkMessages(plain, postmarkMessages, postmarkBatchLimit, postmarkBatchSizeLimit) {
+		batch := make([]PostMarkMessage, len(chunk))
+		for k, j := range chunk {
+			batch[k] = postmarkMessages[j]
+		}
+		batchResults, err := sendPostmarkBatch(serverToken, "https://api.postmarkapp.com/email/batch", batch)
+		recordPostmarkResults(results, indexes, chunk, batchResults, err)
+	}
+	for _, chunk := range chunkPostmarkMessages(templated, postmarkMessages, postmarkBatchLimit, postmarkBatchSizeLimit) {
+		batch := make([]PostMarkMessage, len(chunk))
+		for k, j := range chunk {
+			batch[k] = postmarkMessages[j]
 		}
+		batchResults, err := sendPostmarkBatch(serverToken, "https://api.postmarkapp.com/email/batchWithTemplates", map[string]interface{}{"Messages": batch})
+		recordPostmarkResults(results, indexes, chunk, batchResults, err)
+	}
+	return results
+}
 
-		// Create a new HTTP request
-		req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+// chunkPostmarkMessages splits the messages at positions into batches of at
+// most maxMessages whose encoded size stays within maxBytes. A message that is
+// too large on its own is sent in a batch of its own, for Postmark to reject.
+func chunkPostmarkMessages(positions []int, messages []PostMarkMessage, maxMessages, maxBytes int) [][]int {
+	var result [][]int
+	var chunk []int
+	size := 0
+	for _, j := range positions {
+		encoded, err := json.Marshal(messages[j])
+		messageSize := len(encoded) + 1
 		if err != nil {
-			return fmt.Errorf("failed to create HTTP request: %v", err)
+			messageSize = 0
+		}
+		if len(chunk) > 0 && (len(chunk) >= maxMessages || size+messageSize > maxBytes) {
+			result = append(result, chunk)
+			chunk, size = nil, 0
 		}
+		chunk = append(chunk, j)
+		size += messageSize
+	}
+	if len(chunk) > 0 {
+		result = append(result, chunk)
+	}
+	return result
+}
 
-		// Set default headers
-		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Postmark-Server-Token", serverToken)
+// sendPostmarkBatch posts one batch and returns the result of each message.
+func sendPostmarkBatch(serverToken, apiURL string, payload interface{}) ([]postmarkBatchResult, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal email batch: %v", err)
+	}
 
-		// Send the request
-		sendEmail(req)
+	// Create a new HTTP request
+	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
-	return nil
-}
 
-func sendEmail(req *http.Request) error {
-	// Dump the request to a byte slice
-	// dump, err := httputil.DumpRequestOut(req, true)
-	// if err != nil {
-	// 	return fmt.Errorf("failed to dump request: %v", err)
-	// }
+	// Set default headers
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", serverToken)
 
-	// // Print the dumped request
-	// log.Printf("Request:\n%s", string(dump))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %v", err)
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, handlePostmarkError(resp.StatusCode, body)
 	}
 
-	return HandlePostmarkResponse(resp, err)
+	var batchResults []postmarkBatchResult
+	if err := json.Unmarshal(body, &batchResults); err != nil {
+		return nil, fmt.Errorf("failed to decode postmark batch response: %v", err)
+	}
+	return batchResults, nil
 }
 
-func mapEmailMessageToPostmark(emailMessage EmailMessage) []PostMarkMessage {
-	headers := make([]CustomHeader, 0, len(emailMessage.Headers))
-	for key, value := range emailMessage.Headers {
-		headers = append(headers, CustomHeader{Name: key, Value: value})
+// recordPostmarkResults maps the results of a batch, which Postmark returns
+// in request order, back to personalizations. chunk holds positions in the
+// mapped messages and indexes the personalization of each message.
+func recordPostmarkResults(results sendResults, indexes, chunk []int, batchResults []postmarkBatchResult, err error) {
+	if err == nil && len(batchResults) != len(chunk) {
+		err = fmt.Errorf("postmark returned %d results for %d messages", len(batchResults), len(chunk))
+	}
+	for k, j := range chunk {
+		i := indexes[j]
+		switch {
+		case err != nil:
+			results[i] = err
+		case batchResults[k].ErrorCode != 0:
+			results[i] = fmt.Errorf("Postmark API error: Code=%d, Message=%s", batchResults[k].ErrorCode, batchResults[k].Message)
+			storePostmarkErrorForLater(http.StatusOK, PostmarkErrorResponse{ErrorCode: batchResults[k].ErrorCode, Message: batchResults[k].Message})
+		default:
+			results[i] = nil
+		}
+	}
+}
+
+// mapEmailMessageToPostmark builds a message for each personalization and
+// returns them with the index of the personalization each came from.
+// Personalizations that fail to render are recorded in results.
+func mapEmailMessageToPostmark(emailMessage EmailMessage, results sendResults) ([]PostMarkMessage, []int) {
+	// Postmark allows a single tag per message
+	tag := emailMessage.primaryTag()
+
+	// Without tracking settings, opens and HTML links are tracked
+	trackOpens, trackLinks := true, "HtmlOnly"
+	if opens := emailMessage.Tracking.Opens; opens != nil {
+		trackOpens = *opens
+	}
+	if clicks := emailMessage.Tracking.Clicks; clicks != nil {
+		trackLinks = "None"
+		if *clicks {
+			trackLinks = "HtmlAndText"
+		}
+	}
+	messageStream := "outbound"
+	if emailMessage.Tracking.MessageStream != "" {
+		messageStream = emailMessage.Tracking.MessageStream
 	}
 
-	parsedSections := parseSectionsDynamicPostMark(emailMessage.Sections)
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		log.Printf("Failed to parse email templates: %v", err)
+		results.setAll(allIndexes(results), fmt.Errorf("failed to parse email templates: %v", err))
+		return nil, nil
+	}
 	var postMarkMessages []PostMarkMessage
+	var indexes []int
 
-	for _, personalization := range emailMessage.Personalizations {
-		// Process content for each personalization
-		processedContent := processContent(emailMessage.Content, personalization.Substitutions, parsedSections)
+	for i, personalization := range emailMessage.Personalizations {
+		env := emailMessage.envelopeFor(personalization)
+		allHeaders := env.allHeaders()
+		headers := make([]CustomHeader, 0, len(allHeaders))
+		for key, value := range allHeaders {
+			headers = append(headers, CustomHeader{Name: key, Value: value})
+		}
 
 		postMarkMessage := PostMarkMessage{
-			From:          emailMessage.From.Email,
-			To:            personalization.To.Email,
-			Cc:            strings.Join(emailMessage.Cc, ", "),
-			Bcc:           strings.Join(emailMessage.Bcc, ", "),
-			Subject:       personalization.Subject,
-			Tag:           "",
-			HtmlBody:      getContentByType(processedContent, "text/html"),
-			TextBody:      getContentByType(processedContent, "text/plain"),
-			ReplyTo:       "",
+			From:          formatAddress(env.From),
+			To:            formatAddressList(personalization.To),
+			Cc:            formatAddressList(env.Cc),
+			Bcc:           formatAddressList(env.Bcc),
+			Tag:           tag,
+			ReplyTo:       formatAddress(env.ReplyTo),
+			Metadata:      emailMessage.withCorrelationID(env.customArgStrings(), personalization),
 			Headers:       headers,
 			Attachments:   convertAttachments(emailMessage.Attachments),
-			TrackOpens:    true,
-			TrackLinks:    "HtmlOnly",
-			MessageStream: "outbound",
+			TrackOpens:    trackOpens,
+			TrackLinks:    trackLinks,
+			MessageStream: messageStream,
+		}
+
+		templateID, native := emailMessage.nativeTemplateFor(personalization)
+		if native {
+			postMarkMessage.TemplateId, err = strconv.ParseInt(templateID, 10, 64)
+			native = err == nil
+		}
+		if native {
+			postMarkMessage.TemplateModel = personalizationData(personalization)
+		} else {
+			// Render content for each personalization
+			subject, processedContent, err := renderer.Render(personalization)
+			if err != nil {
+				results[i] = fmt.Errorf("failed to render email for %s: %v", personalization.primaryRecipient().Email, err)
+				log.Println(results[i])
+				continue
+			}
+			postMarkMessage.Subject = subject
+			postMarkMessage.HtmlBody = getContentByType(processedContent, "text/html")
+			postMarkMessage.TextBody = getContentByType(processedContent, "text/plain")
 		}
 
 		postMarkMessages = append(postMarkMessages, postMarkMessage)
+		indexes = append(indexes, i)
 	}
 
-	return postMarkMessages
+	return postMarkMessages, indexes
 }
 
-func processContent(content []Content, substitutions map[string]string, sections map[string]string) []Content {
-	processedContent := make([]Content, len(content))
-	for i, item := range content {
-		value := item.Value
-
-		// First pass: Replace section placeholders
-		for sectionKey, sectionContent := range sections {
-			handlebarPlaceholder := fmt.Sprintf("{{%s}}", sectionKey)
-			hyphenPlaceholder := fmt.Sprintf("-%s-", sectionKey)
-			value = strings.ReplaceAll(value, handlebarPlaceholder, sectionContent)
-			value = strings.ReplaceAll(value, hyphenPlaceholder, sectionContent)
-		}
-
-		// Second pass: Replace substitutions
-		for subKey, subValue := range substitutions {
-			handlebarPlaceholder := fmt.Sprintf("{{%s}}", subKey)
-			hyphenPlaceholder := fmt.Sprintf("-%s-", subKey)
+// createPostmarkTemplate creates a template on the Postmark server and returns
+// its ID.
+func createPostmarkTemplate(serverToken string, content nativeTemplateContent) (string, error) {
+	jsonData, err := json.Marshal(map[string]string{
+		"Name":         content.Name,
+		"Subject":      content.Subject,
+		"HtmlBody":     content.HtmlBody,
+		"TextBody":     content.TextBody,
+		"TemplateType": "Standard",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal template: %v", err)
+	}
 
-			replacementValue := subValue
-			if sectionContent, exists := sections[subValue]; exists {
-				replacementValue = sectionContent
-			}
+	req, err := http.NewRequest("POST", "https://api.postmarkapp.com/templates", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", serverToken)
 
-			value = strings.ReplaceAll(value, handlebarPlaceholder, replacementValue)
-			value = strings.ReplaceAll(value, hyphenPlaceholder, replacementValue)
-		}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
 
-		// Third pass: Replace any remaining placeholders in the content
-		for subKey, subValue := range substitutions {
-			handlebarPlaceholder := fmt.Sprintf("{{%s}}", subKey)
-			hyphenPlaceholder := fmt.Sprintf("-%s-", subKey)
-			value = strings.ReplaceAll(value, handlebarPlaceholder, subValue)
-			value = strings.ReplaceAll(value, hyphenPlaceholder, subValue)
-		}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", handlePostmarkError(resp.StatusCode, body)
+	}
 
-		processedContent[i] = Content{Type: item.Type, Value: value}
+	var created struct {
+		TemplateId int64 `json:"TemplateId"`
 	}
-	return processedContent
+	if err := json.Unmarshal(body, &created); err != nil {
+		return "", fmt.Errorf("failed to decode postmark response: %v", err)
+	}
+	return strconv.FormatInt(created.TemplateId, 10), nil
 }
 
-func getContentByType(content []Content, contentType string) string {
-	for _, item := range content {
-		if item.Type == contentType {
-			return item.Value
-		}
-	}
-	return ""
+// PostmarkAttachment is an attachment in the form the Postmark API expects,
+// with base64 content. Inline images have a ContentID of the form cid:logo.
+type PostmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
 }
 
-func convertAttachments(attachments []Attachment) []Attachment {
-	postmarkAttachments := make([]Attachment, len(attachments))
+func convertAttachments(attachments []Attachment) []PostmarkAttachment {
+	postmarkAttachments := make([]PostmarkAttachment, len(attachments))
 	for i, att := range attachments {
-		postmarkAttachments[i] = Attachment{
+		postmarkAttachments[i] = PostmarkAttachment{
+			Name:        att.filename(),
 			Content:     att.Content,
-			ContentID:   att.ContentID,
-			Disposition: att.Disposition,
-			Filename:    att.Filename,
-			Name:        att.Name,
-			ContentType: att.Type, // Use the 'type' field as 'ContentType'
+			ContentType: att.Type,
+		}
+		if att.inline() {
+			postmarkAttachments[i].ContentID = "cid:" + att.ContentID
 		}
 	}
 	return postmarkAttachments
 }
-
-func parseSectionsDynamicPostMark(sections map[string]string) map[string]string {
-	parsedSections := make(map[string]string)
-	for key, value := range sections {
-		// Remove any leading and trailing hyphens or curly braces
-		cleanKey := strings.Trim(key, "-{}")
-		parsedSections[cleanKey] = value
-	}
-	return parsedSections
-}
@@ -51,26 +51,36 @@ func ProcessPostmarkEvents(msg *sarama.ConsumerMessage) {
 }
 
 type PostmarkEvent struct {
-	RecordType  string    `json:"RecordType"`
-	ServerID    int       `json:"ServerID"`
-	MessageID   string    `json:"MessageID"`
-	Recipient   string    `json:"Recipient"`
-	Tag         string    `json:"Tag"`
-	DeliveredAt time.Time `json:"DeliveredAt"`
-	Details     string    `json:"Details"`
-	Type        string    `json:"Type"`
-	TypeCode    int       `json:"TypeCode"`
-	BouncedAt   time.Time `json:"BouncedAt"`
-	BounceEmail string    `json:"Email"`
-	ReceivedAt  time.Time `json:"ReceivedAt"`
+	RecordType  string            `json:"RecordType"`
+	ServerID    int               `json:"ServerID"`
+	MessageID   string            `json:"MessageID"`
+	Recipient   string            `json:"Recipient"`
+	Tag         string            `json:"Tag"`
+	DeliveredAt time.Time         `json:"DeliveredAt"`
+	Details     string            `json:"Details"`
+	Type        string            `json:"Type"`
+	TypeCode    int               `json:"TypeCode"`
+	BouncedAt   time.Time         `json:"BouncedAt"`
+	BounceEmail string            `json:"Email"`
+	ReceivedAt  time.Time         `json:"ReceivedAt"`
+	Metadata    map[string]string `json:"Metadata"`
 }
 
 func standardizePostmarkEvent(event PostmarkEvent) StandardizedEvent {
+	recipient := event.Recipient
+	if recipient == "" {
+		recipient = event.BounceEmail
+	}
+	domain := recipientDomain(recipient)
+
 	standardEvent := StandardizedEvent{
-		MessageID:     event.MessageID,
-		Provider:      "postmark",
-		Processed:     true,
-		ProcessedTime: time.Now().UTC().Unix(),
+		MessageID:       event.MessageID,
+		Provider:        "postmark",
+		Processed:       true,
+		ProcessedTime:   time.Now().UTC().Unix(),
+		RecipientDomain: domain,
+		MailboxProvider: mailboxProviderGroup(domain, ""),
+		CorrelationID:   event.Metadata[correlationKey],
 	}
 
 	switch event.RecordType {
@@ -95,6 +105,15 @@ func standardizePostmarkEvent(event PostmarkEvent) StandardizedEvent {
 		openTime := event.ReceivedAt.Unix()
 		standardEvent.UniqueOpenTime = &openTime
 		standardEvent.OpenCount = 1
+	case "Click":
+		standardEvent.Click = true
+		standardEvent.ClickCount = 1
+		clickTime := event.ReceivedAt.Unix()
+		standardEvent.LastClickTime = &clickTime
+	case "SpamComplaint":
+		standardEvent.SpamReport = true
+		complaintTime := event.BouncedAt.Unix()
+		standardEvent.SpamReportTime = &complaintTime
 	}
 
 	return standardEvent
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// eventFlags is the state of a message's events row before a new event is
+// applied. A nil *eventFlags means the message has no row yet.
+type eventFlags struct {
+	Delivered  bool
+	Bounce     bool
+	Open       bool
+	Deferred   bool
+	SpamReport bool
+	Click      bool
+}
+
+// ProviderRollupDelta is the change one event makes to the hourly rollup of
+// its user, ESP and mailbox provider. Each counter counts messages, as the
+// weights are calculated per message, so it only moves the first time a
+// message reaches a state.
+type ProviderRollupDelta struct {
+	Total      int
+	Delivered  int
+	Bounced    int
+	Opened     int
+	Deferred   int
+	Complaints int
+	Clicks     int
+}
+
+func (d ProviderRollupDelta) isZero() bool {
+	return d == ProviderRollupDelta{}
+}
+
+// lockEventFlags reads the current flags of a message's events row and locks
+// it until the transaction ends.
+func lockEventFlags(tx *sql.Tx, messageID string) (*eventFlags, error) {
+	var flags eventFlags
+	err := tx.QueryRow(`
+        SELECT delivered, bounce, open, deferred, spam_report, click
+        FROM events
+        WHERE message_id = $1
+        FOR UPDATE
+    `, messageID).Scan(&flags.Delivered, &flags.Bounce, &flags.Open, &flags.Deferred, &flags.SpamReport, &flags.Click)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &flags, nil
+}
+
+// rollupDelta works out which rollup counters an event moves given the
+// message's previous flags.
+func rollupDelta(previous *eventFlags, event StandardizedEvent) ProviderRollupDelta {
+	var before eventFlags
+	var delta ProviderRollupDelta
+	if previous == nil {
+		delta.Total = 1
+	} else {
+		before = *previous
+	}
+
+	count := func(now, was bool) int {
+		if now && !was {
+			return 1
+		}
+		return 0
+	}
+
+	delta.Delivered = count(event.Delivered, before.Delivered)
+	delta.Bounced = count(event.Bounce, before.Bounce)
+	delta.Opened = count(event.Open, before.Open)
+	delta.Deferred = count(event.Deferred, before.Deferred)
+	delta.Complaints = count(event.SpamReport, before.SpamReport)
+	delta.Clicks = count(event.Click, before.Click)
+	return delta
+}
+
+// updateProviderRollup adds delta to the hourly rollup row of the event's
+// user and ESP. The user is found by the ID the message was sent under, which
+// for SocketLabs bulk messages is shared by the events of every recipient.
+// Events for messages we cannot attribute to a user are skipped.
+func updateProviderRollup(tx *sql.Tx, event StandardizedEvent, delta ProviderRollupDelta) error {
+	if delta.isZero() {
+		return nil
+	}
+
+	var userID, espID int
+	var provider string
+	err := tx.QueryRow(`
+        SELECT mua.user_id, mua.esp_id, esp.provider_name
+        FROM message_user_associations mua
+        JOIN email_service_providers esp ON mua.esp_id = esp.esp_id
+        WHERE mua.message_id = $1
+    `, event.sentMessageID()).Scan(&userID, &espID, &provider)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mailboxProvider := event.MailboxProvider
+	if mailboxProvider == "" {
+		mailboxProvider = mailboxOther
+	}
+	bucket := time.Unix(event.ProcessedTime, 0).UTC().Truncate(time.Hour)
+
+	_, err = tx.Exec(`
+        INSERT INTO provider_stats_hourly (
+            user_id, esp_id, provider, mailbox_provider, bucket_start,
+            total_events, delivered, bounced, opened, deferred, complaints, clicks
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        ON CONFLICT (user_id, esp_id, mailbox_provider, bucket_start) DO UPDATE SET
+            total_events = provider_stats_hourly.total_events + EXCLUDED.total_events,
+            delivered = provider_stats_hourly.delivered + EXCLUDED.delivered,
+            bounced = provider_stats_hourly.bounced + EXCLUDED.bounced,
+            opened = provider_stats_hourly.opened + EXCLUDED.opened,
+            deferred = provider_stats_hourly.deferred + EXCLUDED.deferred,
+            complaints = provider_stats_hourly.complaints + EXCLUDED.complaints,
+            clicks = provider_stats_hourly.clicks + EXCLUDED.clicks
+    `, userID, espID, provider, mailboxProvider, bucket,
+		delta.Total, delta.Delivered, delta.Bounced, delta.Opened, delta.Deferred, delta.Complaints, delta.Clicks)
+	return err
+}
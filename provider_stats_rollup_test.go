@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRollupDelta(t *testing.T) {
+	testCases := []struct {
+		name     string
+		previous *eventFlags
+		event    StandardizedEvent
+		expected ProviderRollupDelta
+	}{
+		{
+			name:     "First event for a message",
+			event:    StandardizedEvent{Delivered: true},
+			expected: ProviderRollupDelta{Total: 1, Delivered: 1},
+		},
+		{
+			name:     "Open after delivery",
+			previous: &eventFlags{Delivered: true},
+			event:    StandardizedEvent{Open: true},
+			expected: ProviderRollupDelta{Opened: 1},
+		},
+		{
+			name:     "Repeated open",
+			previous: &eventFlags{Delivered: true, Open: true},
+			event:    StandardizedEvent{Open: true},
+			expected: ProviderRollupDelta{},
+		},
+		{
+			name:     "Spam complaint and click",
+			previous: &eventFlags{Delivered: true, Open: true},
+			event:    StandardizedEvent{SpamReport: true, Click: true},
+			expected: ProviderRollupDelta{Complaints: 1, Clicks: 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if delta := rollupDelta(tc.previous, tc.event); delta != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, delta)
+			}
+		})
+	}
+}
+
+func TestUpdateProviderRollupBulkSocketLabsEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	event := standardizeSocketLabsEvent(SocketLabsBaseEvent{
+		Type:      "Delivered",
+		MessageId: "msg-1",
+		Address:   "Ann@Example.com",
+		DateTime:  time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC),
+	}, SocketlabsWebhookHeaders{})
+	if event.MessageID != "msg-1:ann@example.com" {
+		t.Fatalf("Expected a per-recipient events key, got %q", event.MessageID)
+	}
+
+	// The association is looked up under the MessageId the bulk message was
+	// sent with, not the per-recipient key
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM message_user_associations").
+		WithArgs("msg-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "esp_id", "provider_name"}).AddRow(7, 3, "socketlabs"))
+	mock.ExpectExec("INSERT INTO provider_stats_hourly").
+		WithArgs(7, 3, "socketlabs", "other", time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), 1, 1, 0, 0, 0, 0, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := updateProviderRollup(tx, event, rollupDelta(nil, event)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -1,158 +1,220 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-func SendEmailWithSendGrid(emailMessage EmailMessage) {
+// sendGridRecipientLimit is the most To, Cc and Bcc addresses SendGrid
+// accepts across the personalizations of one request.
+const sendGridRecipientLimit = 1000
+
+// sendGridRequest is a group of personalizations that share everything
+// SendGrid sets once per request: sender, reply-to and content or template.
+type sendGridRequest struct {
+	from       EmailAddress
+	replyTo    EmailAddress
+	templateID string
+	content    []Content
+	indexes    []int
+}
+
+// SendEmailWithSendGrid sends personalizations that share a sender and
+// content in multi-personalization requests, and reports the outcome of
+// each personalization. Content is rendered locally, or by a dynamic
+// template synced from a stored template, so SendGrid's substitutions and
+// sections are not used.
+func SendEmailWithSendGrid(emailMessage EmailMessage) sendResults {
+	results := newSendResults(len(emailMessage.Personalizations))
 	apiKey := emailMessage.Credentials.SendgridAPIKey
 	client := sendgrid.NewSendClient(apiKey)
-	// Parse sections dynamically
-	parsedSections := parseSectionsDynamic(emailMessage.Sections)
-	// Transform substitutions
-	transformedPersonalizations := transformSubstitutionsDynamic(emailMessage.Personalizations, parsedSections)
-
-	for _, p := range transformedPersonalizations {
-		message := mail.NewV3Mail()
-
-		from := mail.NewEmail(emailMessage.From.Name, emailMessage.From.Email)
-		message.SetFrom(from)
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		results.setAll(allIndexes(results), fmt.Errorf("failed to parse email templates: %v", err))
+		return results
+	}
 
-		// Set subject (personalized or default)
-		subject := p.Subject
-		if subject == "" {
-			subject = emailMessage.Subject
-		}
-		message.Subject = subject
+	var order []string
+	requests := make(map[string]*sendGridRequest)
+	personalizations := make([]*mail.Personalization, len(emailMessage.Personalizations))
+	for i, p := range emailMessage.Personalizations {
+		env := emailMessage.envelopeFor(p)
+		request := sendGridRequest{from: env.From, replyTo: env.ReplyTo}
 
-		// Add recipient
-		to := mail.NewEmail(p.To.Name, p.To.Email)
 		personalization := mail.NewPersonalization()
-		personalization.AddTos(to)
+		if templateID, ok := emailMessage.nativeTemplateFor(p); ok {
+			request.templateID = templateID
+			personalization.DynamicTemplateData = personalizationData(p)
+		} else {
+			subject, renderedContent, err := renderer.Render(p)
+			if err != nil {
+				results[i] = fmt.Errorf("failed to render email for %s: %v", p.primaryRecipient().Email, err)
+				log.Println(results[i])
+				continue
+			}
+			personalization.Subject = subject
+			request.content = renderedContent
+		}
 
-		// Add CC and BCC recipients
-		for _, cc := range emailMessage.Cc {
-			personalization.AddCCs(mail.NewEmail("", cc))
+		// Add recipients
+		for _, to := range p.To {
+			personalization.AddTos(mail.NewEmail(to.Name, to.Email))
 		}
-		for _, bcc := range emailMessage.Bcc {
-			personalization.AddBCCs(mail.NewEmail("", bcc))
+		for _, cc := range env.Cc {
+			personalization.AddCCs(mail.NewEmail(cc.Name, cc.Email))
 		}
-
-		// Process content with substitutions
-		for _, content := range emailMessage.Content {
-			processedValue := content.Value
-			for key, value := range p.Substitutions {
-				processedValue = strings.ReplaceAll(processedValue, key, value)
-			}
-			for key, value := range emailMessage.Sections {
-				processedValue = strings.ReplaceAll(processedValue, key, value)
-			}
-			message.AddContent(mail.NewContent(content.Type, processedValue))
+		for _, bcc := range env.Bcc {
+			personalization.AddBCCs(mail.NewEmail(bcc.Name, bcc.Email))
 		}
+		personalization.Headers = env.allHeaders()
+		for key, value := range emailMessage.withCorrelationID(env.customArgStrings(), p) {
+			personalization.SetCustomArg(key, value)
+		}
+		personalizations[i] = personalization
+
+		key, _ := json.Marshal([]interface{}{request.from, request.replyTo, request.templateID, request.content})
+		group, ok := requests[string(key)]
+		if !ok {
+			group = &request
+			requests[string(key)] = group
+			order = append(order, string(key))
+		}
+		group.indexes = append(group.indexes, i)
+	}
 
-		message.Sections = emailMessage.Sections
-
-		// Add transformed substitutions
-		personalization.Substitutions = p.Substitutions
-
-		message.AddPersonalizations(personalization)
-
-		// Add attachments
-		for _, attachment := range emailMessage.Attachments {
-			content, err := base64.StdEncoding.DecodeString(attachment.Content)
-			if err != nil {
-				log.Printf("Failed to decode attachment content: %v", err)
-				continue
+	recipients := func(i int) int {
+		return len(personalizations[i].To) + len(personalizations[i].CC) + len(personalizations[i].BCC)
+	}
+	for _, key := range order {
+		request := requests[key]
+		for _, chunk := range chunkRecipients(request.indexes, recipients, sendGridRecipientLimit) {
+			message := newSendGridMessage(emailMessage, request)
+			for _, i := range chunk {
+				message.AddPersonalizations(personalizations[i])
 			}
 
-			message.AddAttachment(&mail.Attachment{
-				Content:     string(content),
-				ContentID:   attachment.ContentID,
-				Type:        attachment.Type,
-				Filename:    attachment.Filename,
-				Name:        attachment.Name,
-				Disposition: attachment.Disposition,
-			})
+			response, err := client.Send(message)
+			if err != nil || response.StatusCode >= 300 {
+				SendGridErrorHandler(response, err, emailMessage.Personalizations[chunk[0]].primaryRecipient().Email)
+				if err == nil {
+					err = fmt.Errorf("sendgrid returned status %d", response.StatusCode)
+				}
+			}
+			results.setAll(chunk, err)
 		}
+	}
+	return results
+}
 
-		// Add custom headers
-		message.Headers = emailMessage.Headers
+// newSendGridMessage creates a request without personalizations.
+func newSendGridMessage(emailMessage EmailMessage, request *sendGridRequest) *mail.SGMailV3 {
+	message := mail.NewV3Mail()
+	message.SetFrom(mail.NewEmail(request.from.Name, request.from.Email))
+	if request.replyTo.Email != "" {
+		message.SetReplyTo(mail.NewEmail(request.replyTo.Name, request.replyTo.Email))
+	}
+	if request.templateID != "" {
+		message.SetTemplateID(request.templateID)
+	}
+	for _, content := range request.content {
+		message.AddContent(mail.NewContent(content.Type, content.Value))
+	}
 
-		// Add categories
-		message.Categories = emailMessage.Categories
+	// SendGrid takes attachment content as base64; inline images carry the
+	// content ID the HTML references
+	for _, attachment := range emailMessage.Attachments {
+		sgAttachment := &mail.Attachment{
+			Content:     attachment.Content,
+			Type:        attachment.Type,
+			Filename:    attachment.filename(),
+			Name:        attachment.Name,
+			Disposition: "attachment",
+		}
+		if attachment.inline() {
+			sgAttachment.Disposition = "inline"
+			sgAttachment.ContentID = attachment.ContentID
+		}
+		message.AddAttachment(sgAttachment)
+	}
 
-		// printMessageStructure(message)
-		// Send the emails
-		response, err := client.Send(message)
-		if err != nil {
-			SendGridErrorHandler(response, err, p.To.Email)
+	// Add categories and tracking
+	message.Categories = emailMessage.tags()
+	if tracking := emailMessage.Tracking; tracking.Opens != nil || tracking.Clicks != nil {
+		settings := mail.NewTrackingSettings()
+		if tracking.Opens != nil {
+			settings.SetOpenTracking(&mail.OpenTrackingSetting{Enable: tracking.Opens})
+		}
+		if tracking.Clicks != nil {
+			settings.SetClickTracking(&mail.ClickTrackingSetting{Enable: tracking.Clicks, EnableText: tracking.Clicks})
 		}
+		message.SetTrackingSettings(settings)
 	}
+	return message
 }
 
-func printMessageStructure(message *mail.SGMailV3) {
-	jsonData, err := json.MarshalIndent(message, "", "    ")
+// createSendGridTemplate creates a dynamic template with one active version
+// and returns its ID.
+func createSendGridTemplate(apiKey string, content nativeTemplateContent) (string, error) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	err := sendGridAPI(apiKey, "/v3/templates", map[string]interface{}{
+		"name":       content.Name,
+		"generation": "dynamic",
+	}, &created)
 	if err != nil {
-		log.Fatalf("Error marshaling message to JSON: %v", err)
+		return "", err
 	}
-	fmt.Println(string(jsonData))
-}
 
-func transformSubstitutionsDynamic(personalizations []Personalization, sections map[string]string) []Personalization {
-	for i, personalization := range personalizations {
-		newSubstitutions := make(map[string]string)
-
-		for key, value := range personalization.Substitutions {
-			// Create both hyphen and handlebars versions of the key
-			hyphenKey := fmt.Sprintf("-%s-", key)
-			handlebarKey := fmt.Sprintf("{{%s}}", key)
-
-			// Add both versions to the new substitutions
-			newSubstitutions[hyphenKey] = value
-			newSubstitutions[handlebarKey] = value
-
-			// Check if the value corresponds to a section key
-			hyphenSectionKey := fmt.Sprintf("-%s-", value)
-			handlebarSectionKey := fmt.Sprintf("{{%s}}", value)
-			if _, exists := sections[hyphenSectionKey]; exists {
-				newSubstitutions[hyphenKey] = hyphenSectionKey
-				// newSubstitutions[handlebarKey] = hyphenSectionKey
-			} else if _, exists := sections[handlebarSectionKey]; exists {
-				newSubstitutions[hyphenKey] = handlebarSectionKey
-				newSubstitutions[handlebarKey] = handlebarSectionKey
-			}
-		}
-
-		personalizations[i].Substitutions = newSubstitutions
+	err = sendGridAPI(apiKey, "/v3/templates/"+created.ID+"/versions", map[string]interface{}{
+		"template_id":            created.ID,
+		"name":                   content.Name,
+		"subject":                content.Subject,
+		"html_content":           content.HtmlBody,
+		"plain_content":          content.TextBody,
+		"generate_plain_content": content.TextBody == "",
+		"active":                 1,
+	}, nil)
+	if err != nil {
+		return "", err
 	}
-
-	return personalizations
+	return created.ID, nil
 }
 
-func parseSectionsDynamic(sections map[string]string) map[string]string {
-	newSections := make(map[string]string)
-	for key, value := range sections {
-		// Keep the original key
-		newSections[key] = value
+// sendGridAPI posts body to a SendGrid v3 endpoint and decodes the response
+// into result when it is not nil.
+func sendGridAPI(apiKey, endpoint string, body interface{}, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
 
-		// Add handlebars version if it's a hyphen-wrapped key
-		if strings.HasPrefix(key, "-") && strings.HasSuffix(key, "-") {
-			handlebarKey := fmt.Sprintf("{{%s}}", strings.Trim(key, "-"))
-			newSections[handlebarKey] = value
+	request := sendgrid.GetRequest(apiKey, endpoint, "https://api.sendgrid.com")
+	request.Method = "POST"
+	request.Body = payload
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return fmt.Errorf("sendgrid request to %s failed: %v", endpoint, err)
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid request to %s returned status %d: %s", endpoint, response.StatusCode, response.Body)
+	}
+	if result != nil {
+		if err := json.Unmarshal([]byte(response.Body), result); err != nil {
+			return fmt.Errorf("failed to decode sendgrid response: %v", err)
 		}
+	}
+	return nil
+}
 
-		// Add hyphen-wrapped version if it's a handlebars key
-		if strings.HasPrefix(key, "{{") && strings.HasSuffix(key, "}}") {
-			hyphenKey := fmt.Sprintf("-%s-", strings.Trim(key, "{}"))
-			newSections[hyphenKey] = value
-		}
+func printMessageStructure(message *mail.SGMailV3) {
+	jsonData, err := json.MarshalIndent(message, "", "    ")
+	if err != nil {
+		log.Fatalf("Error marshaling message to JSON: %v", err)
 	}
-	return newSections
+	fmt.Println(string(jsonData))
 }
@@ -41,6 +41,8 @@ type EventBody struct {
 	SMTPID        string   `json:"smtp-id"`
 	BounceType    string   `json:"bounce_type,omitempty"`
 	Reason        string   `json:"reason,omitempty"`
+	// Custom arguments are returned as fields of the event
+	CorrelationID string `json:"relay_correlation_id,omitempty"`
 }
 
 func ProcessSendgridEvents(msg *sarama.ConsumerMessage) {
@@ -80,11 +82,15 @@ func ProcessSendgridEvents(msg *sarama.ConsumerMessage) {
 func standardizeEvent(eventBody EventBody, headers SendgridHeaders) StandardizedEvent {
 	processedTime, _ := strconv.ParseInt(headers.XTwilioEmailEventWebhookTimestamp[0], 10, 64)
 
+	domain := recipientDomain(eventBody.Email)
 	event := StandardizedEvent{
-		MessageID:     eventBody.SGMessageID,
-		Provider:      "sendgrid",
-		Processed:     true,
-		ProcessedTime: processedTime,
+		MessageID:       eventBody.SGMessageID,
+		Provider:        "sendgrid",
+		Processed:       true,
+		ProcessedTime:   processedTime,
+		RecipientDomain: domain,
+		MailboxProvider: mailboxProviderGroup(domain, ""),
+		CorrelationID:   eventBody.CorrelationID,
 	}
 
 	switch eventBody.Event {
@@ -111,6 +117,13 @@ func standardizeEvent(eventBody EventBody, headers SendgridHeaders) Standardized
 		event.Dropped = true
 		event.DroppedTime = &eventBody.Timestamp
 		event.DroppedReason = eventBody.Reason
+	case "click":
+		event.Click = true
+		event.ClickCount = 1
+		event.LastClickTime = &eventBody.Timestamp
+	case "spamreport":
+		event.SpamReport = true
+		event.SpamReportTime = &eventBody.Timestamp
 	}
 
 	return event
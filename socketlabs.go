@@ -4,96 +4,296 @@ import (
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/socketlabs/socketlabs-go/injectionapi"
 	"github.com/socketlabs/socketlabs-go/injectionapi/message"
 )
 
-func SendEmailWithSocketLabs(emailMessage EmailMessage) error {
+// socketLabsBulkLimit is the most recipients sent in one bulk message.
+const socketLabsBulkLimit = 1000
+
+// Merge fields carrying each recipient's rendered content in bulk messages.
+const (
+	socketLabsSubjectField = "RelaySubject"
+	socketLabsHTMLField    = "RelayHtml"
+	socketLabsTextField    = "RelayText"
+)
+
+// socketLabsBulk is a bulk message and the personalizations of its
+// recipients, in order.
+type socketLabsBulk struct {
+	message *message.BulkMessage
+	indexes []int
+}
+
+// SendEmailWithSocketLabs sends personalizations with a single recipient in
+// bulk messages, with each recipient's rendered content as merge data, and
+// the others one message each. It reports the outcome of each
+// personalization.
+func SendEmailWithSocketLabs(emailMessage EmailMessage) sendResults {
+	results := newSendResults(len(emailMessage.Personalizations))
 	serverID, _ := strconv.Atoi(emailMessage.Credentials.SocketLabsServerID)
 	apiKey := emailMessage.Credentials.SocketLabsAPIKey
 
 	client := injectionapi.CreateClient(serverID, apiKey)
 	errorHandler := NewSocketLabsErrorHandler()
 
-	preparedMessages := prepareSocketLabsMessages(emailMessage)
-
-	// Print prepared messages for review
-	// printPreparedMessages(preparedMessages)
+	// Bulk recipients cannot have copies or share a message with others
+	var basicIndexes, bulkIndexes []int
+	for i, p := range emailMessage.Personalizations {
+		if len(p.To) == 1 && len(p.Cc)+len(p.Bcc) == 0 {
+			bulkIndexes = append(bulkIndexes, i)
+		} else {
+			basicIndexes = append(basicIndexes, i)
+		}
+	}
 
-	// Optional: Add a prompt to continue or abort
-	// fmt.Print("Press Enter to continue sending, or Ctrl+C to abort...")
-	// fmt.Scanln() // Wait for user input
+	basicMessage := emailMessage
+	basicMessage.Personalizations = make([]Personalization, len(basicIndexes))
+	for k, i := range basicIndexes {
+		basicMessage.Personalizations[k] = emailMessage.Personalizations[i]
+	}
+	for k, basic := range prepareSocketLabsMessages(basicMessage) {
+		i := basicIndexes[k]
+		if basic == nil {
+			results[i] = fmt.Errorf("failed to render email for %s", emailMessage.Personalizations[i].primaryRecipient().Email)
+			continue
+		}
 
-	for _, basic := range preparedMessages {
 		res, err := client.SendBasic(basic)
-		if err != nil {
-			errorHandler.HandleSendError(basic.To[0].EmailAddress, err, &res)
-			return fmt.Errorf("failed to send email: %v", err)
+		if err == nil && res.Result != injectionapi.SendResultSUCCESS {
+			err = fmt.Errorf("send unsuccessful: %s - %s", res.Result.ToString(), res.Result.ToResponseMessage())
 		}
-		if res.Result != injectionapi.SendResultSUCCESS {
-			err := fmt.Errorf("send unsuccessful: %s - %s", res.Result.ToString(), res.Result.ToResponseMessage())
+		if err != nil {
 			errorHandler.HandleSendError(basic.To[0].EmailAddress, err, &res)
-			return err
 		}
+		results[i] = err
 	}
 
-	return nil
+	for _, bulk := range prepareSocketLabsBulkMessages(emailMessage, bulkIndexes, results) {
+		res, err := client.SendBulk(bulk.message)
+		if err == nil && res.Result != injectionapi.SendResultSUCCESS {
+			err = fmt.Errorf("send unsuccessful: %s - %s", res.Result.ToString(), res.Result.ToResponseMessage())
+		}
+		if err != nil {
+			errorHandler.HandleSendError(bulk.message.To[0].Email, err, &res)
+		}
+		results.setAll(bulk.indexes, err)
+
+		// Recipients SocketLabs refused are listed by address
+		for _, address := range res.AddressResults {
+			if address.Accepted {
+				continue
+			}
+			for k, recipient := range bulk.message.To {
+				if strings.EqualFold(recipient.Email, address.EmailAddress) {
+					results[bulk.indexes[k]] = fmt.Errorf("recipient %s not accepted: %s", address.EmailAddress, address.ErrorCode)
+				}
+			}
+		}
+	}
+	return results
 }
 
+// prepareSocketLabsMessages builds one message per personalization. The
+// result is aligned with the personalizations, with nil for those that
+// could not be rendered.
 func prepareSocketLabsMessages(emailMessage EmailMessage) []*message.BasicMessage {
 	xxsMessageId := generateXxsMessageId(emailMessage.Credentials.SocketLabsAPIKey)
-	parsedSections := parseSectionsDynamic(emailMessage.Sections)
-	var preparedMessages []*message.BasicMessage
+	preparedMessages := make([]*message.BasicMessage, len(emailMessage.Personalizations))
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		log.Printf("Failed to parse email templates: %v", err)
+		return preparedMessages
+	}
 
-	for _, personalization := range emailMessage.Personalizations {
-		processedContent := processContent(emailMessage.Content, personalization.Substitutions, parsedSections)
+	for i, personalization := range emailMessage.Personalizations {
+		subject, processedContent, err := renderer.Render(personalization)
+		if err != nil {
+			log.Printf("Failed to render email for %s: %v", personalization.primaryRecipient().Email, err)
+			continue
+		}
 
+		env := emailMessage.envelopeFor(personalization)
 		basic := &message.BasicMessage{
-			Subject: personalization.Subject,
+			Subject: subject,
 			From: message.EmailAddress{
-				EmailAddress: emailMessage.From.Email,
-				FriendlyName: emailMessage.From.Name,
+				EmailAddress: env.From.Email,
+				FriendlyName: env.From.Name,
 			},
 			PlainTextBody: getContentByType(processedContent, "text/plain"),
 			HtmlBody:      getContentByType(processedContent, "text/html"),
+			Attachments:   socketLabsAttachments(emailMessage),
+			CustomHeaders: socketLabsHeaders(env.allHeaders(), xxsMessageId),
+			Metadata:      socketLabsMetadata(env),
+			MessageId:     emailMessage.correlationID(personalization),
+			MailingId:     emailMessage.primaryTag(),
+			Tags:          emailMessage.tags(),
+		}
+
+		if env.ReplyTo.Email != "" {
+			basic.ReplyTo = message.NewFriendlyEmailAddress(env.ReplyTo.Email, env.ReplyTo.Name)
 		}
 
-		basic.AddToEmailAddress(personalization.To.Email)
+		for _, to := range personalization.To {
+			basic.AddToFriendlyEmailAddress(to.Email, to.Name)
+		}
 
-		for _, cc := range emailMessage.Cc {
-			basic.AddCcEmailAddress(cc)
+		for _, cc := range env.Cc {
+			basic.AddCcFriendlyEmailAddress(cc.Email, cc.Name)
 		}
-		for _, bcc := range emailMessage.Bcc {
-			basic.AddBccEmailAddress(bcc)
+		for _, bcc := range env.Bcc {
+			basic.AddBccFriendlyEmailAddress(bcc.Email, bcc.Name)
 		}
 
-		for _, attachment := range emailMessage.Attachments {
-			content, err := base64.StdEncoding.DecodeString(attachment.Content)
-			if err != nil {
-				log.Printf("Failed to decode attachment content: %v", err)
-				continue
+		preparedMessages[i] = basic
+	}
+
+	return preparedMessages
+}
+
+// prepareSocketLabsBulkMessages builds bulk messages for the personalizations
+// at indexes, one per sender, reply-to, headers and metadata, and at most
+// socketLabsBulkLimit recipients each. A bulk message has one MessageId for
+// all its recipients, so it carries the request's MessageID without a
+// recipient index. Personalizations that fail to render are recorded in
+// results.
+func prepareSocketLabsBulkMessages(emailMessage EmailMessage, indexes []int, results sendResults) []socketLabsBulk {
+	if len(indexes) == 0 {
+		return nil
+	}
+	xxsMessageId := generateXxsMessageId(emailMessage.Credentials.SocketLabsAPIKey)
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		results.setAll(indexes, fmt.Errorf("failed to parse email templates: %v", err))
+		return nil
+	}
+
+	// groups holds the bulk message still being filled for each key, and
+	// bulks every bulk message in the order they were started
+	var bulks []*socketLabsBulk
+	groups := make(map[string]*socketLabsBulk)
+	for _, i := range indexes {
+		personalization := emailMessage.Personalizations[i]
+		subject, processedContent, err := renderer.Render(personalization)
+		if err != nil {
+			results[i] = fmt.Errorf("failed to render email for %s: %v", personalization.primaryRecipient().Email, err)
+			log.Println(results[i])
+			continue
+		}
+
+		env := emailMessage.envelopeFor(personalization)
+		args, _ := json.Marshal(env.customArgStrings())
+		key := env.groupKey() + string(args)
+		group, ok := groups[key]
+		if !ok || len(group.indexes) >= socketLabsBulkLimit {
+			bulk := &message.BulkMessage{
+				Subject: "%%" + socketLabsSubjectField + "%%",
+				From: message.EmailAddress{
+					EmailAddress: env.From.Email,
+					FriendlyName: env.From.Name,
+				},
+				Attachments:   socketLabsAttachments(emailMessage),
+				CustomHeaders: socketLabsHeaders(socketLabsBulkHeaders(env), xxsMessageId),
+				Metadata:      socketLabsMetadata(env),
+				MessageId:     emailMessage.messageID,
+				MailingId:     emailMessage.primaryTag(),
+				Tags:          emailMessage.tags(),
+			}
+			if env.ReplyTo.Email != "" {
+				bulk.ReplyTo = message.NewFriendlyEmailAddress(env.ReplyTo.Email, env.ReplyTo.Name)
 			}
-			basic.Attachments = append(basic.Attachments, message.Attachment{
-				Content:  content,
-				MimeType: attachment.Type,
-				Name:     attachment.Name,
-			})
+			group = &socketLabsBulk{message: bulk}
+			groups[key] = group
+			bulks = append(bulks, group)
 		}
 
-		basic.CustomHeaders = append(basic.CustomHeaders, message.CustomHeader{Name: "X-xsMessageId", Value: xxsMessageId})
-		for key, value := range emailMessage.Headers {
-			basic.CustomHeaders = append(basic.CustomHeaders, message.CustomHeader{Name: key, Value: value})
+		to := personalization.To[0]
+		recipient := message.NewFriendlyBulkRecipient(to.Email, to.Name)
+		recipient.MergeData[socketLabsSubjectField] = subject
+		for name, value := range env.RecipientHeaders {
+			recipient.MergeData[recipientHeaderField(name)] = value
+		}
+		if html := getContentByType(processedContent, "text/html"); html != "" {
+			recipient.MergeData[socketLabsHTMLField] = html
+			group.message.HtmlBody = "%%" + socketLabsHTMLField + "%%"
+		}
+		if text := getContentByType(processedContent, "text/plain"); text != "" {
+			recipient.MergeData[socketLabsTextField] = text
+			group.message.PlainTextBody = "%%" + socketLabsTextField + "%%"
 		}
+		group.message.To = append(group.message.To, recipient)
+		group.indexes = append(group.indexes, i)
+	}
 
-		preparedMessages = append(preparedMessages, basic)
+	result := make([]socketLabsBulk, len(bulks))
+	for k, bulk := range bulks {
+		result[k] = *bulk
 	}
+	return result
+}
 
-	return preparedMessages
+// socketLabsAttachments decodes the attachments, as the SocketLabs client
+// encodes their content itself. Inline images are embedded by content ID.
+func socketLabsAttachments(emailMessage EmailMessage) []message.Attachment {
+	var attachments []message.Attachment
+	for _, attachment := range emailMessage.Attachments {
+		content, err := base64.StdEncoding.DecodeString(attachment.Content)
+		if err != nil {
+			log.Printf("Failed to decode attachment content: %v", err)
+			continue
+		}
+		slAttachment := message.Attachment{
+			Content:  content,
+			MimeType: attachment.Type,
+			Name:     attachment.filename(),
+		}
+		if attachment.inline() {
+			slAttachment.ContentID = attachment.ContentID
+		}
+		attachments = append(attachments, slAttachment)
+	}
+	return attachments
+}
+
+func socketLabsHeaders(customHeaders map[string]string, xxsMessageId string) []message.CustomHeader {
+	headers := []message.CustomHeader{{Name: "X-xsMessageId", Value: xxsMessageId}}
+	for key, value := range customHeaders {
+		headers = append(headers, message.CustomHeader{Name: key, Value: value})
+	}
+	return headers
+}
+
+// socketLabsBulkHeaders returns the headers of a bulk message: the shared
+// headers, and merge fields that SocketLabs fills in with each recipient's
+// recipient headers.
+func socketLabsBulkHeaders(env envelope) map[string]string {
+	headers := make(map[string]string, len(env.Headers)+len(env.RecipientHeaders))
+	for key, value := range env.Headers {
+		headers[key] = value
+	}
+	for name := range env.RecipientHeaders {
+		headers[name] = "%%" + recipientHeaderField(name) + "%%"
+	}
+	return headers
+}
+
+// socketLabsMetadata converts custom arguments; SocketLabs rejects metadata
+// with empty values.
+func socketLabsMetadata(env envelope) []message.Metadata {
+	var metadata []message.Metadata
+	for key, value := range env.customArgStrings() {
+		if value != "" {
+			metadata = append(metadata, message.NewMetadata(key, value))
+		}
+	}
+	return metadata
 }
 
 func generateXxsMessageId(apiKey string) string {
@@ -69,12 +69,13 @@ func ProcessSocketLabsEvents(msg *sarama.ConsumerMessage) {
 		return
 	}
 
+	standardizedEvent := standardizeSocketLabsEvent(baseEvent, payload.Headers)
+
+	// Messages sent without a MessageId get none in their events either.
 	// See Decoding Function to reverse this and ID the sender based on Secret Key
-	if baseEvent.MessageId == "" {
-		baseEvent.MessageId = generateMessageID(baseEvent.SecretKey, baseEvent.ServerId)
+	if standardizedEvent.MessageID == "" {
+		standardizedEvent.MessageID = generateMessageID(baseEvent.SecretKey, baseEvent.ServerId)
 	}
-
-	standardizedEvent := standardizeSocketLabsEvent(baseEvent, payload.Headers)
 	err = saveStandardizedEvent(standardizedEvent)
 	if err != nil {
 		log.Printf("Failed to save standardized event: %v\n", err)
@@ -82,11 +83,16 @@ func ProcessSocketLabsEvents(msg *sarama.ConsumerMessage) {
 }
 
 func standardizeSocketLabsEvent(event SocketLabsBaseEvent, headers SocketlabsWebhookHeaders) StandardizedEvent {
+	domain := recipientDomain(event.Address)
 	standardEvent := StandardizedEvent{
-		MessageID:     event.MessageId,
-		Provider:      "socketlabs",
-		Processed:     true,
-		ProcessedTime: event.DateTime.Unix(),
+		MessageID:       socketLabsEventKey(event),
+		CorrelationID:   event.MessageId,
+		SentMessageID:   event.MessageId,
+		Provider:        "socketlabs",
+		Processed:       true,
+		ProcessedTime:   event.DateTime.Unix(),
+		RecipientDomain: domain,
+		MailboxProvider: mailboxProviderGroup(domain, ""),
 	}
 
 	switch event.Type {
@@ -109,6 +115,8 @@ func standardizeSocketLabsEvent(event SocketLabsBaseEvent, headers SocketlabsWeb
 		droppedTime := event.DateTime.Unix()
 		standardEvent.DroppedTime = &droppedTime
 		standardEvent.DroppedReason = "Complaint"
+		standardEvent.SpamReport = true
+		standardEvent.SpamReportTime = &droppedTime
 	case "Deferred":
 		standardEvent.Deferred = true
 		standardEvent.DeferredCount = 1
@@ -120,8 +128,9 @@ func standardizeSocketLabsEvent(event SocketLabsBaseEvent, headers SocketlabsWeb
 		standardEvent.DroppedReason = deferralInfo
 	}
 
-	// Handle tracking types
-	if trackingType, ok := trackingTypeMap[event.TrackingType]; ok {
+	// Handle tracking types. TrackingType is zero (Click) on every other event
+	// type, so only look at it for tracking events.
+	if trackingType, ok := trackingTypeMap[event.TrackingType]; ok && event.Type == "Tracking" {
 		switch trackingType {
 		case "Open":
 			standardEvent.Open = true
@@ -132,7 +141,10 @@ func standardizeSocketLabsEvent(event SocketLabsBaseEvent, headers SocketlabsWeb
 			standardEvent.UniqueOpen = true
 			standardEvent.UniqueOpenTime = &openTime
 		case "Click":
-			// You might want to add click-specific logic here if needed
+			standardEvent.Click = true
+			standardEvent.ClickCount = 1
+			clickTime := event.DateTime.Unix()
+			standardEvent.LastClickTime = &clickTime
 		case "Unsubscribe":
 			// You might want to add unsubscribe-specific logic here if needed
 		}
@@ -140,6 +152,22 @@ func standardizeSocketLabsEvent(event SocketLabsBaseEvent, headers SocketlabsWeb
 
 	return standardEvent
 }
+
+// socketLabsEventKey returns the events row of a SocketLabs event. The
+// MessageId is the correlation ID we sent, which identifies one recipient
+// for basic messages; bulk messages share the request's MessageID between
+// recipients, so the address is added to keep one row per recipient. The
+// event's SentMessageID keeps the MessageId for attributing it to a user.
+func socketLabsEventKey(event SocketLabsBaseEvent) string {
+	if event.MessageId == "" {
+		return ""
+	}
+	if _, _, ok := splitCorrelationID(event.MessageId); ok {
+		return event.MessageId
+	}
+	return event.MessageId + ":" + strings.ToLower(event.Address)
+}
+
 func generateMessageID(secretKey string, serverID int) string {
 	// Use the current timestamp to ensure uniqueness
 	timestamp := time.Now().UTC().UnixNano()
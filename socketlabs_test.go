@@ -21,7 +21,10 @@ func TestProcessContent(t *testing.T) {
 		"greeting": "Welcome, {{name}}!",
 	}
 
-	processed := processContent(content, substitutions, sections)
+	renderer, err := newMessageRenderer(EmailMessage{Content: content, Sections: sections})
+	assert.NoError(t, err)
+	_, processed, err := renderer.Render(Personalization{Substitutions: substitutions})
+	assert.NoError(t, err)
 
 	assert.Equal(t, "Hello John, your order 12345 is ready.", processed[0].Value)
 	assert.Equal(t, "<p>Hello John, your order 12345 is ready.</p>", processed[1].Value)
@@ -59,7 +62,7 @@ func TestPrepareSocketLabsMessages(t *testing.T) {
 		From: EmailAddress{Email: "sender@example.com", Name: "Sender"},
 		Personalizations: []Personalization{
 			{
-				To:      EmailAddress{Email: "recipient1@example.com", Name: "Recipient1"},
+				To:      EmailAddressList{{Email: "recipient1@example.com", Name: "Recipient1"}},
 				Subject: "Test Email 1",
 				Substitutions: map[string]string{
 					"name":     "John",
@@ -67,7 +70,7 @@ func TestPrepareSocketLabsMessages(t *testing.T) {
 				},
 			},
 			{
-				To:      EmailAddress{Email: "recipient2@example.com", Name: "Recipient2"},
+				To:      EmailAddressList{{Email: "recipient2@example.com", Name: "Recipient2"}},
 				Subject: "Test Email 2",
 				Substitutions: map[string]string{
 					"name":     "Jane",
@@ -92,14 +95,14 @@ func TestPrepareSocketLabsMessages(t *testing.T) {
 				Type:     "text/plain",
 			},
 		},
-		Cc:  []string{"cc@example.com"},
-		Bcc: []string{"bcc@example.com"},
+		Cc:  []EmailAddress{{Email: "cc@example.com"}},
+		Bcc: []EmailAddress{{Email: "bcc@example.com"}},
 		Credentials: Credentials{
 			SocketLabsAPIKey: "test-api-key",
 		},
 	}
 
-	preparedMessages := prepareSocketLabsMessages(emailMessage)
+	preparedMessages := prepareSocketLabsMessages(expandPersonalizations(emailMessage))
 
 	assert.Equal(t, 2, len(preparedMessages), "Should have 2 prepared messages")
 
@@ -119,11 +122,17 @@ func TestPrepareSocketLabsMessages(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("Hello %s, your order %s is ready.", expectedName, expectedOrderID), msg.PlainTextBody)
 		assert.Equal(t, fmt.Sprintf("<p>Hello %s, your order %s is ready.</p>", expectedName, expectedOrderID), msg.HtmlBody)
 
-		assert.Equal(t, 1, len(msg.Cc))
-		assert.Equal(t, "cc@example.com", msg.Cc[0].EmailAddress)
+		// The message's copies are sent once, with the first recipient
+		if i == 0 {
+			assert.Equal(t, 1, len(msg.Cc))
+			assert.Equal(t, "cc@example.com", msg.Cc[0].EmailAddress)
 
-		assert.Equal(t, 1, len(msg.Bcc))
-		assert.Equal(t, "bcc@example.com", msg.Bcc[0].EmailAddress)
+			assert.Equal(t, 1, len(msg.Bcc))
+			assert.Equal(t, "bcc@example.com", msg.Bcc[0].EmailAddress)
+		} else {
+			assert.Empty(t, msg.Cc)
+			assert.Empty(t, msg.Bcc)
+		}
 
 		assert.Equal(t, 2, len(msg.CustomHeaders))
 		assert.Contains(t, msg.CustomHeaders, message.CustomHeader{Name: "X-Custom-Header", Value: "Custom Value"})
@@ -135,3 +144,88 @@ func TestPrepareSocketLabsMessages(t *testing.T) {
 		assert.Equal(t, []byte("Hello World!"), msg.Attachments[0].Content)
 	}
 }
+
+func TestPrepareSocketLabsBulkMessages(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "sender@example.com"},
+		Content: []Content{{Type: "text/html", Value: "<p>Hi {{name}}</p>"}},
+		Subject: "Hello {{name}}",
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "a@example.com"}}, Substitutions: map[string]string{"name": "Ann"}},
+			{To: EmailAddressList{{Email: "b@example.com"}}, Substitutions: map[string]string{"name": "Bob"}},
+			{To: EmailAddressList{{Email: "c@example.com"}}, From: EmailAddress{Email: "other@example.com"}},
+		},
+	}
+	results := newSendResults(3)
+
+	bulks := prepareSocketLabsBulkMessages(emailMessage, []int{0, 1, 2}, results)
+
+	assert.Len(t, bulks, 2, "A different sender needs its own bulk message")
+	assert.Equal(t, []int{0, 1}, bulks[0].indexes)
+	assert.Equal(t, []int{2}, bulks[1].indexes)
+
+	bulk := bulks[0].message
+	assert.Equal(t, "%%RelaySubject%%", bulk.Subject)
+	assert.Equal(t, "%%RelayHtml%%", bulk.HtmlBody)
+	assert.Equal(t, "%%RelayText%%", bulk.PlainTextBody, "A text part is generated from the HTML")
+	assert.Equal(t, "Hello Bob", bulk.To[1].MergeData["RelaySubject"])
+	assert.Equal(t, "<p>Hi Bob</p>", bulk.To[1].MergeData["RelayHtml"])
+	assert.Equal(t, "Hi Bob", bulk.To[1].MergeData["RelayText"])
+	assert.Equal(t, "other@example.com", bulks[1].message.From.EmailAddress)
+}
+
+func TestPrepareSocketLabsBulkMessagesOverLimit(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "sender@example.com"},
+		Content: []Content{{Type: "text/plain", Value: "Hi"}},
+		Subject: "Hello",
+	}
+	count := socketLabsBulkLimit*2 + 500
+	indexes := make([]int, count)
+	for i := range indexes {
+		emailMessage.Personalizations = append(emailMessage.Personalizations, Personalization{
+			To: EmailAddressList{{Email: fmt.Sprintf("r%d@example.com", i)}},
+		})
+		indexes[i] = i
+	}
+	results := newSendResults(count)
+
+	bulks := prepareSocketLabsBulkMessages(emailMessage, indexes, results)
+
+	assert.Len(t, bulks, 3)
+	sent := make(map[int]int)
+	for _, bulk := range bulks {
+		assert.LessOrEqual(t, len(bulk.indexes), socketLabsBulkLimit)
+		assert.Equal(t, len(bulk.indexes), len(bulk.message.To))
+		for k, i := range bulk.indexes {
+			sent[i]++
+			assert.Equal(t, fmt.Sprintf("r%d@example.com", i), bulk.message.To[k].Email)
+		}
+	}
+	for i := 0; i < count; i++ {
+		if sent[i] != 1 {
+			t.Errorf("Expected recipient %d in exactly one bulk message, got %d", i, sent[i])
+		}
+	}
+}
+
+func TestPrepareSocketLabsBulkMessagesRecipientHeaders(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "sender@example.com"},
+		Content: []Content{{Type: "text/plain", Value: "Hi"}},
+		Subject: "Hello",
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "a@example.com"}}, recipientHeaders: map[string]string{"List-Unsubscribe": "<https://unsub.example.com/a>"}},
+			{To: EmailAddressList{{Email: "b@example.com"}}, recipientHeaders: map[string]string{"List-Unsubscribe": "<https://unsub.example.com/b>"}},
+		},
+	}
+	results := newSendResults(2)
+
+	bulks := prepareSocketLabsBulkMessages(emailMessage, []int{0, 1}, results)
+
+	assert.Len(t, bulks, 1, "Recipient headers do not split the bulk message")
+	bulk := bulks[0].message
+	assert.Contains(t, bulk.CustomHeaders, message.CustomHeader{Name: "List-Unsubscribe", Value: "%%RelayHeaderListUnsubscribe%%"})
+	assert.Equal(t, "<https://unsub.example.com/a>", bulk.To[0].MergeData["RelayHeaderListUnsubscribe"])
+	assert.Equal(t, "<https://unsub.example.com/b>", bulk.To[1].MergeData["RelayHeaderListUnsubscribe"])
+}
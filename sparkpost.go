@@ -1,24 +1,42 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"regexp"
-	"strings"
 
 	sp "github.com/SparkPost/gosparkpost"
 )
 
-func SendEmailWithSparkPost(emailMessage EmailMessage) {
+// Substitution data keys carrying each recipient's rendered content.
+const (
+	renderedSubjectKey = "rendered_subject"
+	renderedHTMLKey    = "rendered_html"
+	renderedTextKey    = "rendered_text"
+)
+
+// Substitution data keys carrying the sender for synced stored templates.
+const (
+	templateFromEmailKey = "relay_from_email"
+	templateFromNameKey  = "relay_from_name"
+)
+
+// sparkPostRecipientLimit is the most recipients sent in one transmission,
+// the size SparkPost recommends for a transmission.
+const sparkPostRecipientLimit = 10000
+
+// SendEmailWithSparkPost sends the personalizations in one transmission per
+// sender, reply-to, headers and Cc addresses, split again when some recipients use a
+// stored template or a group exceeds sparkPostRecipientLimit, and reports
+// the outcome of each personalization.
+func SendEmailWithSparkPost(emailMessage EmailMessage) sendResults {
+	results := newSendResults(len(emailMessage.Personalizations))
 	apiKey := emailMessage.Credentials.SparkpostAPIKey
 	if apiKey == "" {
-		log.Fatal("Missing SparkPost API key in credentials")
+		results.setAll(allIndexes(results), fmt.Errorf("missing SparkPost API key in credentials"))
+		return results
 	}
 
-	errorHandler := NewSparkPostErrorHandler()
-
 	cfg := &sp.Config{
 		BaseUrl:    "https://api.sparkpost.com",
 		ApiKey:     apiKey,
@@ -27,104 +45,160 @@ func SendEmailWithSparkPost(emailMessage EmailMessage) {
 	var client sp.Client
 	err := client.Init(cfg)
 	if err != nil {
-		log.Fatalf("SparkPost client init failed: %s\n", err)
+		results.setAll(allIndexes(results), fmt.Errorf("SparkPost client init failed: %v", err))
+		return results
 	}
 
-	globalSubstitutionData := make(map[string]string)
-	for key, value := range emailMessage.Sections {
-		// Remove hyphens from keys
-		cleanKey := strings.Trim(key, "-")
+	renderer, err := newMessageRenderer(emailMessage)
+	if err != nil {
+		results.setAll(allIndexes(results), fmt.Errorf("failed to parse email templates: %v", err))
+		return results
+	}
 
-		// Replace leading and trailing '-' with '{{' and '}}' in the value
-		re := regexp.MustCompile(`-(\w+)-`)
-		updatedValue := re.ReplaceAllString(value, "{{$1}}")
+	// A transmission has one sender and one set of headers, Cc included, so
+	// recipients are grouped by the parts of their envelope a transmission
+	// shares
+	var order []string
+	groups := make(map[string][]int)
+	envelopes := make(map[string]envelope)
+	for i, p := range emailMessage.Personalizations {
+		env := emailMessage.envelopeFor(p)
+		key := env.groupKey() + formatAddressList(env.Cc)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+			envelopes[key] = env
+		}
+		groups[key] = append(groups[key], i)
+	}
 
-		globalSubstitutionData[cleanKey] = updatedValue
+	recipients := func(i int) int {
+		p := emailMessage.Personalizations[i]
+		return len(p.To) + len(p.Cc) + len(p.Bcc)
+	}
+	for _, key := range order {
+		for _, chunk := range chunkRecipients(groups[key], recipients, sparkPostRecipientLimit) {
+			sendSparkPostTransmissions(&client, emailMessage, renderer, envelopes[key], chunk, results)
+		}
 	}
+	return results
+}
 
-	// Prepare recipients and substitution data
-	recipients := make([]sp.Recipient, len(emailMessage.Personalizations))
-	for i, p := range emailMessage.Personalizations {
+// sendSparkPostTransmissions sends the personalizations at indexes, which
+// share env, and records their outcome in results. Content and recipient
+// headers are rendered locally for each recipient and passed to SparkPost as
+// substitution data, so one transmission still covers every recipient.
+// Recipients of a synced stored template get its data instead, in a second
+// transmission; stored templates carry no attachments, custom headers, Cc
+// header or reply-to, and carry the List-Unsubscribe headers only when synced for a
+// user with List-Unsubscribe enabled.
+func sendSparkPostTransmissions(client *sp.Client, emailMessage EmailMessage, renderer *messageRenderer, env envelope, indexes []int, results sendResults) {
+	errorHandler := NewSparkPostErrorHandler()
+	canUseNative := len(emailMessage.Attachments) == 0 && len(env.Headers) == 0 && len(env.Cc) == 0 && env.ReplyTo.Email == "" &&
+		equalStrings(env.recipientHeaderNames(), sparkPostTemplateHeaderNames(emailMessage.nativeTemplateID))
 
-		recipientSubstitutions := make(map[string]interface{})
-
-		for key, value := range p.Substitutions {
-			// Check if the value matches a key in globalSubstitutionData
-			if sectionContent, exists := globalSubstitutionData[value]; exists {
-				// Process placeholders in the section content using the recipient's substitutions
-				processedContent := processPlaceholders(sectionContent, p.Substitutions)
-				recipientSubstitutions[key] = processedContent
-			} else {
-				// If no match found, use the original value
-				recipientSubstitutions[key] = value
+	// Each personalization may add several recipients
+	var recipients, nativeRecipients []sp.Recipient
+	var rendered, native []int
+	nativeTemplateID := ""
+	hasHTML, hasText := false, false
+	for _, i := range indexes {
+		p := emailMessage.Personalizations[i]
+		if templateID, ok := emailMessage.nativeTemplateFor(p); ok && canUseNative {
+			substitutionData := personalizationData(p)
+			substitutionData[templateFromEmailKey] = env.From.Email
+			substitutionData[templateFromNameKey] = env.From.Name
+			for name, value := range p.recipientHeaders {
+				substitutionData[recipientHeaderField(name)] = value
 			}
+			nativeRecipients = append(nativeRecipients, sparkPostRecipients(emailMessage, p, substitutionData)...)
+			nativeTemplateID = templateID
+			native = append(native, i)
+			continue
 		}
 
-		// Process placeholders in the substitution values
-		// for key, value := range recipientSubstitutions {
-		// 	if strValue, ok := value.(string); ok {
-		// 		recipientSubstitutions[key] = processPlaceholders(strValue, p.Substitutions)
-		// 	}
-		// }
-
-		recipients[i] = sp.Recipient{
-			Address: sp.Address{
-				Email: p.To.Email,
-				Name:  p.To.Name,
-			},
-			SubstitutionData: recipientSubstitutions,
+		subject, renderedContent, err := renderer.Render(p)
+		if err != nil {
+			results[i] = fmt.Errorf("failed to render email for %s: %v", p.primaryRecipient().Email, err)
+			log.Println(results[i])
+			continue
 		}
+
+		substitutionData := map[string]interface{}{renderedSubjectKey: subject}
+		for name, value := range p.recipientHeaders {
+			substitutionData[recipientHeaderField(name)] = value
+		}
+		if html := getContentByType(renderedContent, "text/html"); html != "" {
+			substitutionData[renderedHTMLKey] = html
+			hasHTML = true
+		}
+		if text := getContentByType(renderedContent, "text/plain"); text != "" {
+			substitutionData[renderedTextKey] = text
+			hasText = true
+		}
+
+		recipients = append(recipients, sparkPostRecipients(emailMessage, p, substitutionData)...)
+		rendered = append(rendered, i)
 	}
 
-	// Add CC and BCC recipients
-	for _, cc := range emailMessage.Cc {
-		recipients = append(recipients, sp.Recipient{Address: sp.Address{Email: cc}})
+	if len(native) > 0 {
+		tx := &sp.Transmission{
+			Recipients: nativeRecipients,
+			Content:    map[string]string{"template_id": nativeTemplateID},
+			CampaignID: emailMessage.primaryTag(),
+			Options:    sparkPostOptions(emailMessage.Tracking),
+		}
+		id, res, err := client.Send(tx)
+		if err != nil {
+			errorHandler.HandleSendError(id, res, err)
+		}
+		results.setAll(native, err)
 	}
-	for _, bcc := range emailMessage.Bcc {
-		recipients = append(recipients, sp.Recipient{Address: sp.Address{Email: bcc}})
+	if len(rendered) == 0 {
+		return
 	}
 
-	// Prepare attachments
-	attachments := make([]sp.Attachment, len(emailMessage.Attachments))
-	for i, att := range emailMessage.Attachments {
-		content, err := base64.StdEncoding.DecodeString(att.Content)
-		if err != nil {
-			log.Printf("Failed to decode attachment content: %v", err)
+	// SparkPost takes attachment content as base64. Inline images are named
+	// after the content ID the HTML references.
+	var attachments []sp.Attachment
+	var inlineImages []sp.InlineImage
+	for _, att := range emailMessage.Attachments {
+		if att.inline() {
+			inlineImages = append(inlineImages, sp.InlineImage{
+				Filename: att.ContentID,
+				MIMEType: att.Type,
+				B64Data:  att.Content,
+			})
 			continue
 		}
-		attachments[i] = sp.Attachment{
-			Filename: att.Filename,
+		attachments = append(attachments, sp.Attachment{
+			Filename: att.filename(),
 			MIMEType: att.Type,
-			B64Data:  string(content),
-		}
+			B64Data:  att.Content,
+		})
 	}
 
-	// Prepare content
-	htmlContent := ""
-	textContent := ""
-	for _, content := range emailMessage.Content {
-		// Use the first personalization's substitutions for processing placeholders
-		re := regexp.MustCompile(`-(\w+)-`)
-		updatedValue := re.ReplaceAllString(content.Value, "{{$1}}")
-		if content.Type == "text/html" {
-			htmlContent = updatedValue
-		} else if content.Type == "text/plain" {
-			textContent = updatedValue
-		}
+	// Triple braces stop SparkPost from escaping the rendered content again
+	content := sp.Content{
+		From:         sp.Address{Email: env.From.Email, Name: env.From.Name},
+		ReplyTo:      formatAddress(env.ReplyTo),
+		Subject:      "{{{" + renderedSubjectKey + "}}}",
+		Headers:      sparkPostHeaders(env),
+		Attachments:  attachments,
+		InlineImages: inlineImages,
+	}
+	if hasHTML {
+		content.HTML = "{{{" + renderedHTMLKey + "}}}"
+	}
+	if hasText {
+		content.Text = "{{{" + renderedTextKey + "}}}"
 	}
 
 	// Create a Transmission
 	tx := &sp.Transmission{
 		Recipients: recipients,
-		Content: sp.Content{
-			From:        sp.Address{Email: emailMessage.From.Email, Name: emailMessage.From.Name},
-			Subject:     emailMessage.Subject,
-			HTML:        htmlContent,
-			Text:        textContent,
-			Headers:     emailMessage.Headers,
-			Attachments: attachments,
-		},
-		SubstitutionData: globalSubstitutionData,
+		Content:    content,
+		CampaignID: emailMessage.primaryTag(),
+		Options:    sparkPostOptions(emailMessage.Tracking),
 	}
 
 	// Send the email
@@ -132,18 +206,119 @@ func SendEmailWithSparkPost(emailMessage EmailMessage) {
 	if err != nil {
 		errorHandler.HandleSendError(id, res, err)
 	}
+	results.setAll(rendered, err)
+}
+
+// sparkPostHeaders returns the headers of a transmission: the shared headers,
+// the Cc header listing the visible copies, and substitutions that fill in
+// each recipient's recipient headers.
+func sparkPostHeaders(env envelope) map[string]string {
+	if len(env.RecipientHeaders) == 0 && len(env.Cc) == 0 {
+		return env.Headers
+	}
+	headers := make(map[string]string, len(env.Headers)+len(env.RecipientHeaders)+1)
+	for key, value := range env.Headers {
+		headers[key] = value
+	}
+	if len(env.Cc) > 0 {
+		headers["Cc"] = formatAddressList(env.Cc)
+	}
+	for name := range env.RecipientHeaders {
+		headers[name] = "{{{" + recipientHeaderField(name) + "}}}"
+	}
+	return headers
+}
+
+// sparkPostRecipients addresses a personalization: every To, Cc and Bcc
+// address is a recipient with the same content, and all of them show the To
+// addresses in the To header and the Cc addresses in the Cc header. Custom arguments and the correlation ID become
+// recipient metadata, which SparkPost returns in its events as rcpt_meta.
+func sparkPostRecipients(emailMessage EmailMessage, p Personalization, substitutionData map[string]interface{}) []sp.Recipient {
+	var metadata interface{}
+	args := emailMessage.envelopeFor(p).CustomArgs
+	if id := emailMessage.correlationID(p); id != "" {
+		withID := make(map[string]interface{}, len(args)+1)
+		for key, value := range args {
+			withID[key] = value
+		}
+		withID[correlationKey] = id
+		args = withID
+	}
+	if len(args) > 0 {
+		metadata = args
+	}
+	headerTo := ""
+	if len(p.To)+len(p.Cc)+len(p.Bcc) > 1 {
+		headerTo = formatAddressList(p.To)
+	}
+
+	recipients := make([]sp.Recipient, 0, len(p.To)+len(p.Cc)+len(p.Bcc))
+	for _, addresses := range [][]EmailAddress{p.To, p.Cc, p.Bcc} {
+		for _, address := range addresses {
+			recipients = append(recipients, sp.Recipient{
+				Address:          sp.Address{Email: address.Email, Name: address.Name, HeaderTo: headerTo},
+				SubstitutionData: substitutionData,
+				Metadata:         metadata,
+				Tags:             emailMessage.tags(),
+			})
+		}
+	}
+	return recipients
+}
 
+// sparkPostOptions returns the transmission options for the tracking
+// toggles that are set, or nil to use the account defaults.
+func sparkPostOptions(tracking Tracking) *sp.TxOptions {
+	if tracking.Opens == nil && tracking.Clicks == nil {
+		return nil
+	}
+	return &sp.TxOptions{TmplOptions: sp.TmplOptions{
+		OpenTracking:  tracking.Opens,
+		ClickTracking: tracking.Clicks,
+	}}
 }
 
-func processPlaceholders(content string, substitutions map[string]string) string {
-	re := regexp.MustCompile(`\{\{(.*?)\}\}`)
-	return re.ReplaceAllStringFunc(content, func(match string) string {
-		placeholder := strings.Trim(match, "{}")
-		if substitutionValue, exists := substitutions[placeholder]; exists {
-			return substitutionValue
+// createSparkPostTemplate publishes a stored template under id and returns
+// the ID SparkPost assigned. The sender and the named headers are filled in
+// from substitution data since they are chosen per message and recipient.
+func createSparkPostTemplate(apiKey, id string, content nativeTemplateContent, headerNames []string) (string, error) {
+	var client sp.Client
+	err := client.Init(&sp.Config{
+		BaseUrl:    "https://api.sparkpost.com",
+		ApiKey:     apiKey,
+		ApiVersion: 1,
+	})
+	if err != nil {
+		return "", fmt.Errorf("SparkPost client init failed: %v", err)
+	}
+
+	var headers map[string]string
+	if len(headerNames) > 0 {
+		headers = make(map[string]string, len(headerNames))
+		for _, name := range headerNames {
+			headers[name] = "{{{" + recipientHeaderField(name) + "}}}"
 		}
-		return match
+	}
+
+	created, _, err := client.TemplateCreate(&sp.Template{
+		ID:   id,
+		Name: content.Name,
+		Content: sp.Content{
+			From: sp.Address{
+				Email: "{{" + templateFromEmailKey + "}}",
+				Name:  "{{" + templateFromNameKey + "}}",
+			},
+			Subject: content.Subject,
+			HTML:    content.HtmlBody,
+			Text:    content.TextBody,
+			Headers: headers,
+		},
+		Published: true,
 	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create SparkPost template: %v", err)
+	}
+	return created, nil
 }
 
 func printSPMessageStructure(message *sp.Transmission) {
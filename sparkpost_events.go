@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/IBM/sarama"
 )
@@ -63,6 +64,14 @@ func standardizeSparkPostEvent(event struct {
 	standardEvent.MessageID = commonFields.MessageID
 	standardEvent.Provider = "sparkpost"
 	standardEvent.Processed = true
+	standardEvent.CorrelationID = metadataString(commonFields.RcptMeta, correlationKey)
+
+	domain := commonFields.RecipientDomain
+	if domain == "" {
+		domain = recipientDomain(commonFields.RcptTo)
+	}
+	standardEvent.RecipientDomain = strings.ToLower(domain)
+	standardEvent.MailboxProvider = mailboxProviderGroup(domain, commonFields.MailboxProvider)
 
 	timestamp, _ := strconv.ParseInt(commonFields.Timestamp, 10, 64)
 	standardEvent.ProcessedTime = timestamp
@@ -90,10 +99,16 @@ func standardizeSparkPostEvent(event struct {
 			standardEvent.UniqueOpen = true
 			standardEvent.UniqueOpenTime = &timestamp
 		}
+	case "click":
+		standardEvent.Click = true
+		standardEvent.ClickCount = 1
+		standardEvent.LastClickTime = &timestamp
 	case "spam_complaint":
 		standardEvent.Dropped = true
 		standardEvent.DroppedTime = &timestamp
 		standardEvent.DroppedReason = "Spam Complaint"
+		standardEvent.SpamReport = true
+		standardEvent.SpamReportTime = &timestamp
 	}
 
 	return standardEvent
@@ -121,47 +136,45 @@ type UserAgentParsed struct {
 }
 
 type CommonEventFields struct {
-	ABTestID              string `json:"ab_test_id"`
-	ABTestVersion         string `json:"ab_test_version"`
-	AmpEnabled            bool   `json:"amp_enabled"`
-	CampaignID            string `json:"campaign_id"`
-	ClickTracking         bool   `json:"click_tracking"`
-	CustomerID            string `json:"customer_id"`
-	DelvMethod            string `json:"delv_method"`
-	EventID               string `json:"event_id"`
-	FriendlyFrom          string `json:"friendly_from"`
-	InitialPixel          bool   `json:"initial_pixel"`
-	InjectionTime         string `json:"injection_time"`
-	IPAddress             string `json:"ip_address"`
-	IPPool                string `json:"ip_pool"`
-	MailboxProvider       string `json:"mailbox_provider"`
-	MailboxProviderRegion string `json:"mailbox_provider_region"`
-	MessageID             string `json:"message_id"`
-	MsgFrom               string `json:"msg_from"`
-	MsgSize               string `json:"msg_size"`
-	NumRetries            string `json:"num_retries"`
-	OpenTracking          bool   `json:"open_tracking"`
-	QueueTime             string `json:"queue_time"`
-	RcptMeta              struct {
-		CustomKey string `json:"customKey"`
-	} `json:"rcpt_meta"`
-	RcptTags        []string `json:"rcpt_tags"`
-	RcptTo          string   `json:"rcpt_to"`
-	RcptHash        string   `json:"rcpt_hash"`
-	RawRcptTo       string   `json:"raw_rcpt_to"`
-	RcptType        string   `json:"rcpt_type"`
-	RecipientDomain string   `json:"recipient_domain"`
-	RoutingDomain   string   `json:"routing_domain"`
-	ScheduledTime   string   `json:"scheduled_time"`
-	SendingIP       string   `json:"sending_ip"`
-	SubaccountID    string   `json:"subaccount_id"`
-	Subject         string   `json:"subject"`
-	TemplateID      string   `json:"template_id"`
-	TemplateVersion string   `json:"template_version"`
-	Timestamp       string   `json:"timestamp"`
-	Transactional   string   `json:"transactional"`
-	TransmissionID  string   `json:"transmission_id"`
-	Type            string   `json:"type"`
+	ABTestID              string                 `json:"ab_test_id"`
+	ABTestVersion         string                 `json:"ab_test_version"`
+	AmpEnabled            bool                   `json:"amp_enabled"`
+	CampaignID            string                 `json:"campaign_id"`
+	ClickTracking         bool                   `json:"click_tracking"`
+	CustomerID            string                 `json:"customer_id"`
+	DelvMethod            string                 `json:"delv_method"`
+	EventID               string                 `json:"event_id"`
+	FriendlyFrom          string                 `json:"friendly_from"`
+	InitialPixel          bool                   `json:"initial_pixel"`
+	InjectionTime         string                 `json:"injection_time"`
+	IPAddress             string                 `json:"ip_address"`
+	IPPool                string                 `json:"ip_pool"`
+	MailboxProvider       string                 `json:"mailbox_provider"`
+	MailboxProviderRegion string                 `json:"mailbox_provider_region"`
+	MessageID             string                 `json:"message_id"`
+	MsgFrom               string                 `json:"msg_from"`
+	MsgSize               string                 `json:"msg_size"`
+	NumRetries            string                 `json:"num_retries"`
+	OpenTracking          bool                   `json:"open_tracking"`
+	QueueTime             string                 `json:"queue_time"`
+	RcptMeta              map[string]interface{} `json:"rcpt_meta"`
+	RcptTags              []string               `json:"rcpt_tags"`
+	RcptTo                string                 `json:"rcpt_to"`
+	RcptHash              string                 `json:"rcpt_hash"`
+	RawRcptTo             string                 `json:"raw_rcpt_to"`
+	RcptType              string                 `json:"rcpt_type"`
+	RecipientDomain       string                 `json:"recipient_domain"`
+	RoutingDomain         string                 `json:"routing_domain"`
+	ScheduledTime         string                 `json:"scheduled_time"`
+	SendingIP             string                 `json:"sending_ip"`
+	SubaccountID          string                 `json:"subaccount_id"`
+	Subject               string                 `json:"subject"`
+	TemplateID            string                 `json:"template_id"`
+	TemplateVersion       string                 `json:"template_version"`
+	Timestamp             string                 `json:"timestamp"`
+	Transactional         string                 `json:"transactional"`
+	TransmissionID        string                 `json:"transmission_id"`
+	Type                  string                 `json:"type"`
 }
 
 type MessageEvent struct {
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The template language is a small subset of Handlebars, rendered locally so
+// every provider receives identical content:
+//
+//	{{name}}                      value, HTML-escaped in HTML content
+//	{{{name}}}                    value, never escaped
+//	{{name | default "friend"}}   value, or the default when missing or empty
+//	{{user.first_name}}           nested template data
+//	{{#if name}}..{{else}}..{{/if}}
+//	{{#unless name}}..{{/unless}}
+//	{{#each items}}{{this}} {{@index}} {{field}}{{/each}}
+//	{{> section}}                 a section of the message, rendered in place
+//	{{! comment }}
+//
+// For compatibility with existing content, -name- is also a placeholder when
+// name is a known value or section; otherwise it is left as written. A value
+// that names a section, as in SendGrid's sections, renders that section.
+
+// maxSectionDepth bounds section nesting, which also stops sections that
+// include themselves.
+const maxSectionDepth = 10
+
+// Template is a parsed template.
+type Template struct {
+	nodes []templateNode
+}
+
+type templateNode interface {
+	render(r *templateRenderer, scope *templateScope, b *strings.Builder) error
+}
+
+type textNode string
+
+type variableNode struct {
+	path   string
+	raw    bool
+	def    *string
+	legacy bool
+}
+
+type blockNode struct {
+	kind     string
+	path     string
+	body     []templateNode
+	elseBody []templateNode
+}
+
+type sectionNode struct {
+	name string
+}
+
+var legacyPlaceholder = regexp.MustCompile(`-([A-Za-z_][A-Za-z0-9_.]*)-`)
+
+// ParseTemplate parses src.
+func ParseTemplate(src string) (*Template, error) {
+	p := &templateParser{src: src}
+	nodes, _, err := p.parseNodes("")
+	if err != nil {
+		return nil, err
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+type templateParser struct {
+	src string
+	pos int
+}
+
+// parseNodes parses until the end of the template or, inside a block, until
+// its {{else}} or closing tag, which is returned as the terminator.
+func (p *templateParser) parseNodes(block string) ([]templateNode, string, error) {
+	var nodes []templateNode
+	for p.pos < len(p.src) {
+		start := strings.Index(p.src[p.pos:], "{{")
+		if start < 0 {
+			nodes = append(nodes, parseText(p.src[p.pos:])...)
+			p.pos = len(p.src)
+			break
+		}
+		nodes = append(nodes, parseText(p.src[p.pos:p.pos+start])...)
+		p.pos += start
+
+		open, close := "{{", "}}"
+		raw := strings.HasPrefix(p.src[p.pos:], "{{{")
+		if raw {
+			open, close = "{{{", "}}}"
+		}
+		end := strings.Index(p.src[p.pos+len(open):], close)
+		if end < 0 {
+			return nil, "", fmt.Errorf("unclosed tag at offset %d", p.pos)
+		}
+		tag := strings.TrimSpace(p.src[p.pos+len(open) : p.pos+len(open)+end])
+		p.pos += len(open) + end + len(close)
+
+		switch {
+		case raw:
+			node, err := parseVariable(tag, true)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+		case strings.HasPrefix(tag, "!"):
+			// Comment
+		case strings.HasPrefix(tag, "#"):
+			fields := strings.Fields(tag[1:])
+			if len(fields) != 2 {
+				return nil, "", fmt.Errorf("invalid block tag {{%s}}", tag)
+			}
+			kind, path := fields[0], fields[1]
+			if kind != "if" && kind != "unless" && kind != "each" {
+				return nil, "", fmt.Errorf("unknown block {{#%s}}", kind)
+			}
+			node := &blockNode{kind: kind, path: path}
+			var terminator string
+			var err error
+			node.body, terminator, err = p.parseNodes(kind)
+			if err != nil {
+				return nil, "", err
+			}
+			if terminator == "else" {
+				node.elseBody, terminator, err = p.parseNodes(kind)
+				if err != nil {
+					return nil, "", err
+				}
+				if terminator == "else" {
+					return nil, "", fmt.Errorf("duplicate {{else}} in {{#%s %s}}", kind, path)
+				}
+			}
+			nodes = append(nodes, node)
+		case tag == "else":
+			if block == "" {
+				return nil, "", fmt.Errorf("unexpected {{else}}")
+			}
+			return nodes, "else", nil
+		case strings.HasPrefix(tag, "/"):
+			name := strings.TrimSpace(tag[1:])
+			if name != block {
+				return nil, "", fmt.Errorf("unexpected {{/%s}}", name)
+			}
+			return nodes, "/" + name, nil
+		case strings.HasPrefix(tag, ">"):
+			name := strings.TrimSpace(tag[1:])
+			if name == "" {
+				return nil, "", fmt.Errorf("missing section name in {{%s}}", tag)
+			}
+			nodes = append(nodes, sectionNode{name: name})
+		default:
+			node, err := parseVariable(tag, false)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	if block != "" {
+		return nil, "", fmt.Errorf("unclosed {{#%s}}", block)
+	}
+	return nodes, "", nil
+}
+
+// parseText splits literal text around legacy -name- placeholders.
+func parseText(text string) []templateNode {
+	var nodes []templateNode
+	last := 0
+	for _, match := range legacyPlaceholder.FindAllStringSubmatchIndex(text, -1) {
+		if match[0] > last {
+			nodes = append(nodes, textNode(text[last:match[0]]))
+		}
+		nodes = append(nodes, variableNode{path: text[match[2]:match[3]], legacy: true})
+		last = match[1]
+	}
+	if last < len(text) {
+		nodes = append(nodes, textNode(text[last:]))
+	}
+	return nodes
+}
+
+func parseVariable(tag string, raw bool) (templateNode, error) {
+	path, filter, hasFilter := strings.Cut(tag, "|")
+	path = strings.TrimSpace(path)
+	if path == "" || strings.ContainsAny(path, " \t\n") {
+		return nil, fmt.Errorf("invalid placeholder {{%s}}", tag)
+	}
+
+	node := variableNode{path: path, raw: raw}
+	if hasFilter {
+		filter = strings.TrimSpace(filter)
+		if !strings.HasPrefix(filter, "default") {
+			return nil, fmt.Errorf("unknown filter in {{%s}}", tag)
+		}
+		value, err := strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(filter, "default")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid default value in {{%s}}", tag)
+		}
+		node.def = &value
+	}
+	return node, nil
+}
+
+// templateRenderer holds what is shared by one rendering of a template.
+type templateRenderer struct {
+	html     bool
+	sections map[string]*Template
+	depth    int
+	// missing, when set, collects the variables rendered empty for lack of
+	// a value
+	missing map[string]bool
+}
+
+// templateScope is the value a lookup starts from. {{#each}} pushes a scope
+// per item so names not found on the item resolve against outer scopes.
+type templateScope struct {
+	value  interface{}
+	index  int
+	parent *templateScope
+}
+
+// Execute renders the template with data. In HTML mode values are escaped.
+// sections are the named templates available to {{> name}}.
+func (t *Template) Execute(data map[string]interface{}, sections map[string]*Template, htmlMode bool) (string, error) {
+	r := &templateRenderer{html: htmlMode, sections: sections}
+	var b strings.Builder
+	if err := r.renderNodes(t.nodes, &templateScope{value: data}, &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// MissingValues returns the variables that would render empty because data
+// has no value for them and they have no default. Variables in branches that
+// are not taken are not reported.
+func (t *Template) MissingValues(data map[string]interface{}, sections map[string]*Template) ([]string, error) {
+	r := &templateRenderer{sections: sections, missing: make(map[string]bool)}
+	var b strings.Builder
+	if err := r.renderNodes(t.nodes, &templateScope{value: data}, &b); err != nil {
+		return nil, err
+	}
+	missing := make([]string, 0, len(r.missing))
+	for path := range r.missing {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func (r *templateRenderer) renderNodes(nodes []templateNode, scope *templateScope, b *strings.Builder) error {
+	for _, node := range nodes {
+		if err := node.render(r, scope, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *templateRenderer) renderSection(name string, scope *templateScope, b *strings.Builder) error {
+	section, ok := r.sections[name]
+	if !ok {
+		return fmt.Errorf("unknown section %q", name)
+	}
+	if r.depth >= maxSectionDepth {
+		return fmt.Errorf("sections nested more than %d deep at %q", maxSectionDepth, name)
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	return r.renderNodes(section.nodes, scope, b)
+}
+
+func (n textNode) render(r *templateRenderer, scope *templateScope, b *strings.Builder) error {
+	b.WriteString(string(n))
+	return nil
+}
+
+func (n variableNode) render(r *templateRenderer, scope *templateScope, b *strings.Builder) error {
+	value, found := scope.lookup(n.path)
+	if found {
+		if name, ok := value.(string); ok {
+			if _, isSection := r.sections[name]; isSection {
+				return r.renderSection(name, scope, b)
+			}
+		}
+	}
+
+	text := ""
+	if found && value != nil {
+		text = stringifyTemplateValue(value)
+	}
+	if text == "" {
+		switch {
+		case n.def != nil:
+			text = *n.def
+		case r.sections[n.path] != nil:
+			return r.renderSection(n.path, scope, b)
+		case n.legacy && !found:
+			b.WriteString("-" + n.path + "-")
+			return nil
+		case !found && r.missing != nil:
+			r.missing[n.path] = true
+		}
+	}
+
+	if r.html && !n.raw {
+		text = html.EscapeString(text)
+	}
+	b.WriteString(text)
+	return nil
+}
+
+func (n *blockNode) render(r *templateRenderer, scope *templateScope, b *strings.Builder) error {
+	value, _ := scope.lookup(n.path)
+	switch n.kind {
+	case "if":
+		if truthy(value) {
+			return r.renderNodes(n.body, scope, b)
+		}
+		return r.renderNodes(n.elseBody, scope, b)
+	case "unless":
+		if !truthy(value) {
+			return r.renderNodes(n.body, scope, b)
+		}
+		return r.renderNodes(n.elseBody, scope, b)
+	default:
+		items, _ := value.([]interface{})
+		if len(items) == 0 {
+			return r.renderNodes(n.elseBody, scope, b)
+		}
+		for i, item := range items {
+			if err := r.renderNodes(n.body, &templateScope{value: item, index: i, parent: scope}, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (n sectionNode) render(r *templateRenderer, scope *templateScope, b *strings.Builder) error {
+	return r.renderSection(n.name, scope, b)
+}
+
+// lookup resolves a dotted path. The first segment is looked up in the
+// innermost scope that has it.
+func (s *templateScope) lookup(path string) (interface{}, bool) {
+	if path == "this" || path == "." {
+		return s.value, true
+	}
+	if path == "@index" {
+		return float64(s.index), true
+	}
+
+	segments := strings.Split(path, ".")
+	var value interface{}
+	found := false
+	if segments[0] == "this" {
+		value, found = s.value, true
+	} else {
+		for scope := s; scope != nil; scope = scope.parent {
+			if m, ok := scope.value.(map[string]interface{}); ok {
+				if v, ok := m[segments[0]]; ok {
+					value, found = v, true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	for _, segment := range segments[1:] {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func stringifyTemplateValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// parseSectionsDynamic normalizes section names written as -name- or
+// {{name}} to name.
+func parseSectionsDynamic(sections map[string]string) map[string]string {
+	parsedSections := make(map[string]string)
+	for key, value := range sections {
+		parsedSections[strings.Trim(key, "-{}")] = value
+	}
+	return parsedSections
+}
+
+// parseSections parses the sections of a message, in name order so errors are
+// reported deterministically.
+func parseSections(sections map[string]string) (map[string]*Template, error) {
+	normalized := parseSectionsDynamic(sections)
+	names := make([]string, 0, len(normalized))
+	for name := range normalized {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parsed := make(map[string]*Template, len(names))
+	for _, name := range names {
+		t, err := ParseTemplate(normalized[name])
+		if err != nil {
+			return nil, fmt.Errorf("section %q: %v", name, err)
+		}
+		parsed[name] = t
+	}
+	return parsed, nil
+}
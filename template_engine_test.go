@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTemplateExecute(t *testing.T) {
+	data := map[string]interface{}{
+		"name":    "Jane",
+		"company": "Smith & Sons",
+		"premium": true,
+		"items": []interface{}{
+			map[string]interface{}{"title": "Boots", "price": 80.5},
+			map[string]interface{}{"title": "Socks", "price": 5.0},
+		},
+		"user": map[string]interface{}{"city": "Lisbon"},
+	}
+	sections := map[string]string{
+		"-footer-":    "Sent to {{name}}. {{> legal}}",
+		"{{legal}}":   "Reply STOP to opt out.",
+		"greeting":    "Hi {{name}}",
+		"self":        "{{> self}}",
+		"unknownsect": "{{missing | default \"n/a\"}}",
+	}
+	parsedSections, err := parseSections(sections)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing sections: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		src      string
+		html     bool
+		expected string
+	}{
+		{"Variable", "Hello {{name}}", false, "Hello Jane"},
+		{"Escaped in HTML", "<b>{{company}}</b>", true, "<b>Smith &amp; Sons</b>"},
+		{"Raw in HTML", "<b>{{{company}}}</b>", true, "<b>Smith & Sons</b>"},
+		{"Not escaped in text", "{{company}}", false, "Smith & Sons"},
+		{"Default", "Hi {{nickname | default \"friend\"}}", false, "Hi friend"},
+		{"Nested data", "{{user.city}}", false, "Lisbon"},
+		{"If", "{{#if premium}}Gold{{else}}Basic{{/if}}", false, "Gold"},
+		{"Unless", "{{#unless premium}}Upgrade{{else}}Thanks{{/unless}}", false, "Thanks"},
+		{"Else of missing value", "{{#if missing}}yes{{else}}no{{/if}}", false, "no"},
+		{"Each", "{{#each items}}{{@index}}:{{title}} {{price}} ({{name}});{{/each}}", false, "0:Boots 80.5 (Jane);1:Socks 5 (Jane);"},
+		{"Empty each", "{{#each missing}}x{{else}}none{{/each}}", false, "none"},
+		{"Nested sections", "{{> footer}}", false, "Sent to Jane. Reply STOP to opt out."},
+		{"Section by name", "{{greeting}}!", false, "Hi Jane!"},
+		{"Legacy placeholder", "Dear -name-, see -greeting-", false, "Dear Jane, see Hi Jane"},
+		{"Unknown legacy placeholder is kept", "a well-known-fact", false, "a well-known-fact"},
+		{"Comment", "a{{! ignored }}b", false, "ab"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tc.src)
+			if err != nil {
+				t.Fatalf("Unexpected parse error: %v", err)
+			}
+			got, err := tmpl.Execute(data, parsedSections, tc.html)
+			if err != nil {
+				t.Fatalf("Unexpected render error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	tmpl, _ := ParseTemplate("{{> self}}")
+	if _, err := tmpl.Execute(data, parsedSections, false); err == nil {
+		t.Error("Expected an error for a section that includes itself")
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, src := range []string{
+		"{{#if premium}}no end",
+		"{{/if}}",
+		"{{#if a}}{{/each}}",
+		"{{#loop items}}{{/loop}}",
+		"{{name",
+		"{{name | upper}}",
+		"{{else}}",
+	} {
+		if _, err := ParseTemplate(src); err == nil {
+			t.Errorf("Expected a parse error for %q", src)
+		}
+	}
+}
+
+func TestMessageRendererIsIdenticalForEveryProvider(t *testing.T) {
+	emailMessage := EmailMessage{
+		From:    EmailAddress{Email: "sender@example.com"},
+		Subject: "Order {{order_id}}",
+		Content: []Content{
+			{Type: "text/plain", Value: "Hi {{name}}"},
+			{Type: "text/html", Value: "<p>Hi {{name}}</p>"},
+		},
+		Personalizations: []Personalization{
+			{To: EmailAddressList{{Email: "a@example.com"}}, Substitutions: map[string]string{"name": "<Ann>", "order_id": "7"}},
+		},
+		Credentials: Credentials{SocketLabsAPIKey: "key"},
+	}
+
+	postmark, _ := mapEmailMessageToPostmark(emailMessage, newSendResults(1))
+	socketlabs := prepareSocketLabsMessages(emailMessage)
+	if len(postmark) != 1 || len(socketlabs) != 1 {
+		t.Fatalf("Expected one message per provider, got %d and %d", len(postmark), len(socketlabs))
+	}
+
+	if postmark[0].Subject != "Order 7" || socketlabs[0].Subject != "Order 7" {
+		t.Errorf("Expected rendered subjects, got %q and %q", postmark[0].Subject, socketlabs[0].Subject)
+	}
+	if postmark[0].HtmlBody != "<p>Hi &lt;Ann&gt;</p>" || socketlabs[0].HtmlBody != postmark[0].HtmlBody {
+		t.Errorf("Expected identical escaped HTML, got %q and %q", postmark[0].HtmlBody, socketlabs[0].HtmlBody)
+	}
+	if postmark[0].TextBody != "Hi <Ann>" || socketlabs[0].PlainTextBody != postmark[0].TextBody {
+		t.Errorf("Expected identical text, got %q and %q", postmark[0].TextBody, socketlabs[0].PlainTextBody)
+	}
+}
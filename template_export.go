@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// templateDialect is the template language of a provider's native templates.
+type templateDialect int
+
+const (
+	// dialectHandlebars is used by SendGrid dynamic templates
+	dialectHandlebars templateDialect = iota
+	// dialectMustache is used by Postmark templates
+	dialectMustache
+	// dialectSparkPost is used by SparkPost stored templates
+	dialectSparkPost
+)
+
+// errUnsupportedTemplate means a template uses a construct the provider's
+// template language cannot express; such messages are rendered locally.
+var errUnsupportedTemplate = errors.New("template cannot be expressed in the provider's template language")
+
+// Export translates the template into a provider's template language so the
+// provider can render it from the same data. Sections are inlined. Inside
+// {{#each}}, names refer to fields of the current item, as they do in the
+// providers' languages.
+func (t *Template) Export(dialect templateDialect, sections map[string]*Template, htmlMode bool) (string, error) {
+	e := &templateExporter{dialect: dialect, sections: sections, html: htmlMode}
+	var b strings.Builder
+	if err := e.exportNodes(t.nodes, &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+type templateExporter struct {
+	dialect  templateDialect
+	sections map[string]*Template
+	html     bool
+	depth    int
+	loops    int
+}
+
+func (e *templateExporter) exportNodes(nodes []templateNode, b *strings.Builder) error {
+	for _, node := range nodes {
+		var err error
+		switch n := node.(type) {
+		case textNode:
+			b.WriteString(string(n))
+		case variableNode:
+			err = e.exportVariable(n, b)
+		case *blockNode:
+			err = e.exportBlock(n, b)
+		case sectionNode:
+			err = e.exportSection(n.name, b)
+		default:
+			err = errUnsupportedTemplate
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *templateExporter) exportSection(name string, b *strings.Builder) error {
+	section, ok := e.sections[name]
+	if !ok {
+		return fmt.Errorf("unknown section %q", name)
+	}
+	if e.depth >= maxSectionDepth {
+		return fmt.Errorf("sections nested more than %d deep at %q", maxSectionDepth, name)
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	return e.exportNodes(section.nodes, b)
+}
+
+// exportVariable writes a value. Defaults, legacy placeholders and names of
+// sections become a conditional that falls back to what the local engine
+// would render when the value is missing.
+func (e *templateExporter) exportVariable(n variableNode, b *strings.Builder) error {
+	value, err := e.value(n.path, n.raw)
+	if err != nil {
+		return err
+	}
+
+	var fallback func(b *strings.Builder) error
+	switch {
+	case n.def != nil:
+		text := *n.def
+		if e.html {
+			text = html.EscapeString(text)
+		}
+		fallback = func(b *strings.Builder) error { b.WriteString(text); return nil }
+	case e.sections[n.path] != nil:
+		fallback = func(b *strings.Builder) error { return e.exportSection(n.path, b) }
+	case n.legacy:
+		fallback = func(b *strings.Builder) error { b.WriteString("-" + n.path + "-"); return nil }
+	default:
+		b.WriteString(value)
+		return nil
+	}
+
+	return e.conditional(n.path, false, func(b *strings.Builder) error {
+		b.WriteString(value)
+		return nil
+	}, fallback, b)
+}
+
+func (e *templateExporter) exportBlock(n *blockNode, b *strings.Builder) error {
+	body := func(b *strings.Builder) error { return e.exportNodes(n.body, b) }
+	var elseBody func(b *strings.Builder) error
+	if len(n.elseBody) > 0 {
+		elseBody = func(b *strings.Builder) error { return e.exportNodes(n.elseBody, b) }
+	}
+
+	switch n.kind {
+	case "if":
+		return e.conditional(n.path, false, body, elseBody, b)
+	case "unless":
+		return e.conditional(n.path, true, body, elseBody, b)
+	}
+
+	// {{#each}}
+	path, err := e.name(n.path)
+	if err != nil {
+		return err
+	}
+	if e.dialect == dialectSparkPost && e.loops > 0 {
+		// SparkPost only exposes the innermost loop variable
+		return errUnsupportedTemplate
+	}
+
+	e.loops++
+	switch e.dialect {
+	case dialectHandlebars:
+		b.WriteString("{{#each " + path + "}}")
+		err = body(b)
+		if err == nil && elseBody != nil {
+			b.WriteString("{{else}}")
+			err = elseBody(b)
+		}
+		b.WriteString("{{/each}}")
+	case dialectMustache:
+		b.WriteString("{{#each " + path + "}}")
+		err = body(b)
+		b.WriteString("{{/each}}")
+	case dialectSparkPost:
+		b.WriteString("{{each " + path + "}}")
+		err = body(b)
+		b.WriteString("{{end}}")
+	}
+	e.loops--
+	if err != nil {
+		return err
+	}
+
+	if elseBody != nil && e.dialect != dialectHandlebars {
+		return e.conditional(n.path, true, elseBody, nil, b)
+	}
+	return nil
+}
+
+// conditional writes "if path then body else elseBody", inverted when negate
+// is set.
+func (e *templateExporter) conditional(path string, negate bool, body, elseBody func(b *strings.Builder) error, b *strings.Builder) error {
+	name, err := e.name(path)
+	if err != nil {
+		return err
+	}
+
+	switch e.dialect {
+	case dialectHandlebars:
+		block := "if"
+		if negate {
+			block = "unless"
+		}
+		b.WriteString("{{#" + block + " " + name + "}}")
+		if err := body(b); err != nil {
+			return err
+		}
+		if elseBody != nil {
+			b.WriteString("{{else}}")
+			if err := elseBody(b); err != nil {
+				return err
+			}
+		}
+		b.WriteString("{{/" + block + "}}")
+	case dialectMustache:
+		open, inverse := "{{#", "{{^"
+		if negate {
+			open, inverse = inverse, open
+		}
+		b.WriteString(open + name + "}}")
+		if err := body(b); err != nil {
+			return err
+		}
+		b.WriteString("{{/" + name + "}}")
+		if elseBody != nil {
+			b.WriteString(inverse + name + "}}")
+			if err := elseBody(b); err != nil {
+				return err
+			}
+			b.WriteString("{{/" + name + "}}")
+		}
+	case dialectSparkPost:
+		if negate {
+			b.WriteString("{{if not " + name + "}}")
+		} else {
+			b.WriteString("{{if " + name + "}}")
+		}
+		if err := body(b); err != nil {
+			return err
+		}
+		if elseBody != nil {
+			b.WriteString("{{else}}")
+			if err := elseBody(b); err != nil {
+				return err
+			}
+		}
+		b.WriteString("{{end}}")
+	}
+	return nil
+}
+
+// value returns the tag that writes path.
+func (e *templateExporter) value(path string, raw bool) (string, error) {
+	name, err := e.name(path)
+	if err != nil {
+		return "", err
+	}
+	if raw {
+		return "{{{" + name + "}}}", nil
+	}
+	return "{{" + name + "}}", nil
+}
+
+// name translates a path into the dialect.
+func (e *templateExporter) name(path string) (string, error) {
+	if path == "@index" {
+		if e.dialect == dialectHandlebars {
+			return path, nil
+		}
+		return "", errUnsupportedTemplate
+	}
+
+	field, isThis := strings.CutPrefix(path, "this")
+	if isThis && field != "" && !strings.HasPrefix(field, ".") {
+		// A name such as "thistle"
+		field, isThis = path, false
+	}
+	field = strings.TrimPrefix(field, ".")
+	if path == "." {
+		field, isThis = "", true
+	}
+
+	switch e.dialect {
+	case dialectMustache:
+		if isThis && field == "" {
+			return ".", nil
+		}
+		if isThis {
+			return field, nil
+		}
+	case dialectSparkPost:
+		if e.loops > 0 {
+			if isThis && field == "" {
+				return "loop_var", nil
+			}
+			if isThis {
+				return "loop_var." + field, nil
+			}
+			return "loop_var." + path, nil
+		}
+		if isThis {
+			return "", errUnsupportedTemplate
+		}
+	}
+	return path, nil
+}
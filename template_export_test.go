@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTemplateExport(t *testing.T) {
+	sections := map[string]*Template{}
+	footer, err := ParseTemplate("<p>Bye {{name}}</p>")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sections["footer"] = footer
+
+	tests := []struct {
+		name     string
+		src      string
+		dialect  templateDialect
+		expected string
+	}{
+		{"handlebars variables", "Hi {{user.name}} {{{html}}}", dialectHandlebars, "Hi {{user.name}} {{{html}}}"},
+		{"handlebars default", `Hi {{name | default "there"}}`, dialectHandlebars, "Hi {{#if name}}{{name}}{{else}}there{{/if}}"},
+		{"handlebars each", "{{#each items}}{{@index}}:{{this.sku}}{{else}}none{{/each}}", dialectHandlebars, "{{#each items}}{{@index}}:{{this.sku}}{{else}}none{{/each}}"},
+		{"inlined section", "{{> footer}}", dialectHandlebars, "<p>Bye {{name}}</p>"},
+		{"legacy placeholder", "Hi -name-", dialectHandlebars, "Hi {{#if name}}{{name}}{{else}}-name-{{/if}}"},
+		{"mustache if else", "{{#if vip}}VIP{{else}}Guest{{/if}}", dialectMustache, "{{#vip}}VIP{{/vip}}{{^vip}}Guest{{/vip}}"},
+		{"mustache unless", "{{#unless vip}}Guest{{/unless}}", dialectMustache, "{{^vip}}Guest{{/vip}}"},
+		{"mustache each", "{{#each items}}{{this}} {{this.sku}}{{/each}}", dialectMustache, "{{#each items}}{{.}} {{sku}}{{/each}}"},
+		{"sparkpost if", "{{#if vip}}VIP{{else}}Guest{{/if}}", dialectSparkPost, "{{if vip}}VIP{{else}}Guest{{end}}"},
+		{"sparkpost each", "{{#each items}}{{this}} {{sku}}{{else}}none{{/each}}", dialectSparkPost, "{{each items}}{{loop_var}} {{loop_var.sku}}{{end}}{{if not items}}none{{end}}"},
+		{"escaped default", `{{name | default "<you>"}}`, dialectSparkPost, "{{if name}}{{name}}{{else}}&lt;you&gt;{{end}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseTemplate(tt.src)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			result, err := parsed.Export(tt.dialect, sections, true)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestTemplateExportUnsupported(t *testing.T) {
+	tests := []struct {
+		src     string
+		dialect templateDialect
+	}{
+		{"{{#each items}}{{@index}}{{/each}}", dialectMustache},
+		{"{{#each a}}{{#each b}}{{this}}{{/each}}{{/each}}", dialectSparkPost},
+		{"{{this}}", dialectSparkPost},
+	}
+
+	for _, tt := range tests {
+		parsed, err := ParseTemplate(tt.src)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := parsed.Export(tt.dialect, nil, false); !errors.Is(err, errUnsupportedTemplate) {
+			t.Errorf("Expected %q to be unsupported, got %v", tt.src, err)
+		}
+	}
+}
+
+func TestNativeTemplateFor(t *testing.T) {
+	emailMessage := EmailMessage{
+		Subject:          "Welcome",
+		nativeTemplateID: "tpl-1",
+		resolved: &resolvedTemplate{
+			subject:  "Welcome",
+			sections: map[string]bool{"footer": true},
+		},
+	}
+
+	if id, ok := emailMessage.nativeTemplateFor(Personalization{TemplateData: map[string]interface{}{"name": "Ann"}}); !ok || id != "tpl-1" {
+		t.Errorf("Expected the native template, got %q, %v", id, ok)
+	}
+	if _, ok := emailMessage.nativeTemplateFor(Personalization{Subject: "Different"}); ok {
+		t.Error("Expected a subject override to be rendered locally")
+	}
+	if _, ok := emailMessage.nativeTemplateFor(Personalization{Substitutions: map[string]string{"-closing-": "footer"}}); ok {
+		t.Error("Expected a value naming a section to be rendered locally")
+	}
+
+	emailMessage.nativeTemplateID = ""
+	if _, ok := emailMessage.nativeTemplateFor(Personalization{}); ok {
+		t.Error("Expected a message without a provider template to be rendered locally")
+	}
+}
@@ -9,28 +9,49 @@ func saveStandardizedEvent(event StandardizedEvent) error {
 	database.InitDB()
 	db := database.GetDB()
 
+	// The event row and the hourly rollups are updated together so the
+	// rollups never count an event the events table does not have
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	previous, err := lockEventFlags(tx, event.MessageID)
+	if err != nil {
+		return err
+	}
+
 	// First, try to update an existing record
-	stmt, err := db.Prepare(`
+	stmt, err := tx.Prepare(`
         UPDATE events SET
             provider = $2,
             processed = $3,
             processed_time = $4,
-            delivered = $5,
+            delivered = delivered OR $5,
             delivered_time = COALESCE($6, delivered_time),
-            bounce = $7,
+            bounce = bounce OR $7,
             bounce_type = COALESCE($8, bounce_type),
             bounce_time = COALESCE($9, bounce_time),
-            deferred = $10,
+            deferred = deferred OR $10,
             deferred_count = deferred_count + $11,
             last_deferral_time = COALESCE($12, last_deferral_time),
-            unique_open = $13,
+            unique_open = unique_open OR $13,
             unique_open_time = COALESCE($14, unique_open_time),
-            open = $15,
+            open = open OR $15,
             open_count = open_count + $16,
             last_open_time = COALESCE($17, last_open_time),
-            dropped = $18,
+            dropped = dropped OR $18,
             dropped_time = COALESCE($19, dropped_time),
-            dropped_reason = COALESCE($20, dropped_reason)
+            dropped_reason = COALESCE($20, dropped_reason),
+            recipient_domain = COALESCE(NULLIF($21, ''), recipient_domain),
+            mailbox_provider = COALESCE(NULLIF($22, ''), mailbox_provider),
+            spam_report = spam_report OR $23,
+            spam_report_time = COALESCE($24, spam_report_time),
+            click = click OR $25,
+            click_count = click_count + $26,
+            last_click_time = COALESCE($27, last_click_time),
+            correlation_id = COALESCE(NULLIF($28, ''), correlation_id)
         WHERE message_id = $1
         RETURNING message_id
     `)
@@ -61,18 +82,28 @@ func saveStandardizedEvent(event StandardizedEvent) error {
 		event.Dropped,
 		event.DroppedTime,
 		event.DroppedReason,
+		event.RecipientDomain,
+		event.MailboxProvider,
+		event.SpamReport,
+		event.SpamReportTime,
+		event.Click,
+		event.ClickCount,
+		event.LastClickTime,
+		event.CorrelationID,
 	).Scan(&updatedMessageID)
 
 	if err == sql.ErrNoRows {
 		// If no existing record was updated, insert a new one
-		insertStmt, err := db.Prepare(`
+		insertStmt, err := tx.Prepare(`
             INSERT INTO events (
                 message_id, provider, processed, processed_time, delivered, delivered_time,
                 bounce, bounce_type, bounce_time, deferred, deferred_count,
                 last_deferral_time, unique_open, unique_open_time, open, open_count, last_open_time,
-                dropped, dropped_time, dropped_reason
+                dropped, dropped_time, dropped_reason, recipient_domain, mailbox_provider,
+                spam_report, spam_report_time, click, click_count, last_click_time, correlation_id
             ) VALUES (
-                $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20
+                $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20,
+                NULLIF($21, ''), NULLIF($22, ''), $23, $24, $25, $26, $27, NULLIF($28, '')
             )
         `)
 		if err != nil {
@@ -101,6 +132,14 @@ func saveStandardizedEvent(event StandardizedEvent) error {
 			event.Dropped,
 			event.DroppedTime,
 			event.DroppedReason,
+			event.RecipientDomain,
+			event.MailboxProvider,
+			event.SpamReport,
+			event.SpamReportTime,
+			event.Click,
+			event.ClickCount,
+			event.LastClickTime,
+			event.CorrelationID,
 		)
 		if err != nil {
 			return err
@@ -109,5 +148,9 @@ func saveStandardizedEvent(event StandardizedEvent) error {
 		return err
 	}
 
-	return nil
+	if err := updateProviderRollup(tx, event, rollupDelta(previous, event)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }